@@ -0,0 +1,171 @@
+package bucket_quoter
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Adaptive (AIMD) Token Bucket
+//
+// Inflow of the wrapped bucket is raised additively while the backend is
+// healthy and cut multiplicatively on errors or latency spikes, staying
+// within [MinInflow, MaxInflow].
+
+type AdaptiveOptions struct {
+	MinInflow int64
+	MaxInflow int64
+
+	// tokens per second added to inflow on every healthy interval
+	IncreaseStep int64
+	// inflow multiplier applied on error or latency spike, 0 < f < 1
+	DecreaseFactor float64
+
+	// latency above the threshold is treated as a spike, 0 disables it
+	LatencyThreshold time.Duration
+
+	// inflow is changed at most once per interval
+	Interval time.Duration
+}
+
+type Outcome struct {
+	Success bool
+	Latency time.Duration
+}
+
+type AdaptiveQuoter struct {
+	*BucketQuoter
+
+	mutex sync.Mutex
+	opts  AdaptiveOptions
+
+	lastAdjust int64
+	unhealthy  bool
+
+	Stat *AdaptiveQuoterStat
+}
+
+type AdaptiveQuoterStat struct {
+	Increases int64
+	Decreases int64
+	Errors    int64
+	Spikes    int64
+}
+
+func (o *AdaptiveOptions) Validate() error {
+	if o.MinInflow <= 0 {
+		return errors.New("adaptive: min inflow must be positive")
+	}
+	if o.MaxInflow < o.MinInflow {
+		return errors.New("adaptive: max inflow is less than min inflow")
+	}
+	if o.IncreaseStep <= 0 {
+		return errors.New("adaptive: increase step must be positive")
+	}
+	if o.DecreaseFactor <= 0 || o.DecreaseFactor >= 1 {
+		return errors.New("adaptive: decrease factor must be within (0, 1)")
+	}
+	if o.Interval < 0 || o.LatencyThreshold < 0 {
+		return errors.New("adaptive: negative interval or latency threshold")
+	}
+	return nil
+}
+
+// NewAdaptiveQuoter wraps quoter, its current inflow is clamped to the
+// configured bounds right away.
+func NewAdaptiveQuoter(quoter *BucketQuoter, opts AdaptiveOptions) (*AdaptiveQuoter, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	a := &AdaptiveQuoter{
+		BucketQuoter: quoter,
+		opts:         opts,
+		lastAdjust:   quoter.timer.Now(),
+		Stat:         &AdaptiveQuoterStat{},
+	}
+	a.setInflow(a.clamp(quoter.InflowTokensPerSecond.Load()))
+
+	return a, nil
+}
+
+// PUBLIC
+
+func (a *AdaptiveQuoter) Report(o Outcome) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	spike := a.opts.LatencyThreshold > 0 && o.Latency > a.opts.LatencyThreshold
+	if !o.Success {
+		a.Stat.Errors += 1
+	}
+	if spike {
+		a.Stat.Spikes += 1
+	}
+
+	now := a.timer.Now()
+	due := a.timer.Duration(a.lastAdjust, now)*int64(time.Second)/a.timer.Resolution() >= int64(a.opts.Interval)
+
+	if !o.Success || spike {
+		// one cut per interval, a burst of failures caused by the
+		// same overload should not collapse inflow down to minimum
+		if due || !a.unhealthy {
+			a.decrease()
+			a.lastAdjust = now
+		}
+		a.unhealthy = true
+		return
+	}
+
+	if due {
+		if !a.unhealthy {
+			a.increase()
+		}
+		a.unhealthy = false
+		a.lastAdjust = now
+	}
+}
+
+func (a *AdaptiveQuoter) ReportSuccess(latency time.Duration) {
+	a.Report(Outcome{Success: true, Latency: latency})
+}
+
+func (a *AdaptiveQuoter) ReportError() {
+	a.Report(Outcome{Success: false})
+}
+
+func (a *AdaptiveQuoter) Inflow() int64 {
+	return a.InflowTokensPerSecond.Load()
+}
+
+// PRIVATE
+
+func (a *AdaptiveQuoter) increase() {
+	inflow := a.clamp(a.Inflow() + a.opts.IncreaseStep)
+	if inflow != a.Inflow() {
+		a.Stat.Increases += 1
+	}
+	a.setInflow(inflow)
+}
+
+func (a *AdaptiveQuoter) decrease() {
+	inflow := a.clamp(int64(float64(a.Inflow()) * a.opts.DecreaseFactor))
+	if inflow != a.Inflow() {
+		a.Stat.Decreases += 1
+	}
+	a.setInflow(inflow)
+}
+
+func (a *AdaptiveQuoter) clamp(inflow int64) int64 {
+	if inflow < a.opts.MinInflow {
+		return a.opts.MinInflow
+	}
+	if inflow > a.opts.MaxInflow {
+		return a.opts.MaxInflow
+	}
+	return inflow
+}
+
+func (a *AdaptiveQuoter) setInflow(inflow int64) {
+	a.Reconfigure(inflow, a.BucketTokensCapacity.Load())
+}
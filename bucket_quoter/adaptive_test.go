@@ -0,0 +1,60 @@
+package bucket_quoter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveQuoter(t *testing.T) {
+	timer := NewManualTimerMs(0)
+	quoter := NewBucketQuoterWithTimer(100, 100, true, nil, timer)
+
+	adaptive, err := NewAdaptiveQuoter(quoter, AdaptiveOptions{
+		MinInflow:        10,
+		MaxInflow:        120,
+		IncreaseStep:     10,
+		DecreaseFactor:   0.5,
+		LatencyThreshold: 200 * time.Millisecond,
+		Interval:         time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// additive increase once per healthy interval, capped by max
+	for i := 0; i < 5; i++ {
+		timer.Advance(time.Second)
+		adaptive.ReportSuccess(10 * time.Millisecond)
+	}
+	if adaptive.Inflow() != 120 {
+		t.Fatalf("expected inflow 120 after healthy intervals, got %d", adaptive.Inflow())
+	}
+
+	// multiplicative decrease, only once for errors within an interval
+	adaptive.ReportError()
+	adaptive.ReportError()
+	if adaptive.Inflow() != 60 {
+		t.Fatalf("expected inflow 60 after errors, got %d", adaptive.Inflow())
+	}
+
+	// latency spike is treated as an error
+	timer.Advance(time.Second)
+	adaptive.ReportSuccess(time.Second)
+	if adaptive.Inflow() != 30 {
+		t.Fatalf("expected inflow 30 after latency spike, got %d", adaptive.Inflow())
+	}
+
+	// first healthy interval after a cut does not increase, floor is min
+	timer.Advance(time.Second)
+	adaptive.ReportSuccess(10 * time.Millisecond)
+	if adaptive.Inflow() != 30 {
+		t.Fatalf("expected inflow 30 after recovery interval, got %d", adaptive.Inflow())
+	}
+	for i := 0; i < 3; i++ {
+		timer.Advance(time.Second)
+		adaptive.ReportError()
+	}
+	if adaptive.Inflow() != 10 {
+		t.Fatalf("expected inflow 10 at the floor, got %d", adaptive.Inflow())
+	}
+}
@@ -0,0 +1,197 @@
+package bucket_quoter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rate Limited Executor
+//
+// Runs tasks with bounded number of workers, every task spends its cost
+// from all the quoters before it runs. Like errgroup, the first error
+// cancels context of the executor and is returned by Wait, unless errors
+// are collected.
+//
+//	e, ctx := NewExecutor(ctx, ExecutorOptions{Workers: 8, Quoters: []*BucketQuoter{api}})
+//	for _, item := range items {
+//	    item := item
+//	    if err := e.Go(1, func(ctx context.Context) error { return call(ctx, item) }); err != nil {
+//	        break
+//	    }
+//	}
+//	err := e.Wait()
+
+type ExecutorOptions struct {
+	// workers running tasks, 1 if not set
+	Workers int
+	// tokens of task are taken from every quoter
+	Quoters []*BucketQuoter
+	// run all the tasks and return all the errors joined, instead of
+	// cancelling on the first one
+	CollectErrors bool
+}
+
+type Executor struct {
+	opts ExecutorOptions
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	workers chan struct{}
+	wg      sync.WaitGroup
+
+	errMutex sync.Mutex
+	errs     []error
+
+	Stat *ExecutorStat
+}
+
+// ExecutorStat is updated concurrently, read it with Progress
+type ExecutorStat struct {
+	Submitted atomic.Int64
+	Running   atomic.Int64
+	Succeeded atomic.Int64
+	Failed    atomic.Int64
+	// sum of costs of tasks run
+	TokensUsed atomic.Int64
+	UsecWaited atomic.Int64
+}
+
+// Progress is snapshot of ExecutorStat
+type Progress struct {
+	Submitted  int64
+	Running    int64
+	Succeeded  int64
+	Failed     int64
+	TokensUsed int64
+	Waited     time.Duration
+}
+
+// NewExecutor returns executor and its context, cancelled on the first
+// error (unless errors are collected) or when Wait returns
+func NewExecutor(ctx context.Context, opts ExecutorOptions) (*Executor, context.Context) {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &Executor{
+		opts:    opts,
+		ctx:     ctx,
+		cancel:  cancel,
+		workers: make(chan struct{}, opts.Workers),
+		Stat:    &ExecutorStat{},
+	}, ctx
+}
+
+// PUBLIC
+
+// Go blocks until worker is free and runs task on it. It fails if executor
+// context is done, task is not run then.
+func (e *Executor) Go(cost int64, task func(ctx context.Context) error) error {
+	if e.ctx.Err() != nil {
+		return context.Cause(e.ctx)
+	}
+
+	select {
+	case e.workers <- struct{}{}:
+	case <-e.ctx.Done():
+		return context.Cause(e.ctx)
+	}
+
+	e.Stat.Submitted.Add(1)
+	e.wg.Add(1)
+	go func() {
+		defer func() {
+			<-e.workers
+			e.wg.Done()
+		}()
+
+		if err := e.take(cost); err != nil {
+			e.fail(err)
+			return
+		}
+
+		e.Stat.Running.Add(1)
+		err := task(e.ctx)
+		e.Stat.Running.Add(-1)
+
+		if err != nil {
+			e.fail(err)
+			return
+		}
+		e.Stat.Succeeded.Add(1)
+	}()
+
+	return nil
+}
+
+// Wait waits for all the tasks run, returns the first error or all of them
+// joined if errors are collected
+func (e *Executor) Wait() error {
+	e.wg.Wait()
+	e.cancel(nil)
+
+	e.errMutex.Lock()
+	defer e.errMutex.Unlock()
+
+	if e.opts.CollectErrors {
+		return errors.Join(e.errs...)
+	}
+	if len(e.errs) > 0 {
+		return e.errs[0]
+	}
+	return nil
+}
+
+func (e *Executor) Progress() Progress {
+	return Progress{
+		Submitted:  e.Stat.Submitted.Load(),
+		Running:    e.Stat.Running.Load(),
+		Succeeded:  e.Stat.Succeeded.Load(),
+		Failed:     e.Stat.Failed.Load(),
+		TokensUsed: e.Stat.TokensUsed.Load(),
+		Waited:     time.Duration(e.Stat.UsecWaited.Load()) * time.Microsecond,
+	}
+}
+
+// PRIVATE
+
+func (e *Executor) take(cost int64) error {
+	start := time.Now()
+	defer func() {
+		e.Stat.UsecWaited.Add(time.Since(start).Microseconds())
+	}()
+
+	for i, q := range e.opts.Quoters {
+		if err := q.UseWithContext(e.ctx, cost); err != nil {
+			// task does not run, quoters charged are refunded
+			for _, charged := range e.opts.Quoters[:i] {
+				charged.Refund(cost)
+			}
+			return err
+		}
+	}
+	// cost of task, not of every quoter
+	e.Stat.TokensUsed.Add(cost)
+	return nil
+}
+
+func (e *Executor) fail(err error) {
+	e.Stat.Failed.Add(1)
+
+	e.errMutex.Lock()
+	defer e.errMutex.Unlock()
+
+	if !e.opts.CollectErrors {
+		if len(e.errs) > 0 {
+			// errors after the first one are caused by cancelling
+			return
+		}
+		e.cancel(err)
+	}
+	e.errs = append(e.errs, err)
+}
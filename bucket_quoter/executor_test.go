@@ -0,0 +1,119 @@
+package bucket_quoter
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExecutorLimits(t *testing.T) {
+	quoter := NewBucketQuoter(100, 10, true, nil)
+	// tokens used are counted once per task, not per quoter
+	shared := NewBucketQuoter(1000, 1000, true, nil)
+	e, _ := NewExecutor(context.Background(), ExecutorOptions{Workers: 4, Quoters: []*BucketQuoter{shared, quoter}})
+
+	var running, maxRunning atomic.Int64
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		err := e.Go(1, func(ctx context.Context) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				max := maxRunning.Load()
+				if n <= max || maxRunning.CompareAndSwap(max, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 11 tasks pass on full bucket, 19 wait for inflow of 100/s
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("expected tasks to be throttled, took %s", elapsed)
+	}
+	if maxRunning.Load() > 4 {
+		t.Fatalf("expected at most 4 tasks running, got %d", maxRunning.Load())
+	}
+	p := e.Progress()
+	if p.Submitted != 30 || p.Succeeded != 30 || p.Failed != 0 || p.Running != 0 || p.TokensUsed != 30 || p.Waited == 0 {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+}
+
+func TestExecutorFirstError(t *testing.T) {
+	failure := errors.New("failure")
+	e, ctx := NewExecutor(context.Background(), ExecutorOptions{Workers: 1})
+
+	if err := e.Go(1, func(context.Context) error { return failure }); err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+
+	// executor is cancelled, task is not run
+	if err := e.Go(1, func(context.Context) error { return nil }); err != failure {
+		t.Fatalf("expected the first error, got %v", err)
+	}
+	if err := e.Wait(); err != failure {
+		t.Fatalf("expected the first error, got %v", err)
+	}
+	if p := e.Progress(); p.Submitted != 1 || p.Failed != 1 {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+}
+
+func TestExecutorCollectErrors(t *testing.T) {
+	first, second := errors.New("first"), errors.New("second")
+	e, _ := NewExecutor(context.Background(), ExecutorOptions{Workers: 2, CollectErrors: true})
+
+	for _, err := range []error{first, nil, second} {
+		err := err
+		if err := e.Go(1, func(context.Context) error { return err }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := e.Wait()
+	if !errors.Is(err, first) || !errors.Is(err, second) {
+		t.Fatalf("expected both errors, got %v", err)
+	}
+	if p := e.Progress(); p.Succeeded != 1 || p.Failed != 2 {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+}
+
+func TestExecutorCancel(t *testing.T) {
+	// bucket in debt for 10s
+	quoter := NewBucketQuoter(1, 1, false, nil)
+	quoter.Use(10)
+	shared := NewBucketQuoter(1, 10, true, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e, _ := NewExecutor(ctx, ExecutorOptions{Quoters: []*BucketQuoter{shared, quoter}})
+
+	var ran atomic.Bool
+	e.Go(1, func(context.Context) error {
+		ran.Store(true)
+		return nil
+	})
+	cancel()
+
+	if err := e.Wait(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	if ran.Load() {
+		t.Fatal("expected task waiting for tokens not to run")
+	}
+	if shared.GetAvailable() != 10 || e.Progress().TokensUsed != 0 {
+		t.Fatalf("expected shared quoter to be refunded, available %d", shared.GetAvailable())
+	}
+}
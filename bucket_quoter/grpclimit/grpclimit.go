@@ -0,0 +1,254 @@
+// Package grpclimit provides gRPC interceptors limiting calls (and
+// messages within streams) by buckets of bucket_quoter.
+//
+// Denied call fails with codes.ResourceExhausted, status carries
+// errdetails.RetryInfo with delay until bucket gets available.
+//
+//	limiter := bucket_quoter.NewKeyedQuoter(10, 10, 10000)
+//	s := grpc.NewServer(
+//	    grpc.ChainUnaryInterceptor(grpclimit.UnaryServerInterceptor(grpclimit.Options{
+//	        Key: grpclimit.MetadataKey("x-limiter-subscription-id"), Limiter: limiter,
+//	    })),
+//	    grpc.ChainStreamInterceptor(grpclimit.StreamServerInterceptor(grpclimit.Options{
+//	        Key: grpclimit.PeerKey(), Limiter: limiter, MaxWait: time.Second,
+//	    })),
+//	)
+package grpclimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// KeyFunc extracts key of the bucket from call
+type KeyFunc func(ctx context.Context, fullMethod string) (string, error)
+
+// Limiter returns bucket of the key, nil if key is not allowed at all.
+// KeyedQuoter is the one.
+type Limiter interface {
+	Get(key string) *bucket_quoter.BucketQuoter
+}
+
+var ErrNoKey = errors.New("grpclimit: no key in call")
+
+type Options struct {
+	Key     KeyFunc
+	Limiter Limiter
+
+	// tokens charged for call, 1 if not set
+	Cost func(fullMethod string) int64
+	// tokens charged for every message of stream, 0 limits stream
+	// creation only
+	MessageCost int64
+
+	// 0 fails fast, otherwise call waits for bucket up to MaxWait (or
+	// call deadline)
+	MaxWait time.Duration
+}
+
+func (o *Options) cost(fullMethod string) int64 {
+	if o.Cost == nil {
+		return 1
+	}
+	return o.Cost(fullMethod)
+}
+
+// MetadataKey takes key from incoming (server) or outgoing (client)
+// metadata
+func MetadataKey(name string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(name); len(values) > 0 && values[0] != "" {
+				return values[0], nil
+			}
+		}
+		if md, ok := metadata.FromOutgoingContext(ctx); ok {
+			if values := md.Get(name); len(values) > 0 && values[0] != "" {
+				return values[0], nil
+			}
+		}
+		return "", ErrNoKey
+	}
+}
+
+// PeerKey takes key from peer address (host only)
+func PeerKey() KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		p, ok := peer.FromContext(ctx)
+		if !ok || p.Addr == nil {
+			return "", ErrNoKey
+		}
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			return p.Addr.String(), nil
+		}
+		return host, nil
+	}
+}
+
+// MethodKey takes full method name as key
+func MethodKey() KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		return fullMethod, nil
+	}
+}
+
+// take charges call, returns status error if denied
+func (o *Options) take(ctx context.Context, fullMethod string, cost int64) error {
+	key, err := o.Key(ctx, fullMethod)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	q := o.Limiter.Get(key)
+	if q == nil {
+		return status.Error(codes.PermissionDenied, "grpclimit: key is not allowed")
+	}
+
+	return o.takeBucket(ctx, q, cost)
+}
+
+func (o *Options) takeBucket(ctx context.Context, q *bucket_quoter.BucketQuoter, cost int64) error {
+	if q.TryUse(cost) {
+		return nil
+	}
+
+	if o.MaxWait > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, o.MaxWait)
+		defer cancel()
+
+		err := q.UseWithContext(waitCtx, cost)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// call itself is cancelled or timed out
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+
+	return exhausted(time.Duration(q.GetWaitTime()) * time.Microsecond)
+}
+
+func exhausted(wait time.Duration) error {
+	s := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	if d, err := s.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)}); err == nil {
+		s = d
+	}
+	return s.Err()
+}
+
+// RetryDelay returns delay suggested by denial, false if err is not one
+func RetryDelay(err error) (time.Duration, bool) {
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != codes.ResourceExhausted {
+		return 0, false
+	}
+	for _, d := range s.Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			return info.GetRetryDelay().AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// SERVER
+
+func UnaryServerInterceptor(opts Options) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if err := opts.take(ctx, info.FullMethod, opts.cost(info.FullMethod)); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor charges stream creation and, with MessageCost,
+// every message received within the stream
+func StreamServerInterceptor(opts Options) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		if err := opts.take(ctx, info.FullMethod, opts.cost(info.FullMethod)); err != nil {
+			return err
+		}
+		if opts.MessageCost <= 0 {
+			return handler(srv, ss)
+		}
+
+		// key is resolved once per stream
+		key, _ := opts.Key(ctx, info.FullMethod)
+		return handler(srv, &serverStream{ServerStream: ss, opts: &opts, q: opts.Limiter.Get(key)})
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+
+	opts *Options
+	q    *bucket_quoter.BucketQuoter
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.opts.takeBucket(s.Context(), s.q, s.opts.MessageCost)
+}
+
+// CLIENT
+
+// UnaryClientInterceptor denies call locally, before it is sent
+func UnaryClientInterceptor(opts Options) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		if err := opts.take(ctx, method, opts.cost(method)); err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, callOpts...)
+	}
+}
+
+// StreamClientInterceptor charges stream creation and, with MessageCost,
+// every message sent within the stream
+func StreamClientInterceptor(opts Options) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if err := opts.take(ctx, method, opts.cost(method)); err != nil {
+			return nil, err
+		}
+		cs, err := streamer(ctx, desc, cc, method, callOpts...)
+		if err != nil || opts.MessageCost <= 0 {
+			return cs, err
+		}
+
+		key, _ := opts.Key(ctx, method)
+		return &clientStream{ClientStream: cs, opts: &opts, q: opts.Limiter.Get(key)}, nil
+	}
+}
+
+type clientStream struct {
+	grpc.ClientStream
+
+	opts *Options
+	q    *bucket_quoter.BucketQuoter
+}
+
+func (s *clientStream) SendMsg(m interface{}) error {
+	if err := s.opts.takeBucket(s.Context(), s.q, s.opts.MessageCost); err != nil {
+		return err
+	}
+	return s.ClientStream.SendMsg(m)
+}
@@ -0,0 +1,198 @@
+package grpclimit
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// test service: unary Ping and bidirectional Echo of empty messages
+type testServer interface{}
+
+var testDesc = grpc.ServiceDesc{
+	ServiceName: "test.Test",
+	HandlerType: (*testServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Ping",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+			interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := &emptypb.Empty{}
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return &emptypb.Empty{}, nil
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{FullMethod: "/test.Test/Ping"}, handler)
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Echo",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			for {
+				m := &emptypb.Empty{}
+				if err := stream.RecvMsg(m); err != nil {
+					if err == io.EOF {
+						return nil
+					}
+					return err
+				}
+				if err := stream.SendMsg(m); err != nil {
+					return err
+				}
+			}
+		},
+	}},
+}
+
+func dial(t *testing.T, server []grpc.ServerOption, client ...grpc.DialOption) *grpc.ClientConn {
+	l := bufconn.Listen(1 << 16)
+	s := grpc.NewServer(server...)
+	s.RegisterService(&testDesc, struct{}{})
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	client = append(client,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}))
+	cc, err := grpc.NewClient("passthrough:///bufnet", client...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	return cc
+}
+
+func ping(cc *grpc.ClientConn, key string) error {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-key", key)
+	return cc.Invoke(ctx, "/test.Test/Ping", &emptypb.Empty{}, &emptypb.Empty{})
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	limiter := bucket_quoter.NewKeyedQuoterWithFactory(func(key string) *bucket_quoter.BucketQuoter {
+		if key == "unknown" {
+			return nil
+		}
+		return bucket_quoter.NewBucketQuoter(1, 2, true, nil)
+	}, 0)
+	cc := dial(t, []grpc.ServerOption{grpc.UnaryInterceptor(UnaryServerInterceptor(Options{
+		Key: MetadataKey("x-key"), Limiter: limiter,
+	}))})
+
+	// bucket goes into debt by the last call
+	for i := 0; i < 3; i++ {
+		if err := ping(cc, "a"); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+
+	err := ping(cc, "a")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	if delay, ok := RetryDelay(err); !ok || delay <= 0 || delay > time.Second {
+		t.Fatalf("expected retry delay within a second, got %s %v", delay, ok)
+	}
+
+	// buckets are per key
+	if err := ping(cc, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(cc, "unknown"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+	if err := cc.Invoke(context.Background(), "/test.Test/Ping", &emptypb.Empty{}, &emptypb.Empty{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	limiter := bucket_quoter.NewKeyedQuoter(1, 3, 0)
+	cc := dial(t, []grpc.ServerOption{grpc.StreamInterceptor(StreamServerInterceptor(Options{
+		Key: PeerKey(), Limiter: limiter, MessageCost: 1,
+	}))})
+
+	stream, err := cc.NewStream(context.Background(), &testDesc.Streams[0], "/test.Test/Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stream itself takes one token, three messages pass
+	for i := 0; i < 3; i++ {
+		if err := stream.SendMsg(&emptypb.Empty{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+
+	stream.SendMsg(&emptypb.Empty{})
+	if err := stream.RecvMsg(&emptypb.Empty{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	limiter := bucket_quoter.NewKeyedQuoter(1, 2, 0)
+	opts := Options{Key: MethodKey(), Limiter: limiter, MessageCost: 1}
+	cc := dial(t, nil,
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor(opts)),
+		grpc.WithStreamInterceptor(StreamClientInterceptor(opts)))
+
+	for i := 0; i < 3; i++ {
+		if err := ping(cc, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ping(cc, ""); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+
+	// stream takes one token, two messages the rest
+	stream, err := cc.NewStream(context.Background(), &testDesc.Streams[0], "/test.Test/Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.SendMsg(&emptypb.Empty{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.SendMsg(&emptypb.Empty{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+}
+
+func TestMaxWait(t *testing.T) {
+	limiter := bucket_quoter.NewKeyedQuoter(20, 1, 0)
+	cc := dial(t, []grpc.ServerOption{grpc.UnaryInterceptor(UnaryServerInterceptor(Options{
+		Key: MetadataKey("x-key"), Limiter: limiter, MaxWait: time.Second,
+	}))})
+
+	// the third call waits for the bucket instead of failing
+	for i := 0; i < 3; i++ {
+		if err := ping(cc, "a"); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package httplimit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+// Rate limit headers of IETF draft "RateLimit header fields for HTTP"
+const (
+	HeaderLimit      = "RateLimit-Limit"
+	HeaderRemaining  = "RateLimit-Remaining"
+	HeaderReset      = "RateLimit-Reset"
+	HeaderPolicy     = "RateLimit-Policy"
+	HeaderRetryAfter = "Retry-After"
+)
+
+// State is rate limit state of bucket as reported to clients
+type State struct {
+	// bucket capacity
+	Limit int64
+	// tokens available now
+	Remaining int64
+	// until bucket is full again
+	Reset time.Duration
+	// until bucket is available, 0 if it is
+	RetryAfter time.Duration
+	// window bucket capacity is refilled within
+	Window time.Duration
+}
+
+func BucketState(q *bucket_quoter.BucketQuoter) State {
+	inflow := q.InflowTokensPerSecond.Load()
+	capacity := q.BucketTokensCapacity.Load()
+	available := q.GetAvailable()
+
+	s := State{
+		Limit:      capacity,
+		Remaining:  available,
+		RetryAfter: time.Duration(q.GetWaitTime()) * time.Microsecond,
+	}
+	if inflow > 0 {
+		s.Reset = time.Duration((capacity-available)*int64(time.Second)/inflow) + s.RetryAfter
+		s.Window = time.Duration(capacity * int64(time.Second) / inflow)
+	}
+
+	return s
+}
+
+// SetHeaders sets rate limit headers, Retry-After only if request is denied
+// and bucket is not available, request allowed into debt has no
+// Retry-After. Durations are rounded up to whole seconds.
+func SetHeaders(h http.Header, s State, denied bool) {
+	h.Set(HeaderLimit, strconv.FormatInt(s.Limit, 10))
+	h.Set(HeaderRemaining, strconv.FormatInt(s.Remaining, 10))
+	h.Set(HeaderReset, strconv.FormatInt(Seconds(s.Reset), 10))
+	h.Set(HeaderPolicy, fmt.Sprintf("%d;w=%d", s.Limit, Seconds(s.Window)))
+	if denied && s.RetryAfter > 0 {
+		h.Set(HeaderRetryAfter, strconv.FormatInt(Seconds(s.RetryAfter), 10))
+	}
+}
+
+// Seconds rounds duration up to whole seconds
+func Seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
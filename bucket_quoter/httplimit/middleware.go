@@ -0,0 +1,176 @@
+package httplimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+// Middleware limits requests by bucket of the request key. Denied request
+// gets 429 with rate limit headers, passed one gets rate limit headers too.
+//
+// net/http:
+//
+//	mw := httplimit.New(httplimit.Options{
+//	    Key:     httplimit.HeaderKey("X-Limiter-Subscription-ID"),
+//	    Limiter: bucket_quoter.NewKeyedQuoter(10, 10, 10000),
+//	})
+//	http.ListenAndServe(":8080", mw.Handler(mux))
+//
+// gin:
+//
+//	r.Use(func(c *gin.Context) {
+//	    if !mw.Allow(c.Writer, c.Request) {
+//	        c.Abort()
+//	        return
+//	    }
+//	    c.Next()
+//	})
+
+// KeyFunc extracts key of the bucket from request
+type KeyFunc func(r *http.Request) (string, error)
+
+// Limiter returns bucket of the key, nil if key is not allowed at all.
+// KeyedQuoter is the one.
+type Limiter interface {
+	Get(key string) *bucket_quoter.BucketQuoter
+}
+
+var ErrNoKey = errors.New("httplimit: no key in request")
+
+type Options struct {
+	Key     KeyFunc
+	Limiter Limiter
+
+	// tokens charged for request, 1 if not set
+	Cost func(r *http.Request) int64
+
+	// 0 fails fast, otherwise request waits for bucket up to MaxWait
+	// (or request context deadline)
+	MaxWait time.Duration
+
+	// replies to the request denied, plain 429 if not set
+	OnDenied http.Handler
+	// replies to the request without key, plain 400 if not set
+	OnKeyError func(w http.ResponseWriter, r *http.Request, err error)
+	// replies to the request with key limiter does not know, plain 403
+	// if not set
+	OnUnknownKey http.Handler
+}
+
+type Middleware struct {
+	opts Options
+}
+
+func New(opts Options) *Middleware {
+	if opts.Cost == nil {
+		opts.Cost = func(*http.Request) int64 { return 1 }
+	}
+	if opts.OnDenied == nil {
+		opts.OnDenied = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		})
+	}
+	if opts.OnKeyError == nil {
+		opts.OnKeyError = func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+	if opts.OnUnknownKey == nil {
+		opts.OnUnknownKey = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}
+
+	return &Middleware{opts: opts}
+}
+
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Allow(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Allow charges request, sets headers and returns true if it may proceed,
+// otherwise reply is written already
+func (m *Middleware) Allow(w http.ResponseWriter, r *http.Request) bool {
+	key, err := m.opts.Key(r)
+	if err != nil {
+		m.opts.OnKeyError(w, r, err)
+		return false
+	}
+
+	q := m.opts.Limiter.Get(key)
+	if q == nil {
+		m.opts.OnUnknownKey.ServeHTTP(w, r)
+		return false
+	}
+
+	if !m.take(r.Context(), q, m.opts.Cost(r)) {
+		SetHeaders(w.Header(), BucketState(q), true)
+		m.opts.OnDenied.ServeHTTP(w, r)
+		return false
+	}
+
+	SetHeaders(w.Header(), BucketState(q), false)
+	return true
+}
+
+func (m *Middleware) take(ctx context.Context, q *bucket_quoter.BucketQuoter, cost int64) bool {
+	if q.TryUse(cost) {
+		return true
+	}
+	if m.opts.MaxWait <= 0 {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.opts.MaxWait)
+	defer cancel()
+
+	return q.UseWithContext(ctx, cost) == nil
+}
+
+// HeaderKey takes key from request header
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		if key := r.Header.Get(name); key != "" {
+			return key, nil
+		}
+		return "", ErrNoKey
+	}
+}
+
+// IPKey takes key from client address, with trustProxy the first address
+// of X-Forwarded-For is used if present
+func IPKey(trustProxy bool) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		if trustProxy {
+			if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+				return strings.TrimSpace(strings.Split(forwarded, ",")[0]), nil
+			}
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			// unix socket or address without port
+			host = r.RemoteAddr
+		}
+		if host == "" {
+			return "", ErrNoKey
+		}
+		return host, nil
+	}
+}
+
+// PathKey takes key from request path
+func PathKey() KeyFunc {
+	return func(r *http.Request) (string, error) {
+		return r.URL.Path, nil
+	}
+}
@@ -0,0 +1,84 @@
+package httplimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+func TestMiddleware(t *testing.T) {
+	mw := New(Options{
+		Key:     HeaderKey("X-Limiter-Subscription-ID"),
+		Limiter: bucket_quoter.NewKeyedQuoter(1, 2, 10),
+	})
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	do := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		if key != "" {
+			r.Header.Set("X-Limiter-Subscription-ID", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do(""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without key, got %d", w.Code)
+	}
+
+	// capacity 2, empty bucket still passes once
+	for i := 0; i < 3; i++ {
+		// request allowed into debt is not told to retry
+		if w := do("a"); w.Code != http.StatusOK || w.Header().Get(HeaderRetryAfter) != "" {
+			t.Fatalf("request %d: expected 200 without Retry-After, got %d %v", i, w.Code, w.Header())
+		}
+	}
+
+	w := do("a")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	if w.Header().Get(HeaderRetryAfter) != "1" || w.Header().Get(HeaderLimit) != "2" ||
+		w.Header().Get(HeaderRemaining) != "0" || w.Header().Get(HeaderPolicy) != "2;w=2" {
+		t.Fatalf("unexpected headers %v", w.Header())
+	}
+
+	// other key has its own bucket
+	if w := do("b"); w.Code != http.StatusOK || w.Header().Get(HeaderRemaining) != "1" {
+		t.Fatalf("expected 200 with 1 remaining, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestMiddlewareWait(t *testing.T) {
+	limiter := bucket_quoter.NewKeyedQuoter(20, 1, 0)
+	mw := New(Options{Key: PathKey(), Limiter: limiter, MaxWait: time.Second})
+
+	r := httptest.NewRequest("GET", "/export", nil)
+	for i := 0; i < 2; i++ {
+		if !mw.Allow(httptest.NewRecorder(), r) {
+			t.Fatalf("request %d: expected to pass", i)
+		}
+	}
+
+	// 50ms debt is paid off within max wait
+	began := time.Now()
+	if !mw.Allow(httptest.NewRecorder(), r) {
+		t.Fatal("expected request to wait and pass")
+	}
+	if time.Since(began) < 40*time.Millisecond {
+		t.Fatalf("expected request to wait, waited %s", time.Since(began))
+	}
+
+	// wait above max fails fast
+	limiter.Get("/export").Use(100)
+	began = time.Now()
+	if mw.Allow(httptest.NewRecorder(), r) || time.Since(began) > 100*time.Millisecond {
+		t.Fatalf("expected request to fail fast, waited %s", time.Since(began))
+	}
+}
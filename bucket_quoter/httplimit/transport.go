@@ -0,0 +1,260 @@
+package httplimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+// Transport limits outgoing requests, e.g. calls of third party API with
+// strict quota. Request takes tokens of its host bucket (and/or asks the
+// quoter server) before it is sent, rate limit headers of response are fed
+// back into the bucket, so it follows the real limits of upstream.
+//
+//	limiter := bucket_quoter.NewKeyedQuoterWithFactory(func(host string) *bucket_quoter.BucketQuoter {
+//	    if host == "api.example.com" {
+//	        return bucket_quoter.NewBucketQuoter(10, 10, true, nil)
+//	    }
+//	    return nil // not limited
+//	}, 0)
+//	client := &http.Client{Transport: httplimit.NewTransport(httplimit.TransportOptions{Limiter: limiter})}
+
+// Remote asks the limiter elsewhere for tokens, returns true if request may
+// be sent or delay suggested before asking again
+type Remote interface {
+	Take(ctx context.Context, key string, cost int64) (bool, time.Duration, error)
+}
+
+// RateLimitError is returned when request could not get tokens in time
+type RateLimitError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("httplimit: rate limit of '%s' exceeded, retry after %s", e.Key, e.RetryAfter)
+}
+
+type TransportOptions struct {
+	// http.DefaultTransport if not set
+	Base http.RoundTripper
+
+	// bucket of the key, nil bucket does not limit
+	Limiter Limiter
+	// asked after local bucket, optional
+	Remote Remote
+
+	// host of request URL if not set
+	Key KeyFunc
+	// tokens charged for request, 1 if not set
+	Cost func(r *http.Request) int64
+
+	// 0 waits as long as request context allows
+	MaxWait time.Duration
+}
+
+type Transport struct {
+	opts TransportOptions
+}
+
+func NewTransport(opts TransportOptions) *Transport {
+	if opts.Base == nil {
+		opts.Base = http.DefaultTransport
+	}
+	if opts.Key == nil {
+		opts.Key = func(r *http.Request) (string, error) {
+			return r.URL.Hostname(), nil
+		}
+	}
+	if opts.Cost == nil {
+		opts.Cost = func(*http.Request) int64 { return 1 }
+	}
+
+	return &Transport{opts: opts}
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	key, err := t.opts.Key(r)
+	if err != nil {
+		closeBody(r)
+		return nil, err
+	}
+
+	var q *bucket_quoter.BucketQuoter
+	if t.opts.Limiter != nil {
+		q = t.opts.Limiter.Get(key)
+	}
+	if q == nil && t.opts.Remote == nil {
+		return t.opts.Base.RoundTrip(r)
+	}
+
+	ctx := r.Context()
+	if t.opts.MaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.opts.MaxWait)
+		defer cancel()
+	}
+
+	cost := t.opts.Cost(r)
+	if q != nil {
+		if err := q.UseWithContext(ctx, cost); err != nil {
+			closeBody(r)
+			return nil, t.denied(r, key, time.Duration(q.GetWaitTime())*time.Microsecond)
+		}
+	}
+	if t.opts.Remote != nil {
+		if err := t.takeRemote(ctx, key, cost); err != nil {
+			if q != nil {
+				// request is not sent, local tokens are given back
+				q.Refund(cost)
+			}
+			closeBody(r)
+			return nil, err
+		}
+	}
+
+	resp, err := t.opts.Base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	if q != nil {
+		feedback(q, resp)
+	}
+
+	return resp, nil
+}
+
+// PRIVATE
+
+func (t *Transport) takeRemote(ctx context.Context, key string, cost int64) error {
+	for {
+		ok, retryAfter, err := t.opts.Remote.Take(ctx, key, cost)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < retryAfter {
+			return &RateLimitError{Key: key, RetryAfter: retryAfter}
+		}
+
+		timer := time.NewTimer(retryAfter)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return &RateLimitError{Key: key, RetryAfter: retryAfter}
+		}
+	}
+}
+
+func (t *Transport) denied(r *http.Request, key string, retryAfter time.Duration) error {
+	if err := r.Context().Err(); err != nil {
+		// request itself is cancelled
+		return err
+	}
+	return &RateLimitError{Key: key, RetryAfter: retryAfter}
+}
+
+// RoundTripper closes request body even if request is not sent
+func closeBody(r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
+
+// feedback adjusts bucket to rate limit headers of upstream
+func feedback(q *bucket_quoter.BucketQuoter, resp *http.Response) {
+	if remaining, err := strconv.ParseInt(resp.Header.Get(HeaderRemaining), 10, 64); err == nil {
+		q.Restrict(remaining)
+		if remaining <= 0 {
+			if reset, ok := parseSeconds(resp.Header.Get(HeaderReset)); ok {
+				q.Block(reset)
+			}
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if retryAfter, ok := ParseRetryAfter(resp.Header.Get(HeaderRetryAfter)); ok {
+			q.Block(retryAfter)
+		}
+	}
+}
+
+// ParseRetryAfter parses Retry-After given as seconds or HTTP date
+func ParseRetryAfter(value string) (time.Duration, bool) {
+	if d, ok := parseSeconds(value); ok {
+		return d, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func parseSeconds(value string) (time.Duration, bool) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// QuoterServer asks quoter server (bucket_quoter_example/quoter) for tokens
+// of subscription
+type QuoterServer struct {
+	// e.g. "http://localhost:8080"
+	URL string
+	// http.DefaultClient if not set
+	Client *http.Client
+}
+
+var (
+	ErrUnknownSubscription  = errors.New("httplimit: subscription is unknown to quoter server")
+	ErrSubscriptionRequired = errors.New("httplimit: quoter server requires subscription key")
+)
+
+func (s *QuoterServer) Take(ctx context.Context, key string, cost int64) (bool, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/limiter", nil)
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("X-Limiter-Subscription-ID", key)
+	req.Header.Set("X-Limiter-Cost", strconv.FormatInt(cost, 10))
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, 0, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, 0, nil
+	case http.StatusTooManyRequests:
+		retryAfter, _ := ParseRetryAfter(resp.Header.Get(HeaderRetryAfter))
+		return false, retryAfter, nil
+	case http.StatusForbidden:
+		return false, 0, ErrUnknownSubscription
+	case http.StatusUnauthorized:
+		return false, 0, ErrSubscriptionRequired
+	}
+
+	return false, 0, fmt.Errorf("httplimit: quoter server replied %d", resp.StatusCode)
+}
@@ -0,0 +1,162 @@
+package httplimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+func TestTransportLimitsHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	limiter := bucket_quoter.NewKeyedQuoterWithFactory(func(host string) *bucket_quoter.BucketQuoter {
+		if host == "127.0.0.1" {
+			return bucket_quoter.NewBucketQuoter(1, 1, true, nil)
+		}
+		return nil
+	}, 0)
+	client := &http.Client{Transport: NewTransport(TransportOptions{Limiter: limiter, MaxWait: 50 * time.Millisecond})}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		resp.Body.Close()
+	}
+
+	_, err := client.Get(upstream.URL)
+	var rateLimited *RateLimitError
+	if !errors.As(err, &rateLimited) || rateLimited.Key != "127.0.0.1" || rateLimited.RetryAfter <= 0 {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+
+	// host without bucket is not limited
+	limiter.Delete("127.0.0.1")
+	transport := NewTransport(TransportOptions{Limiter: limiter, Key: func(*http.Request) (string, error) {
+		return "other", nil
+	}})
+	for i := 0; i < 5; i++ {
+		resp, err := (&http.Client{Transport: transport}).Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestTransportFeedback(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.Header().Set(HeaderRemaining, "0")
+			w.Header().Set(HeaderReset, "5")
+		case 2:
+			w.Header().Set(HeaderRetryAfter, "5")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer upstream.Close()
+
+	// upstream says no budget left for 5s
+	q := bucket_quoter.NewBucketQuoter(10, 10, true, nil)
+	limiter := bucket_quoter.NewKeyedQuoterWithFactory(func(string) *bucket_quoter.BucketQuoter { return q }, 0)
+	client := &http.Client{Transport: NewTransport(TransportOptions{Limiter: limiter, MaxWait: 50 * time.Millisecond})}
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if wait := time.Duration(q.GetWaitTime()) * time.Microsecond; wait < 4*time.Second {
+		t.Fatalf("expected bucket blocked for 5s, got %s", wait)
+	}
+	if _, err := client.Get(upstream.URL); err == nil {
+		t.Fatal("expected request to be held back")
+	}
+
+	// 429 with Retry-After blocks bucket as well
+	q = bucket_quoter.NewBucketQuoter(10, 10, true, nil)
+	limiter.Delete("127.0.0.1")
+	resp, err = client.Get(upstream.URL)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+	if q.IsAvailable() {
+		t.Fatal("expected bucket blocked by Retry-After")
+	}
+}
+
+func TestTransportRemote(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("X-Limiter-Subscription-ID") {
+		case "known":
+			if calls.Add(1) == 1 {
+				w.Header().Set(HeaderRetryAfter, "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+		case "":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	remote := &QuoterServer{URL: server.URL}
+	ok, retryAfter, err := remote.Take(context.Background(), "known", 1)
+	if ok || retryAfter != 0 || err != nil {
+		t.Fatalf("expected denial, got %v %s %v", ok, retryAfter, err)
+	}
+	if ok, _, err := remote.Take(context.Background(), "known", 1); !ok || err != nil {
+		t.Fatalf("expected tokens, got %v %v", ok, err)
+	}
+	if _, _, err := remote.Take(context.Background(), "unknown", 1); err != ErrUnknownSubscription {
+		t.Fatalf("expected unknown subscription, got %v", err)
+	}
+	if _, _, err := remote.Take(context.Background(), "", 1); err != ErrSubscriptionRequired {
+		t.Fatalf("expected subscription required, got %v", err)
+	}
+
+	// denied request waits and asks again
+	calls.Store(0)
+	client := &http.Client{Transport: NewTransport(TransportOptions{
+		Remote: remote,
+		Key:    func(*http.Request) (string, error) { return "known", nil },
+	})}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if calls.Load() != 2 {
+		t.Fatalf("expected two asks, got %d", calls.Load())
+	}
+
+	// local tokens are given back if remote denies
+	local := bucket_quoter.NewBucketQuoter(1, 10, true, nil)
+	client = &http.Client{Transport: NewTransport(TransportOptions{
+		Limiter: bucket_quoter.NewKeyedQuoterWithFactory(func(string) *bucket_quoter.BucketQuoter { return local }, 0),
+		Remote:  remote,
+		Key:     func(*http.Request) (string, error) { return "unknown", nil },
+	})}
+	if _, err := client.Get(server.URL); !errors.Is(err, ErrUnknownSubscription) {
+		t.Fatalf("expected unknown subscription, got %v", err)
+	}
+	if local.GetAvailable() != 10 || local.Stat.MsgPassed != 0 {
+		t.Fatalf("expected local bucket to be refunded, available %d", local.GetAvailable())
+	}
+}
@@ -0,0 +1,137 @@
+// Package iolimit throttles byte streams by buckets of bucket_quoter, one
+// token is one byte.
+//
+// Wrapper takes one or more buckets, bucket may be own one of the wrapper
+// or shared across many of them (all connections of a listener, all
+// exports of a process). Data is passed in chunks of at most the smallest
+// capacity of the buckets, so single write can not overdraw bucket beyond
+// its capacity.
+//
+//	export := bucket_quoter.NewBucketQuoter(10<<20, 1<<20, true, nil) // 10MB/s
+//	w := iolimit.NewWriter(file, export)
+//	io.Copy(w, r)
+package iolimit
+
+import (
+	"context"
+	"io"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+type Reader struct {
+	r      io.Reader
+	ctx    context.Context
+	limits []*bucket_quoter.BucketQuoter
+}
+
+func NewReader(r io.Reader, limits ...*bucket_quoter.BucketQuoter) *Reader {
+	return NewReaderContext(context.Background(), r, limits...)
+}
+
+// NewReaderContext creates reader waiting for buckets until context is done
+func NewReaderContext(ctx context.Context, r io.Reader, limits ...*bucket_quoter.BucketQuoter) *Reader {
+	return &Reader{r: r, ctx: ctx, limits: limits}
+}
+
+// Read reserves up to chunk of bytes before reading and gives back bytes
+// not read
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 || len(r.limits) == 0 {
+		return r.r.Read(p)
+	}
+	if chunk := chunkSize(r.limits); len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	want := int64(len(p))
+	if err := use(r.ctx, r.limits, want); err != nil {
+		return 0, err
+	}
+
+	n, err := r.r.Read(p)
+	if unused := want - int64(n); unused > 0 {
+		for _, q := range r.limits {
+			q.Add(unused)
+		}
+	}
+
+	return n, err
+}
+
+type Writer struct {
+	w      io.Writer
+	ctx    context.Context
+	limits []*bucket_quoter.BucketQuoter
+}
+
+func NewWriter(w io.Writer, limits ...*bucket_quoter.BucketQuoter) *Writer {
+	return NewWriterContext(context.Background(), w, limits...)
+}
+
+// NewWriterContext creates writer waiting for buckets until context is done
+func NewWriterContext(ctx context.Context, w io.Writer, limits ...*bucket_quoter.BucketQuoter) *Writer {
+	return &Writer{w: w, ctx: ctx, limits: limits}
+}
+
+// Write splits p into chunks, every chunk waits for buckets
+func (w *Writer) Write(p []byte) (int, error) {
+	if len(w.limits) == 0 {
+		return w.w.Write(p)
+	}
+
+	// buckets may be reconfigured, so chunk is taken on every write
+	size := chunkSize(w.limits)
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+
+		if err := use(w.ctx, w.limits, int64(len(chunk))); err != nil {
+			return written, err
+		}
+
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// PRIVATE
+
+// chunkSize is the smallest capacity of buckets
+func chunkSize(limits []*bucket_quoter.BucketQuoter) int {
+	chunk := 0
+	for _, q := range limits {
+		capacity := int(q.BucketTokensCapacity.Load())
+		if capacity > 0 && (chunk == 0 || capacity < chunk) {
+			chunk = capacity
+		}
+	}
+	if chunk == 0 {
+		chunk = 1
+	}
+	return chunk
+}
+
+// use takes tokens of every bucket, buckets already charged are refunded
+// if waiting for another one fails
+func use(ctx context.Context, limits []*bucket_quoter.BucketQuoter, tokens int64) error {
+	for i, q := range limits {
+		if err := q.UseWithContext(ctx, tokens); err != nil {
+			for _, charged := range limits[:i] {
+				charged.Refund(tokens)
+			}
+			return err
+		}
+	}
+	return nil
+}
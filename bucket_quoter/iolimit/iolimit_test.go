@@ -0,0 +1,175 @@
+package iolimit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+type recordWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestWriterSplitsWrites(t *testing.T) {
+	// 1000 bytes per second, capacity 100
+	q := bucket_quoter.NewBucketQuoter(1000, 100, true, nil)
+	rec := &recordWriter{}
+	w := NewWriter(rec, q)
+
+	start := time.Now()
+	n, err := w.Write(make([]byte, 300))
+	if err != nil || n != 300 {
+		t.Fatalf("unexpected write %d %v", n, err)
+	}
+
+	// full bucket and debt of one chunk cover 200 bytes, the rest waits
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("expected write to wait, took %s", elapsed)
+	}
+	for _, size := range rec.writes {
+		if size > 100 {
+			t.Fatalf("write of %d exceeds capacity: %v", size, rec.writes)
+		}
+	}
+	if rec.Len() != 300 {
+		t.Fatalf("expected 300 bytes written, got %d", rec.Len())
+	}
+}
+
+func TestReaderGivesBackUnread(t *testing.T) {
+	q := bucket_quoter.NewBucketQuoter(1000, 100, true, nil)
+	r := NewReader(bytes.NewReader(make([]byte, 10)), q)
+
+	p := make([]byte, 1000)
+	n, err := r.Read(p)
+	if err != nil || n != 10 {
+		t.Fatalf("unexpected read %d %v", n, err)
+	}
+	// chunk of 100 reserved, 90 given back
+	if available := q.GetAvailable(); available != 90 {
+		t.Fatalf("expected 90 available, got %d", available)
+	}
+}
+
+func TestWriterContext(t *testing.T) {
+	q := bucket_quoter.NewBucketQuoter(10, 10, true, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	w := NewWriterContext(ctx, io.Discard, q)
+	n, err := w.Write(make([]byte, 100))
+	if err == nil || n != 20 {
+		t.Fatalf("expected write to stop after 20 bytes, got %d %v", n, err)
+	}
+}
+
+func TestWriterContextRefund(t *testing.T) {
+	shared := bucket_quoter.NewBucketQuoter(1000, 100, true, nil)
+	// own bucket is in debt for 10 seconds
+	own := bucket_quoter.NewBucketQuoter(10, 100, true, nil)
+	own.SetTokens(-100)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	w := NewWriterContext(ctx, io.Discard, shared, own)
+	if n, err := w.Write(make([]byte, 10)); err == nil || n != 0 {
+		t.Fatalf("expected write to fail, got %d %v", n, err)
+	}
+	// shared bucket is given back what it was charged
+	if available := shared.GetAvailable(); available != 100 || shared.Stat.MsgPassed != 0 {
+		t.Fatalf("expected shared bucket to be refunded, available %d, stat %+v", available, *shared.Stat)
+	}
+}
+
+func TestSharedConnLimits(t *testing.T) {
+	shared := Limits{Write: bucket_quoter.NewBucketQuoter(1000, 100, true, nil)}
+
+	var conns []*Conn
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		go io.Copy(io.Discard, c2)
+		defer c2.Close()
+
+		conns = append(conns, NewConn(c1, shared, Limits{Write: bucket_quoter.NewBucketQuoter(1000, 1000, true, nil)}))
+	}
+
+	// the second connection pays the debt made by the first one
+	start := time.Now()
+	for _, c := range conns {
+		if _, err := c.Write(make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := conns[0].Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("expected shared bucket to throttle, took %s", elapsed)
+	}
+
+	// close interrupts waiting
+	done := make(chan error)
+	go func() {
+		_, err := conns[1].Write(make([]byte, 100))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	conns[1].Close()
+	if err := <-done; err == nil {
+		t.Fatal("expected write to fail on close")
+	}
+}
+
+func TestListenerAcceptRate(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 20 connections per second, the first two right away
+	l := NewListener(inner, ListenerOptions{Accept: bucket_quoter.NewBucketQuoter(20, 1, true, nil)})
+	defer l.Close()
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			if c, err := net.Dial("tcp", inner.Addr().String()); err == nil {
+				defer c.Close()
+			}
+		}
+		time.Sleep(time.Second)
+	}()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.(*Conn); !ok {
+			t.Fatalf("expected limited connection, got %T", c)
+		}
+		c.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("expected the third accept to wait, took %s", elapsed)
+	}
+
+	// close interrupts waiting accept
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Close()
+	}()
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("expected accept to fail on close")
+	}
+}
@@ -0,0 +1,121 @@
+package iolimit
+
+import (
+	"context"
+	"net"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+// Limits of connection, nil bucket does not limit
+type Limits struct {
+	Read  *bucket_quoter.BucketQuoter
+	Write *bucket_quoter.BucketQuoter
+}
+
+func (l Limits) reads() []*bucket_quoter.BucketQuoter {
+	return buckets(l.Read)
+}
+
+func (l Limits) writes() []*bucket_quoter.BucketQuoter {
+	return buckets(l.Write)
+}
+
+// Conn throttles reads and writes of connection, waiting is interrupted by
+// Close
+type Conn struct {
+	net.Conn
+
+	r      *Reader
+	w      *Writer
+	cancel context.CancelFunc
+}
+
+// NewConn limits connection by all the limits given, e.g. own limits of
+// connection and limits shared by all connections
+func NewConn(c net.Conn, limits ...Limits) *Conn {
+	var reads, writes []*bucket_quoter.BucketQuoter
+	for _, l := range limits {
+		reads = append(reads, l.reads()...)
+		writes = append(writes, l.writes()...)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{
+		Conn:   c,
+		r:      NewReaderContext(ctx, c, reads...),
+		w:      NewWriterContext(ctx, c, writes...),
+		cancel: cancel,
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+type ListenerOptions struct {
+	// connections accepted per second, nil does not limit
+	Accept *bucket_quoter.BucketQuoter
+	// limits shared by all connections
+	Shared Limits
+	// own limits of every connection, nil if connections have none
+	PerConn func(c net.Conn) Limits
+}
+
+// Listener throttles accept rate and wraps connections accepted
+type Listener struct {
+	net.Listener
+
+	opts   ListenerOptions
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewListener(l net.Listener, opts ListenerOptions) *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Listener{Listener: l, opts: opts, ctx: ctx, cancel: cancel}
+}
+
+// Accept waits for accept bucket before accepting, so connections over
+// rate stay in the backlog of listener
+func (l *Listener) Accept() (net.Conn, error) {
+	if l.opts.Accept != nil {
+		if err := l.opts.Accept.UseWithContext(l.ctx, 1); err != nil {
+			return nil, net.ErrClosed
+		}
+	}
+
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	limits := []Limits{l.opts.Shared}
+	if l.opts.PerConn != nil {
+		limits = append(limits, l.opts.PerConn(c))
+	}
+	return NewConn(c, limits...), nil
+}
+
+func (l *Listener) Close() error {
+	l.cancel()
+	return l.Listener.Close()
+}
+
+// PRIVATE
+
+func buckets(q *bucket_quoter.BucketQuoter) []*bucket_quoter.BucketQuoter {
+	if q == nil {
+		return nil
+	}
+	return []*bucket_quoter.BucketQuoter{q}
+}
@@ -0,0 +1,99 @@
+package bucket_quoter
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Keyed Token Buckets
+//
+// Bucket per key (subscription, client address, ...) created on first use.
+// Number of keys tracked is capped, the least recently used bucket is
+// evicted to make room for a new one.
+
+type KeyedQuoter struct {
+	mutex sync.Mutex
+
+	factory func(key string) *BucketQuoter
+	maxKeys int
+
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type keyedEntry struct {
+	key    string
+	quoter *BucketQuoter
+}
+
+// NewKeyedQuoter creates buckets filled up, maxKeys 0 means unlimited
+func NewKeyedQuoter(inflow int64, capacity int64, maxKeys int) *KeyedQuoter {
+	return NewKeyedQuoterWithFactory(func(string) *BucketQuoter {
+		return NewBucketQuoter(inflow, capacity, true, nil)
+	}, maxKeys)
+}
+
+// NewKeyedQuoterWithFactory creates buckets with factory, it may return
+// nil for keys that should not get bucket
+func NewKeyedQuoterWithFactory(factory func(key string) *BucketQuoter, maxKeys int) *KeyedQuoter {
+	return &KeyedQuoter{
+		factory: factory,
+		maxKeys: maxKeys,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// PUBLIC
+
+// Get returns bucket of the key, creating it if needed
+func (k *KeyedQuoter) Get(key string) *BucketQuoter {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if e, ok := k.buckets[key]; ok {
+		k.lru.MoveToFront(e)
+		return e.Value.(*keyedEntry).quoter
+	}
+
+	q := k.factory(key)
+	if q == nil {
+		return nil
+	}
+	if k.maxKeys > 0 && k.lru.Len() >= k.maxKeys {
+		oldest := k.lru.Back()
+		k.lru.Remove(oldest)
+		delete(k.buckets, oldest.Value.(*keyedEntry).key)
+	}
+	k.buckets[key] = k.lru.PushFront(&keyedEntry{key: key, quoter: q})
+
+	return q
+}
+
+// Lookup returns bucket of the key only if it exists
+func (k *KeyedQuoter) Lookup(key string) (*BucketQuoter, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if e, ok := k.buckets[key]; ok {
+		return e.Value.(*keyedEntry).quoter, true
+	}
+	return nil, false
+}
+
+func (k *KeyedQuoter) Delete(key string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if e, ok := k.buckets[key]; ok {
+		k.lru.Remove(e)
+		delete(k.buckets, key)
+	}
+}
+
+func (k *KeyedQuoter) Len() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	return k.lru.Len()
+}
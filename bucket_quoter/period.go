@@ -0,0 +1,268 @@
+package bucket_quoter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Period Quota
+//
+// Unlike token bucket quota is not refilled continuously: up to Limit
+// tokens may be used within calendar period (day, week, month, year) and
+// usage is reset on period boundary in the given location.
+
+type Period int
+
+const (
+	PeriodDaily Period = iota
+	PeriodWeekly
+	PeriodMonthly
+	PeriodYearly
+)
+
+func ParsePeriod(s string) (Period, error) {
+	switch s {
+	case "daily", "day":
+		return PeriodDaily, nil
+	case "weekly", "week":
+		return PeriodWeekly, nil
+	case "monthly", "month":
+		return PeriodMonthly, nil
+	case "yearly", "year":
+		return PeriodYearly, nil
+	}
+	return 0, fmt.Errorf("bucket_quoter: unknown period '%s'", s)
+}
+
+func (p Period) String() string {
+	switch p {
+	case PeriodDaily:
+		return "daily"
+	case PeriodWeekly:
+		return "weekly"
+	case PeriodMonthly:
+		return "monthly"
+	case PeriodYearly:
+		return "yearly"
+	}
+	return "unknown"
+}
+
+// Start returns beginning of the period t belongs to, weeks start on monday
+func (p Period) Start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch p {
+	case PeriodWeekly:
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location())
+	case PeriodMonthly:
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	case PeriodYearly:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func (p Period) Next(start time.Time) time.Time {
+	switch p {
+	case PeriodWeekly:
+		return start.AddDate(0, 0, 7)
+	case PeriodMonthly:
+		return start.AddDate(0, 1, 0)
+	case PeriodYearly:
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+type PeriodQuota struct {
+	mutex sync.Mutex
+	timer InstantTimer
+
+	Limit    int64
+	Period   Period
+	Location *time.Location
+
+	Used        int64
+	PeriodStart time.Time
+}
+
+// PeriodQuotaState is persisted between restarts
+type PeriodQuotaState struct {
+	Used        int64     `json:"used"`
+	PeriodStart time.Time `json:"periodStart"`
+}
+
+func NewPeriodQuota(limit int64, period Period, location *time.Location) *PeriodQuota {
+	return NewPeriodQuotaWithTimer(limit, period, location, NewInstantTimerMs())
+}
+
+func NewPeriodQuotaWithTimer(limit int64, period Period, location *time.Location, timer InstantTimer) *PeriodQuota {
+	if location == nil {
+		location = time.UTC
+	}
+
+	p := &PeriodQuota{
+		timer:    timer,
+		Limit:    limit,
+		Period:   period,
+		Location: location,
+	}
+	p.PeriodStart = period.Start(p.now())
+
+	return p
+}
+
+// PUBLIC
+
+// TryUse takes tokens only if all of them fit into the quota left
+func (p *PeriodQuota) TryUse(tokens int64) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.resetNoLock()
+	if p.Used+tokens > p.Limit {
+		return false
+	}
+	p.Used += tokens
+
+	return true
+}
+
+// Refund returns tokens taken, e.g. when another limiter combined with
+// quota has denied request
+func (p *PeriodQuota) Refund(tokens int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.resetNoLock()
+	p.Used -= tokens
+	if p.Used < 0 {
+		p.Used = 0
+	}
+}
+
+// Reset clears usage of the current period
+func (p *PeriodQuota) Reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.resetNoLock()
+	p.Used = 0
+}
+
+func (p *PeriodQuota) Remaining() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.resetNoLock()
+	if p.Used >= p.Limit {
+		return 0
+	}
+	return p.Limit - p.Used
+}
+
+// ResetTime returns time when usage is reset next
+func (p *PeriodQuota) ResetTime() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.resetNoLock()
+	return p.Period.Next(p.PeriodStart)
+}
+
+func (p *PeriodQuota) State() PeriodQuotaState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.resetNoLock()
+	return PeriodQuotaState{Used: p.Used, PeriodStart: p.PeriodStart}
+}
+
+// Restore applies persisted state, usage of the past period is dropped
+func (p *PeriodQuota) Restore(s PeriodQuotaState) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.resetNoLock()
+	if s.PeriodStart.Equal(p.PeriodStart) {
+		p.Used = s.Used
+	}
+}
+
+// PRIVATE
+
+func (p *PeriodQuota) now() time.Time {
+	return time.UnixMilli(p.timer.Now()).In(p.Location)
+}
+
+func (p *PeriodQuota) resetNoLock() {
+	start := p.Period.Start(p.now())
+	if !start.Equal(p.PeriodStart) {
+		p.PeriodStart = start
+		p.Used = 0
+	}
+}
+
+// File Quota Store
+
+type FileQuotaStore struct {
+	mutex sync.Mutex
+	path  string
+}
+
+func NewFileQuotaStore(path string) *FileQuotaStore {
+	return &FileQuotaStore{path: path}
+}
+
+// Load returns states by quota key, missing file is empty store
+func (s *FileQuotaStore) Load() (map[string]PeriodQuotaState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	states := make(map[string]PeriodQuotaState)
+	content, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &states); err != nil {
+		return nil, err
+	}
+
+	return states, nil
+}
+
+// Save replaces store content atomically
+func (s *FileQuotaStore) Save(states map[string]PeriodQuotaState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	content, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,66 @@
+package bucket_quoter
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeriodQuota(t *testing.T) {
+	timer := NewManualTimerMs(time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC).UnixMilli())
+	quota := NewPeriodQuotaWithTimer(100, PeriodMonthly, time.UTC, timer)
+
+	if !quota.TryUse(60) || quota.TryUse(60) || quota.Remaining() != 40 {
+		t.Fatalf("expected 40 tokens remaining, got %d", quota.Remaining())
+	}
+	quota.Refund(10)
+	if quota.Remaining() != 50 {
+		t.Fatalf("expected 50 tokens remaining after refund, got %d", quota.Remaining())
+	}
+	if reset := quota.ResetTime(); !reset.Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected reset time %s", reset)
+	}
+
+	// usage survives restart within the period
+	store := NewFileQuotaStore(filepath.Join(t.TempDir(), "state.json"))
+	if err := store.Save(map[string]PeriodQuotaState{"sub": quota.State()}); err != nil {
+		t.Fatal(err)
+	}
+	states, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewPeriodQuotaWithTimer(100, PeriodMonthly, time.UTC, timer)
+	restored.Restore(states["sub"])
+	if restored.Remaining() != 50 {
+		t.Fatalf("expected 50 tokens remaining after restore, got %d", restored.Remaining())
+	}
+
+	// and is reset on the 1st
+	timer.Set(time.Date(2026, 11, 1, 0, 0, 1, 0, time.UTC).UnixMilli())
+	if restored.Remaining() != 100 {
+		t.Fatalf("expected quota reset, got %d remaining", restored.Remaining())
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 2026-10-21 is wednesday
+	at := time.Date(2026, 10, 21, 15, 30, 0, 0, berlin)
+
+	cases := map[Period]time.Time{
+		PeriodDaily:   time.Date(2026, 10, 21, 0, 0, 0, 0, berlin),
+		PeriodWeekly:  time.Date(2026, 10, 19, 0, 0, 0, 0, berlin),
+		PeriodMonthly: time.Date(2026, 10, 1, 0, 0, 0, 0, berlin),
+		PeriodYearly:  time.Date(2026, 1, 1, 0, 0, 0, 0, berlin),
+	}
+	for period, expected := range cases {
+		if start := period.Start(at); !start.Equal(expected) {
+			t.Errorf("%s period start %s, expected %s", period, start, expected)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package bucket_quoter
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,6 +25,9 @@ type BucketQuoter struct {
 	BucketTokensCapacity  *atomic.Int64
 
 	Stat *BucketQuoterStat
+
+	// optional warm-up ramp, see warmup.go
+	warmup *warmup
 }
 
 type Result struct {
@@ -33,7 +37,10 @@ type Result struct {
 }
 
 func NewBucketQuoter(inflow int64, capacity int64, fill bool, stat *BucketQuoterStat) *BucketQuoter {
-	timer := NewInstantTimerMs()
+	return NewBucketQuoterWithTimer(inflow, capacity, fill, stat, NewInstantTimerMs())
+}
+
+func NewBucketQuoterWithTimer(inflow int64, capacity int64, fill bool, stat *BucketQuoterStat, timer InstantTimer) *BucketQuoter {
 	if stat == nil {
 		stat = &BucketQuoterStat{}
 	}
@@ -43,24 +50,20 @@ func NewBucketQuoter(inflow int64, capacity int64, fill bool, stat *BucketQuoter
 		bucket = atomic.LoadInt64(&capacity)
 	}
 
-	var fixedCapacity atomic.Int64
-	fixedCapacity.Add(capacity)
-
-	var fixedInflow atomic.Int64
-	fixedInflow.Add(inflow)
-
-	return &BucketQuoter{
-		bucketMutex:           sync.Mutex{},
-		timer:                 timer,
-		Bucket:                bucket,
-		SeqNo:                 0,
-		LastAdd:               timer.Now(),
-		FixedInflow:           fixedInflow,
-		FixedCapacity:         fixedCapacity,
-		InflowTokensPerSecond: &fixedInflow,
-		BucketTokensCapacity:  &fixedCapacity,
-		Stat:                  stat,
+	q := &BucketQuoter{
+		bucketMutex: sync.Mutex{},
+		timer:       timer,
+		Bucket:      bucket,
+		SeqNo:       0,
+		LastAdd:     timer.Now(),
+		Stat:        stat,
 	}
+	q.FixedInflow.Store(inflow)
+	q.FixedCapacity.Store(capacity)
+	q.InflowTokensPerSecond = &q.FixedInflow
+	q.BucketTokensCapacity = &q.FixedCapacity
+
+	return q
 }
 
 // PUBLIC
@@ -135,6 +138,41 @@ func (q *BucketQuoter) UseWithSleep(tokens int64) {
 	q.useNoLock(tokens, true)
 }
 
+// UseWithContext waits until bucket is available and takes tokens. Unlike
+// UseWithSleep waiting is interrupted by context, if context deadline comes
+// before bucket gets available it fails right away.
+func (q *BucketQuoter) UseWithContext(ctx context.Context, tokens int64) error {
+	var waited int64
+	for {
+		q.bucketMutex.Lock()
+		// stat, updated under lock as waiters run concurrently
+		q.Stat.UsecWaited += waited
+		waited = 0
+
+		if q.isAvailableNoLock() {
+			q.useNoLock(tokens, false)
+			q.bucketMutex.Unlock()
+			return nil
+		}
+		delay := q.waitTimeNoLock()
+		q.bucketMutex.Unlock()
+
+		wait := time.Duration(delay) * time.Microsecond
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return context.DeadlineExceeded
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+			waited = delay
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
 func (q *BucketQuoter) UseWithResult(tokens int64, r *Result, sleep bool) {
 	q.bucketMutex.Lock()
 	defer q.bucketMutex.Unlock()
@@ -145,6 +183,45 @@ func (q *BucketQuoter) UseWithResult(tokens int64, r *Result, sleep bool) {
 	r.SeqNo = q.SeqNo + 1
 }
 
+// TryUse checks availability and takes tokens under the same lock, so
+// concurrent callers can not both pass on the last available tokens.
+// Like IsAvailable it only requires bucket not to be in debt, all tokens
+// are taken even if there are fewer, and bucket goes into debt, which
+// following callers wait to be paid back by inflow.
+func (q *BucketQuoter) TryUse(tokens int64) bool {
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+
+	return q.tryUseNoLock(tokens)
+}
+
+func (q *BucketQuoter) TryUseWithResult(tokens int64, r *Result) bool {
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+
+	r.Before = q.Bucket
+	ok := q.tryUseNoLock(tokens)
+	r.After = q.Bucket
+	r.SeqNo = q.SeqNo + 1
+
+	return ok
+}
+
+// Refund gives back tokens of request taken but not passed after all, the
+// request is not counted as passed. Bucket is filled first, so it ends up
+// as if tokens were not taken, also near its capacity.
+func (q *BucketQuoter) Refund(tokens int64) {
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+
+	q.fillBucket()
+	q.addNoLock(tokens)
+
+	// stat
+	q.Stat.TokensUsed -= tokens
+	q.Stat.MsgPassed -= 1
+}
+
 func (q *BucketQuoter) UseAndFill(tokens int64) int64 {
 	q.bucketMutex.Lock()
 	defer q.bucketMutex.Unlock()
@@ -181,7 +258,7 @@ func (q *BucketQuoter) GetWaitTime() int64 {
 		return 0
 	}
 
-	return (-q.Bucket * 1000000) / q.InflowTokensPerSecond.Load()
+	return q.waitTimeNoLock()
 }
 
 func (q *BucketQuoter) GetWaitTimeWithResult(r *Result) int64 {
@@ -197,7 +274,56 @@ func (q *BucketQuoter) GetWaitTimeWithResult(r *Result) int64 {
 		return 0
 	}
 
-	return (-q.Bucket * 1000000) / q.InflowTokensPerSecond.Load()
+	return q.waitTimeNoLock()
+}
+
+// Reconfigure changes inflow and capacity of the bucket in place. Tokens
+// accumulated so far are kept, but cut down to the new capacity.
+func (q *BucketQuoter) Reconfigure(inflow int64, capacity int64) {
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+
+	q.fillBucket()
+	q.InflowTokensPerSecond.Store(inflow)
+	q.BucketTokensCapacity.Store(capacity)
+	if q.Bucket > capacity {
+		q.Bucket = capacity
+	}
+}
+
+// Restrict cuts bucket down to tokens if it has more, e.g. to follow
+// remaining budget reported by upstream
+func (q *BucketQuoter) Restrict(tokens int64) {
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+
+	q.fillBucket()
+	if q.Bucket > tokens {
+		q.Bucket = tokens
+	}
+}
+
+// Block makes bucket unavailable for d at least, by debt the inflow pays
+// off in d. Bucket already blocked for longer is kept as it is.
+func (q *BucketQuoter) Block(d time.Duration) {
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+
+	q.fillBucket()
+	debt := q.InflowTokensPerSecond.Load()*int64(d)/int64(time.Second) + 1
+	if q.Bucket > -debt {
+		q.Bucket = -debt
+	}
+}
+
+// SetTokens sets bucket to tokens (cut down to capacity), debt is forgotten
+func (q *BucketQuoter) SetTokens(tokens int64) {
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+
+	q.fillBucket()
+	q.Bucket = 0
+	q.addNoLock(tokens)
 }
 
 func (q *BucketQuoter) Sleep() {
@@ -224,8 +350,13 @@ func (q *BucketQuoter) fillBucket() {
 	timerNow := q.timer.Now()
 	elapsed := q.timer.Duration(q.LastAdd, timerNow)
 
-	if q.InflowTokensPerSecond.Load()*elapsed > q.timer.Resolution() {
-		inflow := q.InflowTokensPerSecond.Load() * elapsed / q.timer.Resolution()
+	inflowElapsed := q.InflowTokensPerSecond.Load() * elapsed
+	if q.warmup != nil {
+		inflowElapsed = q.warmup.inflowElapsed(q, q.LastAdd, timerNow)
+	}
+
+	if inflowElapsed > q.timer.Resolution() {
+		inflow := inflowElapsed / q.timer.Resolution()
 		if q.Stat != nil {
 			q.Stat.AggregateInflow += inflow
 		}
@@ -240,10 +371,29 @@ func (q *BucketQuoter) fillBucket() {
 	}
 }
 
+// waitTimeNoLock returns microseconds until bucket debt is paid off
+// with the current inflow
+func (q *BucketQuoter) waitTimeNoLock() int64 {
+	if q.Bucket >= 0 {
+		return 0
+	}
+
+	inflow := q.InflowTokensPerSecond.Load()
+	if q.warmup != nil {
+		inflow = q.warmup.inflow(q, q.timer.Now())
+	}
+	return (-q.Bucket * 1000000) / inflow
+}
+
 func (q *BucketQuoter) useNoLock(tokens int64, sleep bool) {
 	if sleep {
 		q.Sleep()
 	}
+	if q.warmup != nil {
+		// ramp restarts on bucket filled up to now
+		q.fillBucket()
+		q.warmup.use(q)
+	}
 	q.Bucket -= tokens
 
 	// stat
@@ -251,6 +401,17 @@ func (q *BucketQuoter) useNoLock(tokens int64, sleep bool) {
 	q.Stat.MsgPassed += 1
 }
 
+func (q *BucketQuoter) tryUseNoLock(tokens int64) bool {
+	if !q.isAvailableNoLock() {
+		// stat
+		q.Stat.BucketUnderflows += 1
+		return false
+	}
+	q.useNoLock(tokens, false)
+
+	return true
+}
+
 func (q *BucketQuoter) addNoLock(tokens int64) {
 	q.Bucket += tokens
 	if q.Bucket > q.BucketTokensCapacity.Load() {
@@ -51,3 +51,74 @@ func TestBasicBucketQuoterWithSleep(t *testing.T) {
 		// send message
 	}
 }
+
+func TestTryUseWithResult(t *testing.T) {
+	quoter := NewBucketQuoter(1, 10, true, nil)
+
+	var r Result
+	if !quoter.TryUseWithResult(10, &r) || r.Before != 10 || r.After != 0 {
+		t.Fatalf("expected 10 tokens to be taken, got %+v", r)
+	}
+	// empty bucket still passes, next caller waits for the debt
+	if !quoter.TryUse(3) {
+		t.Fatal("expected empty bucket to be available")
+	}
+	if quoter.TryUse(1) {
+		t.Fatal("expected bucket in debt to be unavailable")
+	}
+	if quoter.Bucket != -3 || quoter.Stat.BucketUnderflows != 1 {
+		t.Fatalf("unexpected bucket %d, stat %+v", quoter.Bucket, *quoter.Stat)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	timer := NewManualTimerMs(0)
+	quoter := NewBucketQuoterWithTimer(10, 100, true, nil, timer)
+
+	quoter.TryUse(30)
+	quoter.Refund(30)
+	if quoter.GetAvailable() != 100 || quoter.Stat.TokensUsed != 0 || quoter.Stat.MsgPassed != 0 {
+		t.Fatalf("expected refund to revert request, available %d, stat %+v", quoter.GetAvailable(), *quoter.Stat)
+	}
+
+	// bucket refilled meanwhile is not filled above capacity
+	quoter.TryUse(30)
+	timer.Advance(time.Second)
+	quoter.Refund(30)
+	if quoter.GetAvailable() != 100 {
+		t.Fatalf("expected 100 available, got %d", quoter.GetAvailable())
+	}
+}
+
+func TestRestrictAndBlock(t *testing.T) {
+	timer := NewManualTimerMs(0)
+	quoter := NewBucketQuoterWithTimer(10, 100, true, nil, timer)
+
+	quoter.Restrict(30)
+	if quoter.GetAvailable() != 30 {
+		t.Fatalf("expected 30 available, got %d", quoter.GetAvailable())
+	}
+	// restrict never adds tokens
+	quoter.Restrict(50)
+	if quoter.GetAvailable() != 30 {
+		t.Fatalf("expected 30 available, got %d", quoter.GetAvailable())
+	}
+
+	quoter.Block(2 * time.Second)
+	if quoter.IsAvailable() {
+		t.Fatal("expected blocked bucket to be unavailable")
+	}
+	if wait := quoter.GetWaitTime(); wait <= 2000000 || wait > 2100000 {
+		t.Fatalf("expected wait of 2s, got %dus", wait)
+	}
+	// shorter block does not lift longer one
+	quoter.Block(time.Second)
+	timer.Advance(1500 * time.Millisecond)
+	if quoter.IsAvailable() {
+		t.Fatal("expected bucket to stay blocked")
+	}
+	timer.Advance(600 * time.Millisecond)
+	if !quoter.IsAvailable() {
+		t.Fatal("expected bucket to be available after block")
+	}
+}
@@ -0,0 +1,147 @@
+package simulator
+
+import (
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+// Limiter is what simulator drives, limiters of bucket_quoter are adapted
+// with Bucket and Quota, several of them are combined with All
+type Limiter interface {
+	// TryUse takes tokens if limiter is available
+	TryUse(tokens int64) bool
+	// Use takes tokens regardless, request delayed is charged upfront
+	Use(tokens int64)
+	// Refund returns tokens taken
+	Refund(tokens int64)
+	// WaitTime until limiter is available, negative if never
+	WaitTime() time.Duration
+}
+
+type bucketLimiter struct {
+	q *bucket_quoter.BucketQuoter
+}
+
+// Bucket adapts BucketQuoter (including warm-up and adaptive ones)
+func Bucket(q *bucket_quoter.BucketQuoter) Limiter {
+	return &bucketLimiter{q: q}
+}
+
+func (l *bucketLimiter) TryUse(tokens int64) bool {
+	return l.q.TryUse(tokens)
+}
+
+func (l *bucketLimiter) Use(tokens int64) {
+	l.q.Use(tokens)
+}
+
+func (l *bucketLimiter) Refund(tokens int64) {
+	l.q.Add(tokens)
+}
+
+func (l *bucketLimiter) WaitTime() time.Duration {
+	return time.Duration(l.q.GetWaitTime()) * time.Microsecond
+}
+
+type quotaLimiter struct {
+	p     *bucket_quoter.PeriodQuota
+	timer bucket_quoter.InstantTimer
+
+	// tokens of delayed callers charged to the next period
+	owed      int64
+	owedReset time.Time
+}
+
+// Quota adapts PeriodQuota, timer is the one quota is created with
+func Quota(p *bucket_quoter.PeriodQuota, timer bucket_quoter.InstantTimer) Limiter {
+	return &quotaLimiter{p: p, timer: timer}
+}
+
+func (l *quotaLimiter) TryUse(tokens int64) bool {
+	l.settle()
+	return l.p.TryUse(tokens)
+}
+
+// Use takes tokens of the current period if they fit, otherwise waiting
+// caller gets tokens of the next period
+func (l *quotaLimiter) Use(tokens int64) {
+	l.settle()
+	if l.p.TryUse(tokens) {
+		return
+	}
+	l.owed += tokens
+	l.owedReset = l.p.ResetTime()
+}
+
+func (l *quotaLimiter) Refund(tokens int64) {
+	l.settle()
+	l.p.Refund(tokens)
+}
+
+func (l *quotaLimiter) WaitTime() time.Duration {
+	l.settle()
+	if l.p.Remaining() > 0 {
+		return 0
+	}
+	if l.owed >= l.p.Limit {
+		// the next period is taken by callers waiting already
+		return -1
+	}
+	now := time.UnixMilli(l.timer.Now())
+	return l.p.ResetTime().Sub(now)
+}
+
+// settle charges tokens owed once the next period has begun
+func (l *quotaLimiter) settle() {
+	if l.owed == 0 || time.UnixMilli(l.timer.Now()).Before(l.owedReset) {
+		return
+	}
+	l.p.TryUse(min(l.owed, l.p.Remaining()))
+	l.owed = 0
+}
+
+type allLimiter []Limiter
+
+// All passes request only if every limiter passes it
+func All(limiters ...Limiter) Limiter {
+	return allLimiter(limiters)
+}
+
+func (a allLimiter) TryUse(tokens int64) bool {
+	for i, l := range a {
+		if !l.TryUse(tokens) {
+			for _, taken := range a[:i] {
+				taken.Refund(tokens)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (a allLimiter) Use(tokens int64) {
+	for _, l := range a {
+		l.Use(tokens)
+	}
+}
+
+func (a allLimiter) Refund(tokens int64) {
+	for _, l := range a {
+		l.Refund(tokens)
+	}
+}
+
+func (a allLimiter) WaitTime() time.Duration {
+	var wait time.Duration
+	for _, l := range a {
+		w := l.WaitTime()
+		if w < 0 {
+			return w
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
@@ -0,0 +1,176 @@
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+// Simulator runs limiter against arrival trace in virtual time: limiters
+// have to be created with the simulator timer, nothing ever sleeps.
+//
+// Request is allowed when limiter is available on arrival. Otherwise it is
+// delayed if limiter gets available within MaxWait (tokens are charged
+// upfront, like UseWithSleep does), or denied.
+
+type Options struct {
+	// trace start, virtual clock is set to it before the run
+	Start time.Time
+	// 0 means requests are never delayed, just denied
+	MaxWait time.Duration
+}
+
+type Simulator struct {
+	opts  Options
+	timer *bucket_quoter.ManualTimer
+}
+
+type Report struct {
+	Requests int64
+	Allowed  int64
+	Delayed  int64
+	Denied   int64
+
+	// tokens of the requests passed (allowed and delayed)
+	Tokens int64
+
+	// wait of the delayed requests
+	WaitP50 time.Duration
+	WaitP90 time.Duration
+	WaitP99 time.Duration
+	WaitMax time.Duration
+
+	// trace time covered and requests passed per second of it
+	Duration   time.Duration
+	Throughput float64
+}
+
+func New(opts Options) *Simulator {
+	if opts.Start.IsZero() {
+		opts.Start = time.Unix(0, 0)
+	}
+	return &Simulator{
+		opts:  opts,
+		timer: bucket_quoter.NewManualTimerMs(opts.Start.UnixMilli()),
+	}
+}
+
+// Timer is the virtual clock limiters must be created with
+func (s *Simulator) Timer() *bucket_quoter.ManualTimer {
+	return s.timer
+}
+
+func (s *Simulator) Run(l Limiter, trace Trace) (Report, error) {
+	var r Report
+	var waits histogram
+	start := s.opts.Start.UnixMilli()
+
+	for {
+		a, ok := trace.Next()
+		if !ok {
+			break
+		}
+		s.timer.Set(start + a.At.Milliseconds())
+		r.Requests += 1
+		r.Duration = a.At
+
+		if l.TryUse(a.Cost) {
+			r.Allowed += 1
+			r.Tokens += a.Cost
+			continue
+		}
+
+		wait := l.WaitTime()
+		if s.opts.MaxWait > 0 && wait >= 0 && wait <= s.opts.MaxWait {
+			l.Use(a.Cost)
+			r.Delayed += 1
+			r.Tokens += a.Cost
+			waits.add(wait)
+			continue
+		}
+		r.Denied += 1
+	}
+	if err := trace.Err(); err != nil {
+		return r, err
+	}
+
+	r.WaitP50 = waits.quantile(0.5)
+	r.WaitP90 = waits.quantile(0.9)
+	r.WaitP99 = waits.quantile(0.99)
+	r.WaitMax = waits.max
+	if r.Duration > 0 {
+		r.Throughput = float64(r.Allowed+r.Delayed) / r.Duration.Seconds()
+	}
+
+	return r, nil
+}
+
+func (r *Report) AsString() string {
+	var out []string
+	out = append(out, fmt.Sprintf("requests:'%d'", r.Requests))
+	out = append(out, fmt.Sprintf("allowed:'%d'", r.Allowed))
+	out = append(out, fmt.Sprintf("delayed:'%d'", r.Delayed))
+	out = append(out, fmt.Sprintf("denied:'%d'", r.Denied))
+	out = append(out, fmt.Sprintf("tokens:'%d'", r.Tokens))
+	out = append(out, fmt.Sprintf("wait p50:'%s' p90:'%s' p99:'%s' max:'%s'",
+		r.WaitP50, r.WaitP90, r.WaitP99, r.WaitMax))
+	out = append(out, fmt.Sprintf("duration:'%s'", r.Duration))
+	out = append(out, fmt.Sprintf("throughput:'%.3f'", r.Throughput))
+	return strings.Join(out, ",")
+}
+
+// histogram keeps waits in log buckets with ~1% precision, so percentiles
+// of months of traffic take constant memory
+type histogram struct {
+	counts map[int]int64
+	total  int64
+	max    time.Duration
+}
+
+const histogramBase = 1.01
+
+func (h *histogram) add(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make(map[int]int64)
+	}
+	h.counts[histogramIndex(d)] += 1
+	h.total += 1
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func histogramIndex(d time.Duration) int {
+	us := float64(d.Microseconds())
+	if us < 1 {
+		return 0
+	}
+	return 1 + int(math.Log(us)/math.Log(histogramBase))
+}
+
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+
+	maxIndex := histogramIndex(h.max)
+	rank := int64(math.Ceil(q * float64(h.total)))
+	var seen int64
+	for i := 0; i <= maxIndex; i++ {
+		seen += h.counts[i]
+		if seen >= rank {
+			if i == 0 {
+				return 0
+			}
+			d := time.Duration(math.Pow(histogramBase, float64(i))) * time.Microsecond
+			if d > h.max {
+				d = h.max
+			}
+			return d
+		}
+	}
+	return h.max
+}
@@ -0,0 +1,85 @@
+package simulator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+func TestReplayCSV(t *testing.T) {
+	sim := New(Options{MaxWait: 1500 * time.Millisecond})
+	quoter := bucket_quoter.NewBucketQuoterWithTimer(1, 1, true, nil, sim.Timer())
+
+	trace := ReadCSV(strings.NewReader("time,cost\n0\n0\n0,1\n0.5\n2.0\n"))
+	r, err := sim.Run(Bucket(quoter), trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Requests != 5 || r.Allowed != 3 || r.Delayed != 1 || r.Denied != 1 {
+		t.Fatalf("unexpected report %s", r.AsString())
+	}
+	if r.WaitMax != time.Second || r.WaitP50 != time.Second {
+		t.Fatalf("unexpected waits %s", r.AsString())
+	}
+
+	_, err = sim.Run(Bucket(quoter), ReadCSV(strings.NewReader("1\n0\n")))
+	if err == nil {
+		t.Fatal("expected out of order trace to fail")
+	}
+}
+
+func TestPoissonMonth(t *testing.T) {
+	if testing.Short() {
+		t.Skip("long simulation")
+	}
+
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	sim := New(Options{Start: start, MaxWait: time.Second})
+	quoter := bucket_quoter.NewBucketQuoterWithTimer(10, 10, true, nil, sim.Timer())
+	quota := bucket_quoter.NewPeriodQuotaWithTimer(4000000, bucket_quoter.PeriodMonthly, time.UTC, sim.Timer())
+
+	began := time.Now()
+	r, err := sim.Run(All(Quota(quota, sim.Timer()), Bucket(quoter)), Poisson(1.5, 31*24*time.Hour, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("simulated in %s: %s", time.Since(began), r.AsString())
+
+	if r.Requests < 4000000 || r.Denied > r.Requests/100 || r.Throughput < 1.49 || r.Throughput > 1.51 {
+		t.Fatalf("unexpected report %s", r.AsString())
+	}
+}
+
+func TestBurstyQuotaExhausted(t *testing.T) {
+	start := time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC)
+	sim := New(Options{Start: start})
+	quota := bucket_quoter.NewPeriodQuotaWithTimer(1000, bucket_quoter.PeriodMonthly, time.UTC, sim.Timer())
+
+	// two hours across month boundary, quota is reset on the 1st
+	r, err := sim.Run(Quota(quota, sim.Timer()), Bursty(1, 50, 10*time.Second, time.Minute, 2*time.Hour, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Allowed != 2000 || r.Denied != r.Requests-2000 {
+		t.Fatalf("unexpected report %s", r.AsString())
+	}
+}
+
+func TestQuotaDelayedChargesNextPeriod(t *testing.T) {
+	start := time.Date(2026, 10, 18, 23, 59, 59, 0, time.UTC)
+	sim := New(Options{Start: start, MaxWait: 2 * time.Second})
+	quota := bucket_quoter.NewPeriodQuotaWithTimer(2, bucket_quoter.PeriodDaily, time.UTC, sim.Timer())
+
+	// two delayed callers take the next day, the third one waits too long,
+	// nothing is left after midnight
+	r, err := sim.Run(Quota(quota, sim.Timer()), ReadCSV(strings.NewReader("0\n0\n0\n0\n0\n1.5\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Allowed != 2 || r.Delayed != 2 || r.Denied != 2 || r.WaitMax != time.Second {
+		t.Fatalf("unexpected report %s", r.AsString())
+	}
+}
@@ -0,0 +1,171 @@
+package simulator
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Arrival is a request of the trace, At is offset from the trace start
+type Arrival struct {
+	At   time.Duration
+	Cost int64
+}
+
+// Trace yields arrivals ordered by time, traces are generated lazily so
+// long periods of traffic do not have to fit into memory
+type Trace interface {
+	Next() (Arrival, bool)
+	// Err returns error stopped the trace, if any
+	Err() error
+}
+
+type poissonTrace struct {
+	rnd      *rand.Rand
+	rate     func(at time.Duration) float64
+	peak     float64
+	duration time.Duration
+	at       float64
+}
+
+// Poisson generates arrivals with exponential inter-arrival times, rate
+// is requests per second
+func Poisson(rate float64, duration time.Duration, seed int64) Trace {
+	return &poissonTrace{
+		rnd:      rand.New(rand.NewSource(seed)),
+		rate:     func(time.Duration) float64 { return rate },
+		peak:     rate,
+		duration: duration,
+	}
+}
+
+// Bursty generates Poisson arrivals at base rate, switching to burst rate
+// for burstLength at the beginning of every period
+func Bursty(base float64, burst float64, burstLength time.Duration, period time.Duration,
+	duration time.Duration, seed int64) Trace {
+	return &poissonTrace{
+		rnd: rand.New(rand.NewSource(seed)),
+		rate: func(at time.Duration) float64 {
+			if period > 0 && at%period < burstLength {
+				return burst
+			}
+			return base
+		},
+		peak:     math.Max(base, burst),
+		duration: duration,
+	}
+}
+
+// Next uses thinning: candidates are generated at peak rate and accepted
+// with probability rate(t) / peak
+func (t *poissonTrace) Next() (Arrival, bool) {
+	if t.peak <= 0 {
+		return Arrival{}, false
+	}
+	for {
+		t.at += t.rnd.ExpFloat64() / t.peak * float64(time.Second)
+		at := time.Duration(t.at)
+		if at >= t.duration {
+			return Arrival{}, false
+		}
+		if t.rnd.Float64()*t.peak < t.rate(at) {
+			return Arrival{At: at, Cost: 1}, true
+		}
+	}
+}
+
+func (t *poissonTrace) Err() error {
+	return nil
+}
+
+type csvTrace struct {
+	r     *csv.Reader
+	start *time.Time
+	last  time.Duration
+	err   error
+}
+
+// ReadCSV replays recorded trace, every row is "time[,cost]" where time is
+// either RFC3339 timestamp or offset in seconds, rows must be ordered
+func ReadCSV(r io.Reader) Trace {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+
+	return &csvTrace{r: cr}
+}
+
+func (t *csvTrace) Next() (Arrival, bool) {
+	if t.err != nil {
+		return Arrival{}, false
+	}
+	for {
+		row, err := t.r.Read()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.err = err
+			}
+			return Arrival{}, false
+		}
+		if len(row) == 0 || row[0] == "" {
+			continue
+		}
+
+		a, err := t.parse(row)
+		if err != nil {
+			// header line is skipped
+			if line, _ := t.r.FieldPos(0); line == 1 {
+				continue
+			}
+			t.err = err
+			return Arrival{}, false
+		}
+		if a.At < t.last {
+			line, _ := t.r.FieldPos(0)
+			t.err = fmt.Errorf("simulator: trace line %d is out of order", line)
+			return Arrival{}, false
+		}
+		t.last = a.At
+
+		return a, true
+	}
+}
+
+func (t *csvTrace) parse(row []string) (Arrival, error) {
+	a := Arrival{Cost: 1}
+
+	value := strings.TrimSpace(row[0])
+	if ts, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		if t.start == nil {
+			t.start = &ts
+		}
+		a.At = ts.Sub(*t.start)
+	} else {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 0 {
+			return a, fmt.Errorf("simulator: invalid time '%s'", value)
+		}
+		a.At = time.Duration(seconds * float64(time.Second))
+	}
+
+	if len(row) > 1 && strings.TrimSpace(row[1]) != "" {
+		cost, err := strconv.ParseInt(strings.TrimSpace(row[1]), 10, 64)
+		if err != nil || cost <= 0 {
+			return a, fmt.Errorf("simulator: invalid cost '%s'", row[1])
+		}
+		a.Cost = cost
+	}
+
+	return a, nil
+}
+
+func (t *csvTrace) Err() error {
+	return t.err
+}
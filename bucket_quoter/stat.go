@@ -6,4 +6,9 @@ type BucketQuoterStat struct {
 	TokensUsed       int64
 	UsecWaited       int64
 	AggregateInflow  int64
+
+	// wait queue
+	QueueDepth    int64
+	QueueRejected int64
+	QueueTimeouts int64
 }
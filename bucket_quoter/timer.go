@@ -1,6 +1,9 @@
 package bucket_quoter
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
 // Timers - only ms now (add us by demand)
 
@@ -31,3 +34,36 @@ func (t *InstantTimerMs) Duration(from int64, to int64) int64 {
 func (t *InstantTimerMs) Resolution() int64 {
 	return t.resolution
 }
+
+// ManualTimer is moved by hand (virtual time for simulations and tests),
+// milliseconds
+type ManualTimer struct {
+	now        atomic.Int64
+	resolution int64
+}
+
+func NewManualTimerMs(start int64) *ManualTimer {
+	t := &ManualTimer{resolution: 1000}
+	t.now.Store(start)
+	return t
+}
+
+func (t *ManualTimer) Now() int64 {
+	return t.now.Load()
+}
+
+func (t *ManualTimer) Duration(from int64, to int64) int64 {
+	return to - from
+}
+
+func (t *ManualTimer) Resolution() int64 {
+	return t.resolution
+}
+
+func (t *ManualTimer) Set(now int64) {
+	t.now.Store(now)
+}
+
+func (t *ManualTimer) Advance(d time.Duration) {
+	t.now.Add(int64(d) * t.resolution / int64(time.Second))
+}
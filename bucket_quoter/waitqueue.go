@@ -0,0 +1,246 @@
+package bucket_quoter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Wait Queue
+//
+// Waiters are served one by one: the head of the queue is the only one
+// sleeping on the bucket, the rest wait for their turn. Within a class
+// waiters are served first-come-first-served, classes share the bucket
+// by weight (stride scheduling by tokens requested).
+
+var (
+	ErrQueueFull    = errors.New("bucket_quoter: wait queue is full")
+	ErrWaitTimeout  = errors.New("bucket_quoter: wait timeout")
+	ErrUnknownClass = errors.New("bucket_quoter: unknown wait class")
+)
+
+const DefaultWaitClass = "default"
+
+type WaitClass struct {
+	Name   string
+	Weight int64
+}
+
+type WaitQueueOptions struct {
+	// empty means single DefaultWaitClass
+	Classes []WaitClass
+	// 0 means unlimited
+	MaxLength int
+	// per waiter, 0 means no timeout besides context
+	Timeout time.Duration
+}
+
+type WaitQueue struct {
+	quoter *BucketQuoter
+
+	mutex   sync.Mutex
+	opts    WaitQueueOptions
+	classes map[string]*waitClass
+	order   []*waitClass
+
+	length  int
+	serving bool
+	// pass of the class served last
+	vtime float64
+
+	// called with queue length when waiter is queued, lets tests wait
+	// for waiters without polling
+	queued func(length int)
+}
+
+type waitClass struct {
+	weight  int64
+	pass    float64
+	waiters []*waiter
+}
+
+type waiter struct {
+	tokens  int64
+	ready   chan struct{}
+	granted bool
+}
+
+func NewWaitQueue(quoter *BucketQuoter, opts WaitQueueOptions) (*WaitQueue, error) {
+	if len(opts.Classes) == 0 {
+		opts.Classes = []WaitClass{{Name: DefaultWaitClass, Weight: 1}}
+	}
+	if opts.MaxLength < 0 || opts.Timeout < 0 {
+		return nil, errors.New("bucket_quoter: negative wait queue length or timeout")
+	}
+
+	w := &WaitQueue{
+		quoter:  quoter,
+		opts:    opts,
+		classes: make(map[string]*waitClass),
+	}
+	for _, c := range opts.Classes {
+		if c.Weight <= 0 {
+			return nil, errors.New("bucket_quoter: wait class weight must be positive")
+		}
+		if _, ok := w.classes[c.Name]; ok {
+			return nil, errors.New("bucket_quoter: duplicate wait class " + c.Name)
+		}
+		w.classes[c.Name] = &waitClass{weight: c.Weight}
+		w.order = append(w.order, w.classes[c.Name])
+	}
+
+	return w, nil
+}
+
+// PUBLIC
+
+// Wait blocks until the caller's turn comes and tokens are taken from the
+// bucket. On error no tokens are taken.
+func (w *WaitQueue) Wait(ctx context.Context, class string, tokens int64) error {
+	w.mutex.Lock()
+	c, ok := w.classes[class]
+	if !ok {
+		w.mutex.Unlock()
+		return ErrUnknownClass
+	}
+	if w.opts.MaxLength > 0 && w.length >= w.opts.MaxLength {
+		// stat
+		w.quoter.Stat.QueueRejected += 1
+		w.mutex.Unlock()
+		return ErrQueueFull
+	}
+
+	wt := &waiter{tokens: tokens, ready: make(chan struct{})}
+	if len(c.waiters) == 0 && c.pass < w.vtime {
+		// idle class does not bank credit
+		c.pass = w.vtime
+	}
+	c.waiters = append(c.waiters, wt)
+	w.length += 1
+	w.quoter.Stat.QueueDepth = int64(w.length)
+	if w.queued != nil {
+		w.queued(w.length)
+	}
+
+	if !w.serving {
+		w.serving = true
+		w.dispatchNoLock()
+	}
+	w.mutex.Unlock()
+
+	if w.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.opts.Timeout)
+		defer cancel()
+	}
+
+	select {
+	case <-wt.ready:
+	case <-ctx.Done():
+		w.mutex.Lock()
+		if !wt.granted {
+			c.remove(wt)
+			w.length -= 1
+			w.quoter.Stat.QueueDepth = int64(w.length)
+			w.quoter.Stat.QueueTimeouts += 1
+			w.mutex.Unlock()
+			return waitError(ctx)
+		}
+		// turn came together with cancellation, head has
+		// to pass it on anyway
+		w.mutex.Unlock()
+	}
+
+	err := w.acquire(ctx, tokens)
+
+	w.mutex.Lock()
+	if err != nil {
+		w.quoter.Stat.QueueTimeouts += 1
+	}
+	w.dispatchNoLock()
+	w.mutex.Unlock()
+
+	return err
+}
+
+func (w *WaitQueue) Len() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.length
+}
+
+// PRIVATE
+
+// dispatchNoLock grants the turn to the next waiter, must be called
+// with the turn held (serving)
+func (w *WaitQueue) dispatchNoLock() {
+	var next *waitClass
+	for _, c := range w.order {
+		if len(c.waiters) > 0 && (next == nil || c.pass < next.pass) {
+			next = c
+		}
+	}
+	if next == nil {
+		w.serving = false
+		return
+	}
+
+	wt := next.waiters[0]
+	next.waiters = next.waiters[1:]
+	w.length -= 1
+	w.quoter.Stat.QueueDepth = int64(w.length)
+
+	w.vtime = next.pass
+	next.pass += float64(wt.tokens) / float64(next.weight)
+
+	wt.granted = true
+	close(wt.ready)
+}
+
+// acquire sleeps on the bucket until it is available and takes tokens
+func (w *WaitQueue) acquire(ctx context.Context, tokens int64) error {
+	q := w.quoter
+	var waited int64
+	for {
+		q.bucketMutex.Lock()
+		// stat, updated under lock as waiters of UseWithContext run
+		// concurrently
+		q.Stat.UsecWaited += waited
+		waited = 0
+
+		if q.isAvailableNoLock() {
+			q.useNoLock(tokens, false)
+			q.bucketMutex.Unlock()
+			return nil
+		}
+		delay := q.waitTimeNoLock()
+		q.bucketMutex.Unlock()
+
+		t := time.NewTimer(time.Duration(delay) * time.Microsecond)
+		select {
+		case <-t.C:
+			waited = delay
+		case <-ctx.Done():
+			t.Stop()
+			return waitError(ctx)
+		}
+	}
+}
+
+func (c *waitClass) remove(wt *waiter) {
+	for i, item := range c.waiters {
+		if item == wt {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func waitError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrWaitTimeout
+	}
+	return ctx.Err()
+}
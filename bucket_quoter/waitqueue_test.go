@@ -0,0 +1,134 @@
+package bucket_quoter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queuedSignal returns channel getting queue length whenever waiter is
+// queued
+func queuedSignal(queue *WaitQueue) chan int {
+	queued := make(chan int, 16)
+	queue.queued = func(length int) { queued <- length }
+	return queued
+}
+
+func TestWaitQueueOrder(t *testing.T) {
+	// one token per 10ms of manual time, bucket is in debt, so head of
+	// queue waits until time is advanced
+	timer := NewManualTimerMs(0)
+	quoter := NewBucketQuoterWithTimer(100, 1, false, nil, timer)
+	quoter.Use(1)
+
+	queue, err := NewWaitQueue(quoter, WaitQueueOptions{
+		Classes: []WaitClass{{Name: "interactive", Weight: 3}, {Name: "batch", Weight: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := queuedSignal(queue)
+
+	served := make(chan string)
+	wait := func(class string, name string) {
+		if err := queue.Wait(context.Background(), class, 1); err != nil {
+			t.Error(err)
+		}
+		served <- name
+	}
+
+	// the first waiter becomes head, the rest are queued in order,
+	// interactive gets three turns for every batch one
+	for _, name := range []string{"b0", "b1", "b2", "i0", "i1", "i2"} {
+		class := "batch"
+		if name[0] == 'i' {
+			class = "interactive"
+		}
+		go wait(class, name)
+		<-queued
+	}
+
+	// every token lets one waiter through
+	expected := []string{"b0", "i0", "i1", "i2", "b1", "b2"}
+	for i := range expected {
+		timer.Advance(15 * time.Millisecond)
+		if name := <-served; name != expected[i] {
+			t.Fatalf("expected %s served as %d of %v, got %s", expected[i], i, expected, name)
+		}
+	}
+}
+
+func TestWaitQueueLimits(t *testing.T) {
+	// one token per second, bucket is drained
+	quoter := NewBucketQuoter(1, 1, false, nil)
+	quoter.Use(1)
+
+	queue, err := NewWaitQueue(quoter, WaitQueueOptions{MaxLength: 1, Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queued := queuedSignal(queue)
+
+	// the first waiter becomes head, the second one fills the queue
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- queue.Wait(context.Background(), DefaultWaitClass, 1)
+		}()
+		<-queued
+	}
+
+	if err := queue.Wait(context.Background(), DefaultWaitClass, 1); err != ErrQueueFull {
+		t.Fatalf("expected queue full, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != ErrWaitTimeout {
+			t.Fatalf("expected wait timeout, got %v", err)
+		}
+	}
+	if quoter.Stat.QueueDepth != 0 || quoter.Stat.QueueRejected != 1 || quoter.Stat.QueueTimeouts != 2 {
+		t.Fatalf("unexpected stat %+v", *quoter.Stat)
+	}
+}
+
+func TestWaitQueueConcurrent(t *testing.T) {
+	// one token per ms, bucket is drained
+	quoter := NewBucketQuoter(1000, 1, false, nil)
+	quoter.Use(1)
+
+	queue, err := NewWaitQueue(quoter, WaitQueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queue waiters and UseWithContext callers share the bucket
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := queue.Wait(context.Background(), DefaultWaitClass, 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := quoter.UseWithContext(context.Background(), 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	quoter.bucketMutex.Lock()
+	defer quoter.bucketMutex.Unlock()
+	if quoter.Stat.UsecWaited == 0 {
+		t.Fatalf("expected waiting to be counted")
+	}
+}
@@ -0,0 +1,132 @@
+package bucket_quoter
+
+import (
+	"errors"
+	"time"
+)
+
+// Warm-up
+//
+// Similar to Guava SmoothWarmingUp: right after start, or after bucket has
+// been idle, effective inflow ramps linearly from cold inflow up to the
+// configured one over the warm-up period. Tokens stored in the bucket are
+// cut down to one second of cold inflow when ramp (re)starts, so an idle
+// bucket does not let full capacity burst through.
+
+type WarmupOptions struct {
+	ColdInflow int64
+	Period     time.Duration
+	// bucket not used for that long gets cold again, 0 means warm-up
+	// happens only once after start
+	IdleTimeout time.Duration
+}
+
+type warmup struct {
+	opts WarmupOptions
+
+	// timer units
+	period int64
+	idle   int64
+
+	start   int64
+	lastUse int64
+}
+
+// SetWarmup enables warm-up ramp starting now
+func (q *BucketQuoter) SetWarmup(opts WarmupOptions) error {
+	if opts.ColdInflow <= 0 || opts.Period <= 0 || opts.IdleTimeout < 0 {
+		return errors.New("bucket_quoter: invalid warm-up options")
+	}
+
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+
+	q.fillBucket()
+
+	units := func(d time.Duration) int64 {
+		return int64(d) * q.timer.Resolution() / int64(time.Second)
+	}
+	q.warmup = &warmup{
+		opts:   opts,
+		period: units(opts.Period),
+		idle:   units(opts.IdleTimeout),
+	}
+	q.warmup.restart(q, q.timer.Now())
+
+	return nil
+}
+
+// IsWarm tells if ramp is over
+func (q *BucketQuoter) IsWarm() bool {
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+
+	return q.warmup == nil || q.warmup.inflow(q, q.timer.Now()) >= q.InflowTokensPerSecond.Load()
+}
+
+// PRIVATE
+
+func (w *warmup) restart(q *BucketQuoter, now int64) {
+	w.start = now
+	w.lastUse = now
+	if q.Bucket > w.opts.ColdInflow {
+		q.Bucket = w.opts.ColdInflow
+	}
+}
+
+// use is called on every take of tokens with bucket filled up to now
+func (w *warmup) use(q *BucketQuoter) {
+	now := q.timer.Now()
+	if w.idle > 0 && q.timer.Duration(w.lastUse, now) >= w.idle {
+		w.restart(q, now)
+	}
+	w.lastUse = now
+}
+
+// inflow returns effective tokens per second at the moment
+func (w *warmup) inflow(q *BucketQuoter, at int64) int64 {
+	hot := q.InflowTokensPerSecond.Load()
+	cold := w.opts.ColdInflow
+	if cold >= hot {
+		return hot
+	}
+
+	since := q.timer.Duration(w.start, at)
+	if since >= w.period {
+		return hot
+	}
+	return cold + (hot-cold)*since/w.period
+}
+
+// inflowElapsed returns integral of inflow over [from, to] in tokens per
+// second times timer units, the same as inflow * elapsed without warm-up
+func (w *warmup) inflowElapsed(q *BucketQuoter, from int64, to int64) int64 {
+	hot := q.InflowTokensPerSecond.Load()
+	cold := w.opts.ColdInflow
+	if cold >= hot {
+		return hot * q.timer.Duration(from, to)
+	}
+
+	// offsets from ramp start
+	a := q.timer.Duration(w.start, from)
+	b := q.timer.Duration(w.start, to)
+	if a < 0 {
+		a = 0
+	}
+
+	var total float64
+	if a < w.period {
+		end := b
+		if end > w.period {
+			end = w.period
+		}
+		slope := float64(hot-cold) / float64(w.period)
+		total += float64(cold)*float64(end-a) + slope*(float64(end*end)-float64(a*a))/2
+		a = end
+	}
+	if b > a {
+		total += float64(hot) * float64(b-a)
+	}
+
+	return int64(total)
+}
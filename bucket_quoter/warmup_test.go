@@ -0,0 +1,54 @@
+package bucket_quoter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWarmup(t *testing.T) {
+	timer := NewManualTimerMs(0)
+	quoter := NewBucketQuoterWithTimer(100, 1000, true, nil, timer)
+
+	err := quoter.SetWarmup(WarmupOptions{ColdInflow: 10, Period: 10 * time.Second, IdleTimeout: 30 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quoter.GetAvailable() != 10 {
+		t.Fatalf("expected bucket cut down to cold inflow, got %d", quoter.GetAvailable())
+	}
+	quoter.Use(10)
+
+	// first second runs close to cold inflow: 10 + 90 * 0.1 / 2
+	timer.Advance(time.Second)
+	if got := quoter.UseAndFill(0); got != 14 {
+		t.Fatalf("expected 14 tokens after first second, got %d", got)
+	}
+	quoter.Use(14)
+
+	// whole ramp gives (10 + 100) / 2 per second on average, less
+	// fractions rounded down on every fill
+	timer.Advance(9 * time.Second)
+	if got := quoter.UseAndFill(0); got != 535 {
+		t.Fatalf("expected 535 tokens at the end of ramp, got %d", got)
+	}
+	if !quoter.IsWarm() {
+		t.Fatal("expected bucket to be warm")
+	}
+	quoter.Use(quoter.GetAvailable())
+
+	// idle bucket gets cold again on next use
+	timer.Advance(30 * time.Second)
+	quoter.TryUse(1)
+	if quoter.IsWarm() || quoter.Bucket != 9 {
+		t.Fatalf("expected cold bucket with 9 tokens, got %d", quoter.Bucket)
+	}
+
+	// the same on Use, tokens of idle time are cut down too
+	timer.Advance(10 * time.Second)
+	quoter.Use(quoter.GetAvailable())
+	timer.Advance(30 * time.Second)
+	quoter.Use(1)
+	if quoter.IsWarm() || quoter.GetAvailable() != 9 {
+		t.Fatalf("expected cold bucket with 9 tokens after Use, got %d", quoter.GetAvailable())
+	}
+}
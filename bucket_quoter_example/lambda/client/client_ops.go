@@ -45,7 +45,12 @@ func WithHTTPHost(host string) ClientOpt {
 	}
 }
 
-func WithTLSCert(caCertPath string) ClientOpt {
+// WithTLSCert verifies server by CA certificate, optional clientCert is
+// certificate and key files presented to server requiring mutual TLS.
+// Example:
+//
+//	WithTLSCert("certs/ca.crt", "certs/lambda.crt", "certs/lambda.key")
+func WithTLSCert(caCertPath string, clientCert ...string) ClientOpt {
 	return func(c *Client) error {
 		caCert, err := ioutil.ReadFile(caCertPath)
 		if err != nil {
@@ -59,6 +64,18 @@ func WithTLSCert(caCertPath string) ClientOpt {
 			RootCAs:       caCertPool,
 		}
 
+		switch {
+		case len(clientCert) == 0 || (len(clientCert) == 2 && clientCert[0] == ""):
+		case len(clientCert) == 2:
+			cert, err := tls.LoadX509KeyPair(clientCert[0], clientCert[1])
+			if err != nil {
+				return fmt.Errorf("failed to load client cert: %s, err: %w", clientCert[0], err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		default:
+			return errors.New("laas: client cert expects cert and key files")
+		}
+
 		c.httpc.SetTLSClientConfig(tlsConfig)
 		return nil
 	}
@@ -11,6 +11,9 @@ type Config struct {
 	ApiSubKey   string
 	LimiterHost string
 	CaCertPath  string
+	// client certificate for server requiring mutual TLS, optional
+	ClientCertPath string
+	ClientKeyPath  string
 }
 
 func LoadConf() (*Config, error) {
@@ -37,10 +40,18 @@ func LoadConf() (*Config, error) {
 		}
 	*/
 
+	clientCertPath := os.Getenv("CLIENT_CERT_PATH")
+	clientKeyPath := os.Getenv("CLIENT_KEY_PATH")
+	if clientCertPath != "" && (caCertPath == "" || clientKeyPath == "") {
+		return nil, fmt.Errorf("%s requires %s and %s", "CLIENT_CERT_PATH", "CA_CERT_PATH", "CLIENT_KEY_PATH")
+	}
+
 	return &Config{
-		DryRun:      dry,
-		ApiSubKey:   apiSubIs,
-		LimiterHost: limiterHost,
-		CaCertPath:  caCertPath,
+		DryRun:         dry,
+		ApiSubKey:      apiSubIs,
+		LimiterHost:    limiterHost,
+		CaCertPath:     caCertPath,
+		ClientCertPath: clientCertPath,
+		ClientKeyPath:  clientKeyPath,
 	}, nil
 }
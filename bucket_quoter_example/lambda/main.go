@@ -26,11 +26,17 @@ func basicHandler() (client.Response, error) {
 		}, nil
 	}
 
+	tlsOpt := client.WithInsecureSkipVerify()
+	if conf.ClientCertPath != "" {
+		// mutual TLS, server may take subscription from certificate
+		tlsOpt = client.WithTLSCert(conf.CaCertPath, conf.ClientCertPath, conf.ClientKeyPath)
+	}
+
 	c, err := client.NewClient(
 		client.AsService("lambda"),
 		client.WithApiSubId(conf.ApiSubKey),
 		client.WithHTTPHost(conf.LimiterHost),
-		client.WithInsecureSkipVerify(),
+		tlsOpt,
 	)
 	if err != nil {
 		return errResponse(err), nil
@@ -64,6 +64,10 @@ func init() {
 	serverCmd.core = C
 	rootCmd.AddCommand(serverCmd.Command())
 
+	// simulate sub-command
+	simulateCmd := cmdSimulate{g: &g}
+	rootCmd.AddCommand(simulateCmd.Command())
+
 	return
 }
 
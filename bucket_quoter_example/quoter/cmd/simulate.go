@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"quoter/internal"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+	"github.com/alexgaas/bucket_quoter/simulator"
+	"github.com/spf13/cobra"
+)
+
+// command: "quoter simulate"
+type cmdSimulate struct {
+	g *internal.CmdGlobal
+
+	bucket   string
+	inflow   int64
+	capacity int64
+
+	trace    string
+	file     string
+	rate     float64
+	burst    float64
+	burstLen time.Duration
+	period   time.Duration
+	duration time.Duration
+	seed     int64
+
+	start   string
+	maxWait time.Duration
+
+	// trace files, closed after run
+	files []*os.File
+}
+
+func (c *cmdSimulate) Command() *cobra.Command {
+	cmd := &cobra.Command{}
+
+	cmd.Use = "simulate"
+	cmd.Short = "Simulating bucket against traffic trace"
+	cmd.Long = `Description:
+  runs bucket configured (or given by inflow and capacity) against
+  synthetic or recorded arrival trace in virtual time and reports
+  requests allowed, delayed and denied.
+
+  Bucket inflow and capacity, warm-up and period quota are simulated,
+  schedule, adaptive inflow, concurrency and rules are not.
+`
+
+	cmd.Flags().StringVarP(&c.bucket, "bucket", "b", "", "subscription id of bucket from configuration")
+	cmd.Flags().Int64VarP(&c.inflow, "inflow", "", 0, "bucket inflow, overrides configuration")
+	cmd.Flags().Int64VarP(&c.capacity, "capacity", "", 0, "bucket capacity, overrides configuration")
+
+	cmd.Flags().StringVarP(&c.trace, "trace", "t", "poisson", "trace: 'poisson', 'bursty', 'csv' or 'decisionlog'")
+	cmd.Flags().StringVarP(&c.file, "file", "f", "", "trace file for 'csv' and 'decisionlog'")
+	cmd.Flags().Float64VarP(&c.rate, "rate", "r", 1, "requests per second")
+	cmd.Flags().Float64VarP(&c.burst, "burst-rate", "", 10, "requests per second within burst")
+	cmd.Flags().DurationVarP(&c.burstLen, "burst-length", "", 10*time.Second, "burst length")
+	cmd.Flags().DurationVarP(&c.period, "burst-period", "", time.Minute, "burst period")
+	cmd.Flags().DurationVarP(&c.duration, "duration", "", time.Hour, "trace duration")
+	cmd.Flags().Int64VarP(&c.seed, "seed", "", 1, "random seed")
+
+	cmd.Flags().StringVarP(&c.start, "start", "", "", "trace start (RFC3339), default: now")
+	cmd.Flags().DurationVarP(&c.maxWait, "max-wait", "w", 0, "delay requests up to, default: deny")
+
+	cmd.RunE = c.Run
+	return cmd
+}
+
+func (c *cmdSimulate) Run(cmd *cobra.Command, args []string) error {
+	start := time.Now()
+	if c.start != "" {
+		var err error
+		if start, err = time.Parse(time.RFC3339, c.start); err != nil {
+			return fmt.Errorf("invalid start, err:'%s'", err)
+		}
+	}
+
+	sim := simulator.New(simulator.Options{Start: start, MaxWait: c.maxWait})
+
+	limiter, err := c.limiter(sim)
+	if err != nil {
+		return err
+	}
+
+	defer c.closeFiles()
+	trace, err := c.arrivals()
+	if err != nil {
+		return err
+	}
+
+	began := time.Now()
+	r, err := sim.Run(limiter, trace)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("simulated %s of traffic in %s\n", r.Duration, time.Since(began))
+	fmt.Printf("requests:   %d\n", r.Requests)
+	fmt.Printf("allowed:    %d\n", r.Allowed)
+	fmt.Printf("delayed:    %d\n", r.Delayed)
+	fmt.Printf("denied:     %d\n", r.Denied)
+	fmt.Printf("wait:       p50 %s, p90 %s, p99 %s, max %s\n", r.WaitP50, r.WaitP90, r.WaitP99, r.WaitMax)
+	fmt.Printf("throughput: %.3f rps\n", r.Throughput)
+
+	return nil
+}
+
+// limiter builds bucket the way server does, with virtual timer
+func (c *cmdSimulate) limiter(sim *simulator.Simulator) (simulator.Limiter, error) {
+	settings := &internal.BucketSettings{}
+	if c.bucket != "" {
+		var err error
+		if settings, err = c.g.Opts.Bucket(c.bucket); err != nil {
+			return nil, err
+		}
+		if settings == nil {
+			return nil, fmt.Errorf("bucket '%s' is not configured", c.bucket)
+		}
+	}
+
+	inflow, capacity := int64(settings.Inflow), int64(settings.Capacity)
+	if c.inflow > 0 {
+		inflow = c.inflow
+	}
+	if c.capacity > 0 {
+		capacity = c.capacity
+	}
+	if inflow <= 0 || capacity <= 0 {
+		return nil, errors.New("bucket or inflow and capacity must be given")
+	}
+
+	quoter := bucket_quoter.NewBucketQuoterWithTimer(inflow, capacity, false, nil, sim.Timer())
+	if settings.Warmup != nil {
+		if err := quoter.SetWarmup(settings.Warmup.Options()); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.Quota != nil {
+		quota, err := settings.Quota.NewQuota()
+		if err != nil {
+			return nil, err
+		}
+		quota = bucket_quoter.NewPeriodQuotaWithTimer(quota.Limit, quota.Period, quota.Location, sim.Timer())
+		return simulator.All(simulator.Quota(quota, sim.Timer()), simulator.Bucket(quoter)), nil
+	}
+
+	return simulator.Bucket(quoter), nil
+}
+
+func (c *cmdSimulate) arrivals() (simulator.Trace, error) {
+	switch c.trace {
+	case "poisson":
+		return simulator.Poisson(c.rate, c.duration, c.seed), nil
+	case "bursty":
+		return simulator.Bursty(c.rate, c.burst, c.burstLen, c.period, c.duration, c.seed), nil
+	case "csv":
+		f, err := c.open(c.file)
+		if err != nil {
+			return nil, err
+		}
+		return simulator.ReadCSV(f), nil
+	case "decisionlog":
+		// rotated files are replayed first, requests of the bucket
+		// simulated only
+		var readers []io.Reader
+		for _, path := range internal.DecisionLogFiles(c.file) {
+			f, err := c.open(path)
+			if err != nil {
+				return nil, err
+			}
+			readers = append(readers, f)
+		}
+		return internal.DecisionTrace(io.MultiReader(readers...), c.bucket), nil
+	}
+
+	return nil, fmt.Errorf("unknown trace '%s'", c.trace)
+}
+
+// open opens trace file, trace is read while simulation runs
+func (c *cmdSimulate) open(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	c.files = append(c.files, f)
+	return f, nil
+}
+
+func (c *cmdSimulate) closeFiles() {
+	for _, f := range c.files {
+		f.Close()
+	}
+	c.files = nil
+}
@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admin API changes buckets at runtime, changes are not written back to
+// configuration. Callers are authenticated by "auth" section (see auth.go),
+// tenants see their own buckets only.
+
+const (
+	ERROR_UNAUTHORIZED     = "unauthorized"
+	ERROR_KEY_EXISTS       = "key_exists"
+	ERROR_INVALID_SETTINGS = "invalid_settings"
+)
+
+// AdminBucket is bucket state with settings it runs with
+type AdminBucket struct {
+	State    BucketState     `json:"state"`
+	Settings *BucketSettings `json:"settings"`
+	Quota    *QuotaInfo      `json:"quota,omitempty"`
+	// requests in flight, set if concurrency is limited
+	InFlight *int `json:"inFlight,omitempty"`
+}
+
+type AdminBucketsResponse struct {
+	Buckets []AdminBucket `json:"buckets"`
+}
+
+// AdminUpdateRequest changes limits of bucket, tokens are kept
+type AdminUpdateRequest struct {
+	Inflow   int `json:"inflow"`
+	Capacity int `json:"capacity"`
+}
+
+func (a *Api) registerAdmin(r *gin.Engine) {
+	admin := r.Group("/admin", a.adminAuth)
+	admin.GET("/buckets", a.adminListBuckets)
+	admin.GET("/buckets/:key", a.adminGetBucket)
+	admin.POST("/buckets/:key", a.adminWrite, a.adminCreateBucket)
+	admin.PATCH("/buckets/:key", a.adminWrite, a.adminUpdateBucket)
+	admin.DELETE("/buckets/:key", a.adminWrite, a.adminDeleteBucket)
+	admin.POST("/buckets/:key/reset", a.adminWrite, a.adminResetBucket)
+	admin.POST("/buckets/:key/refill", a.adminWrite, a.adminRefillBucket)
+}
+
+// adminAuth authenticates caller, reading requires any role, changes
+// require admin role
+func (a *Api) adminAuth(c *gin.Context) {
+	// routes are registered always, authentication could be set by reload
+	if len(*a.auth.Load()) == 0 {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	a.authenticate(c)
+}
+
+// adminWrite is middleware of routes changing buckets
+func (a *Api) adminWrite(c *gin.Context) {
+	if p := principal(c); p == nil || !p.CanWrite() {
+		a.v1SendError(c, apiError(403, ERROR_FORBIDDEN, "Admin role is required"))
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func (a *Api) adminBucket(key string, sub *subscription) AdminBucket {
+	b := AdminBucket{
+		State:    a.bucketState(key, sub.limiter),
+		Settings: sub.settings,
+	}
+	if sub.quota != nil {
+		b.Quota = &QuotaInfo{Limit: sub.quota.Limit, Remaining: sub.quota.Remaining(), Reset: sub.quota.ResetTime().UTC()}
+	}
+	if sub.concurrency != nil {
+		inFlight := sub.concurrency.InFlight()
+		b.InFlight = &inFlight
+	}
+	return b
+}
+
+// adminSubscription returns subscription of key parameter or replies 404,
+// 403 if caller may not see it
+func (a *Api) adminSubscription(c *gin.Context) (string, *subscription, bool) {
+	key := c.Param("key")
+	if err := authorizeRead(c, key); err != nil {
+		a.v1SendError(c, err)
+		return key, nil, false
+	}
+	sub, ok := a.subscription(key)
+	if !ok {
+		a.v1SendError(c, apiError(404, ERROR_UNKNOWN_KEY, fmt.Sprintf("Unknown subscription '%s'", key)))
+	}
+	return key, sub, ok
+}
+
+func (a *Api) adminListBuckets(c *gin.Context) {
+	keys := a.subscriptionKeys()
+	sort.Strings(keys)
+
+	r := AdminBucketsResponse{Buckets: []AdminBucket{}}
+	p := principal(c)
+	for _, key := range keys {
+		if p != nil && !p.CanRead(key) {
+			continue
+		}
+		// may be deleted meanwhile
+		if sub, ok := a.subscription(key); ok {
+			r.Buckets = append(r.Buckets, a.adminBucket(key, sub))
+		}
+	}
+	a.apiSendJSON(c, 200, r)
+}
+
+func (a *Api) adminGetBucket(c *gin.Context) {
+	if key, sub, ok := a.adminSubscription(c); ok {
+		a.apiSendJSON(c, 200, a.adminBucket(key, sub))
+	}
+}
+
+func (a *Api) adminCreateBucket(c *gin.Context) {
+	key := c.Param("key")
+	if reservedKey(key) {
+		a.v1SendError(c, apiError(400, ERROR_BAD_REQUEST, fmt.Sprintf("Key '%s' is reserved", key)))
+		return
+	}
+
+	var settings BucketSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		a.v1SendError(c, apiError(400, ERROR_BAD_REQUEST, fmt.Sprintf("Invalid request, err:'%s'", err)))
+		return
+	}
+	resolved, err := a.resolvePlan(&settings)
+	var sub *subscription
+	if err == nil {
+		sub, err = newSubscription(key, resolved)
+	}
+	if err != nil {
+		a.v1SendError(c, apiError(400, ERROR_INVALID_SETTINGS, err.Error()))
+		return
+	}
+	if settings.Plan != "" {
+		sub.overrides = &settings
+	}
+
+	if !a.createSubscription(key, sub) {
+		a.v1SendError(c, apiError(409, ERROR_KEY_EXISTS, fmt.Sprintf("Subscription '%s' exists", key)))
+		return
+	}
+	a.scheduler.Apply()
+	a.g.Log.Info(fmt.Sprintf("(admin) bucket:'%s' created plan:'%s' inflow:'%d' capacity:'%d'",
+		key, resolved.Plan, resolved.Inflow, resolved.Capacity))
+
+	a.apiSendJSON(c, 201, a.adminBucket(key, sub))
+}
+
+func (a *Api) adminUpdateBucket(c *gin.Context) {
+	key := c.Param("key")
+
+	var req AdminUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		a.v1SendError(c, apiError(400, ERROR_BAD_REQUEST, fmt.Sprintf("Invalid request, err:'%s'", err)))
+		return
+	}
+
+	sub, err := a.updateSubscription(key, req.Inflow, req.Capacity)
+	if err != nil {
+		a.v1SendError(c, apiError(400, ERROR_INVALID_SETTINGS, err.Error()))
+		return
+	}
+	if sub == nil {
+		a.v1SendError(c, apiError(404, ERROR_UNKNOWN_KEY, fmt.Sprintf("Unknown subscription '%s'", key)))
+		return
+	}
+	a.scheduler.Apply()
+	a.g.Log.Info(fmt.Sprintf("(admin) bucket:'%s' updated inflow:'%d' capacity:'%d'", key, req.Inflow, req.Capacity))
+
+	a.apiSendJSON(c, 200, a.adminBucket(key, sub))
+}
+
+func (a *Api) adminDeleteBucket(c *gin.Context) {
+	key := c.Param("key")
+	if !a.removeSubscription(key) {
+		a.v1SendError(c, apiError(404, ERROR_UNKNOWN_KEY, fmt.Sprintf("Unknown subscription '%s'", key)))
+		return
+	}
+	a.g.Log.Info(fmt.Sprintf("(admin) bucket:'%s' deleted", key))
+
+	c.Status(204)
+}
+
+// adminResetBucket returns bucket to the state of start: no tokens, no
+// debt, quota usage of the period cleared
+func (a *Api) adminResetBucket(c *gin.Context) {
+	key, sub, ok := a.adminSubscription(c)
+	if !ok {
+		return
+	}
+
+	sub.limiter.SetTokens(0)
+	if sub.quota != nil {
+		sub.quota.Reset()
+	}
+	a.g.Log.Info(fmt.Sprintf("(admin) bucket:'%s' reset", key))
+
+	a.apiSendJSON(c, 200, a.adminBucket(key, sub))
+}
+
+func (a *Api) adminRefillBucket(c *gin.Context) {
+	key, sub, ok := a.adminSubscription(c)
+	if !ok {
+		return
+	}
+
+	sub.limiter.SetTokens(sub.limiter.BucketTokensCapacity.Load())
+	a.g.Log.Info(fmt.Sprintf("(admin) bucket:'%s' refilled", key))
+
+	a.apiSendJSON(c, 200, a.adminBucket(key, sub))
+}
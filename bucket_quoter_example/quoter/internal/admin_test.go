@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func adminRequest(r *gin.Engine, method string, path string, body string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func adminBucket(t *testing.T, w *httptest.ResponseRecorder) AdminBucket {
+	var b AdminBucket
+	if err := json.Unmarshal(w.Body.Bytes(), &b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestAdminBuckets(t *testing.T) {
+	conf := &ConfYaml{
+		Admin:   AdminSection{Token: "secret"},
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 5}}},
+	}
+	_, r := testApiConf(t, conf)
+
+	if w := adminRequest(r, "GET", "/admin/buckets", "", ""); w.Code != 401 {
+		t.Fatalf("expected 401 without token, got %d", w.Code)
+	}
+	if w := adminRequest(r, "GET", "/admin/buckets", "", "wrong"); w.Code != 401 {
+		t.Fatalf("expected 401 with wrong token, got %d", w.Code)
+	}
+
+	// create
+	w := adminRequest(r, "POST", "/admin/buckets/b", `{"inflow": 2, "capacity": 3, "quota": {"limit": 100, "period": "daily"}}`, "secret")
+	if b := adminBucket(t, w); w.Code != 201 || b.State.Capacity != 3 || b.Quota == nil || b.Quota.Limit != 100 {
+		t.Fatalf("unexpected create %d %s", w.Code, w.Body.String())
+	}
+	if w := adminRequest(r, "POST", "/admin/buckets/b", `{"inflow": 2, "capacity": 3}`, "secret"); w.Code != 409 {
+		t.Fatalf("expected 409 on existing key, got %d", w.Code)
+	}
+	if w := adminRequest(r, "POST", "/admin/buckets/c", `{"inflow": 0, "capacity": 3}`, "secret"); w.Code != 400 {
+		t.Fatalf("expected 400 on invalid settings, got %d", w.Code)
+	}
+	for _, key := range []string{"rule:tenant:acme", "anonymous:192.0.2.1"} {
+		if w := adminRequest(r, "POST", "/admin/buckets/"+key, `{"inflow": 2, "capacity": 3}`, "secret"); w.Code != 400 {
+			t.Fatalf("%s: expected 400 on reserved key, got %d", key, w.Code)
+		}
+	}
+
+	// new bucket serves traffic right away
+	if w := testRequest(r, "GET", "/limiter", "b"); w.Code != 200 {
+		t.Fatalf("expected 200 from created bucket, got %d", w.Code)
+	}
+
+	// refill, update keeps tokens, reset empties
+	if b := adminBucket(t, adminRequest(r, "POST", "/admin/buckets/b/refill", "", "secret")); b.State.Available != 3 {
+		t.Fatalf("expected refilled bucket, got %+v", b.State)
+	}
+	w = adminRequest(r, "PATCH", "/admin/buckets/b", `{"inflow": 20, "capacity": 30}`, "secret")
+	if b := adminBucket(t, w); w.Code != 200 || b.State.Inflow != 20 || b.State.Capacity != 30 ||
+		b.State.Available != 3 || b.Settings.Quota == nil {
+		t.Fatalf("unexpected update %d %s", w.Code, w.Body.String())
+	}
+	if b := adminBucket(t, adminRequest(r, "POST", "/admin/buckets/b/reset", "", "secret")); b.State.Available != 0 ||
+		b.Quota.Remaining != 100 {
+		t.Fatalf("expected reset bucket, got %+v %+v", b.State, b.Quota)
+	}
+
+	var list AdminBucketsResponse
+	if err := json.Unmarshal(adminRequest(r, "GET", "/admin/buckets", "", "secret").Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Buckets) != 2 || list.Buckets[0].State.Key != "a" || list.Buckets[1].State.Key != "b" {
+		t.Fatalf("unexpected list %+v", list)
+	}
+
+	// delete
+	if w := adminRequest(r, "DELETE", "/admin/buckets/b", "", "secret"); w.Code != 204 {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if w := adminRequest(r, "GET", "/admin/buckets/b", "", "secret"); w.Code != 404 {
+		t.Fatalf("expected 404 after delete, got %d", w.Code)
+	}
+	if w := testRequest(r, "GET", "/limiter", "b"); w.Code != 403 {
+		t.Fatalf("expected 403 from deleted bucket, got %d", w.Code)
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	_, r := testApi(t, nil)
+
+	if w := adminRequest(r, "GET", "/admin/buckets", "", ""); w.Code != 404 {
+		t.Fatalf("expected admin API to be disabled, got %d", w.Code)
+	}
+}
+
+func TestAdminConcurrentTraffic(t *testing.T) {
+	conf := &ConfYaml{
+		Admin:   AdminSection{Token: "secret"},
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{"a": {Inflow: 1000, Capacity: 1000}}},
+	}
+	_, r := testApiConf(t, conf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				testRequest(r, "GET", "/limiter", "a")
+				testRequest(r, "GET", "/limiter", "b")
+			}
+		}()
+	}
+	for j := 0; j < 50; j++ {
+		adminRequest(r, "POST", "/admin/buckets/b", `{"inflow": 10, "capacity": 10}`, "secret")
+		adminRequest(r, "PATCH", "/admin/buckets/a", `{"inflow": 100, "capacity": 100}`, "secret")
+		adminRequest(r, "DELETE", "/admin/buckets/b", "", "secret")
+	}
+	wg.Wait()
+}
@@ -6,11 +6,14 @@ import (
 
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/sys/unix"
 )
 
 type Api struct {
@@ -18,7 +21,46 @@ type Api struct {
 
 	core *Core
 
-	limiterMap map[string]*bucket_quoter.BucketQuoter
+	// subscriptions, changed at runtime by admin API, so every access
+	// goes through limiterMutex
+	limiterMutex sync.RWMutex
+	limiterMap   map[string]*subscription
+	// quota states saved of keys not created yet, see templates.go
+	pendingStates map[string]bucket_quoter.PeriodQuotaState
+
+	// configuration applied, replaced as a whole on configuration reload
+	conf atomic.Pointer[ConfYaml]
+
+	// templates of keys not configured, changed on configuration reload
+	templates    atomic.Pointer[TemplatesSection]
+	templateKeys *templateKeys
+	// rules of request attributes, their buckets are created like buckets
+	// of templates, see rules.go
+	rules atomic.Pointer[Rules]
+
+	// plans buckets created by admin API could refer to
+	plansMutex sync.RWMutex
+	plans      map[string]*BucketSettings
+
+	quotaStore *bucket_quoter.FileQuotaStore
+
+	// optional, nil if disabled, swapped on configuration reload
+	decisionLog atomic.Pointer[DecisionLog]
+
+	// admin API is disabled if empty, changed on configuration reload
+	auth atomic.Pointer[Authenticators]
+
+	// nil if keys are sent by callers, changed on configuration reload
+	keyResolver atomic.Pointer[jwtKeyResolver]
+
+	scheduler *Scheduler
+	stop      chan struct{}
+
+	// servers running and unix sockets they listen on, see shutdown.go
+	serverMutex sync.Mutex
+	servers     []*http.Server
+	sockets     []string
+	closed      bool
 
 	metrics *prometheus.Registry
 }
@@ -27,12 +69,71 @@ func CreateApi(g *CmdGlobal) (*Api, error) {
 	var api Api
 
 	api.g = g
+	api.conf.Store(g.Opts)
 
 	// setup limiter API
-	api.limiterMap = make(map[string]*bucket_quoter.BucketQuoter)
-	for key, l := range api.g.Opts.Buckets.Buckets {
-		api.limiterMap[key] = bucket_quoter.NewBucketQuoter(int64(l.Inflow), int64(l.Capacity), false, nil)
+	api.limiterMap = make(map[string]*subscription)
+	api.pendingStates = make(map[string]bucket_quoter.PeriodQuotaState)
+	api.templateKeys = newTemplateKeys()
+	templates, err := api.g.Opts.resolvedTemplates()
+	if err != nil {
+		return nil, err
+	}
+	api.templates.Store(templates)
+	rules, err := newRules(api.g.Opts)
+	if err != nil {
+		return nil, err
+	}
+	api.rules.Store(&rules)
+	api.plans = api.g.Opts.Plans
+	buckets, err := api.g.Opts.resolvedBuckets()
+	if err != nil {
+		return nil, err
+	}
+	api.scheduler = NewScheduler(g, nil)
+	api.stop = make(chan struct{})
+	for key, l := range buckets {
+		sub, err := newSubscription(key, l)
+		if err != nil {
+			return nil, err
+		}
+		api.addSubscription(key, sub)
+	}
+
+	if api.g.Opts.RateLimiter.StateFile != "" {
+		api.quotaStore = bucket_quoter.NewFileQuotaStore(api.g.Opts.RateLimiter.StateFile)
+		states, err := api.quotaStore.Load()
+		if err != nil {
+			return nil, fmt.Errorf("loading state file: %w", err)
+		}
+		for key, state := range states {
+			if sub, ok := api.subscription(key); ok {
+				if sub.quota != nil {
+					sub.quota.Restore(state)
+				}
+			} else {
+				api.pendingStates[key] = state
+			}
+		}
+	}
+
+	if l := api.g.Opts.DecisionLog; l.Path != "" {
+		decisionLog, err := NewDecisionLog(l.Path, int64(l.MaxSize)*1024*1024, l.MaxFiles)
+		if err != nil {
+			return nil, fmt.Errorf("opening decision log: %w", err)
+		}
+		api.decisionLog.Store(decisionLog)
 	}
+	auth, err := NewAuthenticators(api.g.Opts)
+	if err != nil {
+		return nil, err
+	}
+	api.auth.Store(&auth)
+	resolver, err := newKeyResolver(&api.g.Opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	api.keyResolver.Store(resolver)
 
 	// setup metrics
 	api.metrics = prometheus.NewRegistry(prometheus.NewRegistryOpts())
@@ -40,59 +141,147 @@ func CreateApi(g *CmdGlobal) (*Api, error) {
 	return &api, nil
 }
 
-const (
-	API_UNIXSOCKET = 0
-	API_HTTPS      = 1
-)
-
-// RunHTTPServer provide run http in tcp or unix socket mode
-func (a *Api) RunHTTPServer(mode int) error {
+// RunListeners serves API on every listener configured, it returns once
+// all of them are stopped by Shutdown or on the first failure
+func (a *Api) RunListeners() error {
 	id := "(http) (server)"
-	var err error
 
-	r := a.routerEngine()
-	if mode == API_UNIXSOCKET {
+	if err := a.g.Opts.RateLimiter.Validate(); err != nil {
+		a.g.Log.Error(fmt.Sprintf("%s run failed, err:'%s'", id, err))
+		return err
+	}
+	listeners := a.g.Opts.RateLimiter.listeners()
+	handler := a.routerEngine()
+	served := make(chan error, len(listeners))
+	for _, settings := range listeners {
+		srv, err := a.server(settings, handler)
+		var l net.Listener
+		if err == nil {
+			l, err = a.listen(settings)
+		}
+		if err != nil {
+			a.g.Log.Error(fmt.Sprintf("%s run failed on listener:'%s' address:'%s', err:'%s'",
+				id, settings.Type, settings.Address, err))
+			return err
+		}
+		a.g.Log.Debug(fmt.Sprintf("%s run http server on listener:'%s' address:'%s'", id, settings.Type, settings.Address))
+
+		go func() {
+			served <- a.serve(srv, l, settings.Certfile, settings.Keyfile)
+		}()
+	}
+
+	for range listeners {
+		if err := <-served; err != nil {
+			a.g.Log.Error(fmt.Sprintf("%s run failed, err:'%s'", id, err))
+			return err
+		}
+	}
+	return nil
+}
+
+// server returns server of listener, TLS listener may verify client
+// certificates and take bucket keys from them
+func (a *Api) server(settings ListenerSettings, handler http.Handler) (*http.Server, error) {
+	// settings are validated before
+	srv := &http.Server{Handler: handler}
+	if settings.Type != LISTENER_TLS {
+		return srv, nil
+	}
+
+	var err error
+	if srv.TLSConfig, err = settings.tlsConfig(); err != nil {
+		return nil, err
+	}
+	if settings.Identity != "" {
+		srv.Handler = withIdentity(settings.Identity, handler)
+	}
 
-		socket := a.g.Opts.RateLimiter.Socket
+	return srv, nil
+}
 
+// listen opens listener, unix socket left by previous run is replaced
+func (a *Api) listen(settings ListenerSettings) (net.Listener, error) {
+	switch settings.Type {
+	case LISTENER_TCP, LISTENER_TLS:
+		return net.Listen("tcp", settings.Address)
+	case LISTENER_UNIX:
+		socket := settings.Address
 		if Exists(socket) {
-			err = os.Remove(socket)
-			if err != nil {
-				return err
+			if err := os.Remove(socket); err != nil {
+				return nil, err
 			}
 		}
 
-		a.g.Log.Debug(fmt.Sprintf("%s run http server on socket:'%s'", id, socket))
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		a.addSocket(socket)
 
-		// http web server needs to write permissions
-		// on unix socket to write
-		unix.Umask(0000)
+		// clients need write permission on socket to connect
+		mode := settings.Mode
+		if mode == 0 {
+			mode = 0666
+		}
+		if err = os.Chmod(socket, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
 
-		err = r.RunUnix(socket)
+	return nil, fmt.Errorf("unknown listener type '%s'", settings.Type)
+}
 
-		return err
+const stateSaveInterval = 10 * time.Second
+
+// SaveState persists period quotas usage
+func (a *Api) SaveState() error {
+	if a.quotaStore == nil {
+		return nil
 	}
-	if mode == API_HTTPS {
-		certfile := a.g.Opts.RateLimiter.Certfile
-		keyfile := a.g.Opts.RateLimiter.Keyfile
-		port := a.g.Opts.RateLimiter.Port
 
-		if port > 0 {
-			a.g.Log.Debug(fmt.Sprintf("%s run http server on port:'%d'", id, port))
-			err = r.RunTLS(fmt.Sprintf(":%d", port), certfile, keyfile)
-			if err != nil {
-				a.g.Log.Error(fmt.Sprintf("%s run failed on the port:'%d', err %s", id, port, err.Error()))
-			}
+	states := make(map[string]bucket_quoter.PeriodQuotaState)
+	a.limiterMutex.RLock()
+	for key, state := range a.pendingStates {
+		states[key] = state
+	}
+	for key, sub := range a.limiterMap {
+		if sub.quota != nil {
+			states[key] = sub.quota.State()
 		}
 	}
+	a.limiterMutex.RUnlock()
+	return a.quotaStore.Save(states)
+}
 
-	return err
+func (a *Api) stateLoop(stop <-chan struct{}) {
+	if a.quotaStore == nil {
+		return
+	}
+
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := a.SaveState(); err != nil {
+			a.g.Log.Error(fmt.Sprintf("(state) error saving state, err:'%s'", err))
+		}
+	}
 }
 
 // Main entry point for http requests
 func (a *Api) routerEngine() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
+	// X-Forwarded-For is spoofed easily, it is taken from trusted proxies
+	// only, proxies are validated before
+	r.SetTrustedProxies(a.g.Opts.RateLimiter.TrustedProxies)
 
 	r.Use(gin.Recovery())
 	r.Use(a.apiRequestLogger)
@@ -100,15 +289,14 @@ func (a *Api) routerEngine() *gin.Engine {
 	r.GET("/ping", a.getPing)
 	// register limiter API
 	r.GET("/limiter", a.isAPIAvailableWithLimiter)
+	r.POST("/limiter/outcome", a.reportLimiterOutcome)
+	r.GET("/limiter/state", a.authenticate, a.getLimiterState)
 
-	return r
-}
-
-func (a *Api) Apiloop(wg *sync.WaitGroup, mode int) {
-	defer wg.Done()
+	// versioned API, /limiter is kept for backward compatibility
+	a.registerV1(r)
+	a.registerAdmin(r)
 
-	a.RunHTTPServer(mode)
-	return
+	return r
 }
 
 func (a *Api) apiRequestLogger(c *gin.Context) {
@@ -118,6 +306,34 @@ func (a *Api) apiRequestLogger(c *gin.Context) {
 	c.Next()
 }
 
+// logDecision writes final decision of request with reason it is denied
+func (a *Api) logDecision(key string, cost int64, d *limiterDecision) {
+	decisionLog := a.decisionLog.Load()
+	if decisionLog == nil {
+		return
+	}
+
+	record := DecisionRecord{
+		Time:     time.Now().UTC(),
+		Key:      key,
+		Cost:     cost,
+		Decision: DECISION_ALLOWED,
+		Rule:     d.rule,
+	}
+	if d.err != nil {
+		record.Decision = DECISION_DENIED
+		record.Reason = d.err.Code
+	}
+	if d.result != nil {
+		record.Before = d.result.Before
+		record.After = d.result.After
+	}
+
+	if err := decisionLog.Write(&record); err != nil {
+		a.g.Log.Error(fmt.Sprintf("(decision) error writing log, err:'%s'", err))
+	}
+}
+
 func (a *Api) apiRequestString(c *gin.Context) (string, string) {
 	ip := c.ClientIP()
 	if len(ip) == 0 {
@@ -146,11 +362,41 @@ type Response struct {
 	Success  bool           `json:"success"`
 	Errors   []ResponseInfo `json:"errors,omitempty"`
 	Messages []ResponseInfo `json:"messages,omitempty"`
+
+	RateLimit *RateLimitInfo `json:"rateLimit,omitempty"`
+	Quota     *QuotaInfo     `json:"quota,omitempty"`
+}
+
+// RateLimitInfo describes bucket of subscription, same numbers as
+// "RateLimit-*" and "Retry-After" headers
+type RateLimitInfo struct {
+	// bucket capacity
+	Limit int64 `json:"limit"`
+	// tokens available now
+	Remaining int64 `json:"remaining"`
+	// seconds until bucket is full again
+	Reset int64 `json:"reset"`
+	// "<capacity>;w=<seconds>"
+	Policy string `json:"policy"`
+	// seconds until request may pass, 0 if it may now
+	RetryAfter int64 `json:"retryAfter"`
+	// the same with precision for buckets of high rate
+	RetryAfterMs int64 `json:"retryAfterMs"`
+}
+
+// QuotaInfo describes calendar period quota of subscription
+type QuotaInfo struct {
+	Limit     int64     `json:"limit"`
+	Remaining int64     `json:"remaining"`
+	Reset     time.Time `json:"reset"`
 }
 
 func (a *Api) apiSendError(c *gin.Context, code int, errStr string) {
 	var r Response
+	a.apiSendErrorResponse(c, code, errStr, r)
+}
 
+func (a *Api) apiSendErrorResponse(c *gin.Context, code int, errStr string, r Response) {
 	r.Success = false
 	var ri ResponseInfo
 	ri.Code = code
@@ -163,9 +409,19 @@ func (a *Api) apiSendError(c *gin.Context, code int, errStr string) {
 	c.String(code, string(response))
 }
 
+func (a *Api) apiSendJSON(c *gin.Context, code int, r interface{}) {
+	responseBody, _ := json.Marshal(r)
+
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.String(code, string(responseBody))
+}
+
 func (a *Api) apiSendOK(c *gin.Context, code int, msgStr string) {
 	var r Response
+	a.apiSendOKResponse(c, code, msgStr, r)
+}
 
+func (a *Api) apiSendOKResponse(c *gin.Context, code int, msgStr string, r Response) {
 	r.Success = true
 	var ri ResponseInfo
 	ri.Code = code
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenersConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimiter.yaml")
+	writeConf(t, path, `
+rateLimiter:
+  listeners:
+    - type: "tls"
+      address: ":8443"
+      certfile: "server.crt"
+      keyfile: "server.key"
+    - type: "unix"
+      address: "/var/run/ratelimiter.socket"
+      mode: "0660"
+`)
+	conf, err := LoadConf(path, ConfigOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := conf.RateLimiter.listeners()
+	if len(listeners) != 2 || listeners[0].Type != LISTENER_TLS || listeners[0].Certfile != "server.crt" ||
+		listeners[1].Type != LISTENER_UNIX || listeners[1].Mode != 0660 {
+		t.Fatalf("unexpected listeners %+v", listeners)
+	}
+
+	// deprecated port is TLS listener
+	legacy := RateLimiterSection{Port: 8443, Certfile: "server.crt", Keyfile: "server.key"}
+	if l := legacy.listeners(); len(l) != 1 || l[0].Type != LISTENER_TLS || l[0].Address != ":8443" {
+		t.Fatalf("unexpected listeners %+v", l)
+	}
+}
+
+func TestListenersValidate(t *testing.T) {
+	for _, invalid := range []RateLimiterSection{
+		{},
+		{Listeners: []ListenerSettings{{Type: "udp", Address: ":8080"}}},
+		{Listeners: []ListenerSettings{{Type: LISTENER_TCP}}},
+		{Listeners: []ListenerSettings{{Type: LISTENER_TLS, Address: ":8443", Certfile: "server.crt"}}},
+		{Listeners: []ListenerSettings{{Type: LISTENER_TCP, Address: ":8080", ClientCA: "ca.crt"}}},
+		{Port: 8443},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("expected error of listeners %+v", invalid)
+		}
+	}
+	legacy := RateLimiterSection{Port: 8443, Certfile: "server.crt", Keyfile: "server.key"}
+	if err := legacy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// server without listeners does not start
+	api, _ := testApiConf(t, &ConfYaml{})
+	if err := api.RunListeners(); err == nil {
+		t.Fatalf("expected error without listeners")
+	}
+
+	// malformed listener is not skipped
+	path := filepath.Join(t.TempDir(), "ratelimiter.yaml")
+	for _, listeners := range []string{`["tcp"]`, `"tcp"`} {
+		writeConf(t, path, "rateLimiter:\n  listeners: "+listeners+"\n")
+		if _, err := LoadConf(path, ConfigOverrides{}); err == nil {
+			t.Fatalf("expected error of listeners %s", listeners)
+		}
+	}
+}
+
+func TestRunListeners(t *testing.T) {
+	// free port for tcp listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	socket := filepath.Join(t.TempDir(), "ratelimiter.socket")
+	api, _ := testApiConf(t, &ConfYaml{RateLimiter: RateLimiterSection{Listeners: []ListenerSettings{
+		{Type: LISTENER_TCP, Address: address},
+		{Type: LISTENER_UNIX, Address: socket, Mode: 0600},
+	}}})
+
+	served := make(chan error)
+	go func() { served <- api.RunListeners() }()
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	for _, c := range []struct {
+		client *http.Client
+		url    string
+	}{
+		{http.DefaultClient, "http://" + address + "/ping"},
+		{unixClient, "http://socket/ping"},
+	} {
+		var resp *http.Response
+		for i := 0; i < 50; i++ {
+			if resp, err = c.client.Get(c.url); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected 200 on '%s', got %d", c.url, resp.StatusCode)
+		}
+	}
+
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected socket with mode 0600, got %v %v", info, err)
+	}
+
+	if err := api.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("expected socket to be removed, err:'%v'", err)
+	}
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Authentication of admin and introspection endpoints. Authenticators of
+// "auth" section (static bearer tokens, HMAC signed requests, JWT verified
+// by JWKS) are tried in turn, the first one recognizing credentials of its
+// scheme decides. Without authenticators admin API is disabled and
+// introspection endpoints are open.
+
+const (
+	ROLE_ADMIN = "admin"
+	// reads state of any bucket
+	ROLE_READ_ONLY = "read-only"
+	// reads state of its own buckets
+	ROLE_TENANT = "tenant"
+)
+
+// Principal is caller authenticated
+type Principal struct {
+	// token name, HMAC key id or JWT subject
+	Name string
+	Role string
+	// buckets of tenant
+	Buckets []string
+}
+
+// CanRead reports whether principal may see bucket of key
+func (p *Principal) CanRead(key string) bool {
+	switch p.Role {
+	case ROLE_ADMIN, ROLE_READ_ONLY:
+		return true
+	case ROLE_TENANT:
+		return slices.Contains(p.Buckets, key)
+	}
+	return false
+}
+
+// CanWrite reports whether principal may change buckets
+func (p *Principal) CanWrite() bool {
+	return p.Role == ROLE_ADMIN
+}
+
+// CanDescribeClient reports whether client address of request described by
+// principal is taken, so it could not dodge or charge rules of addresses
+func (p *Principal) CanDescribeClient() bool {
+	return p.Role == ROLE_ADMIN
+}
+
+func checkRole(role string) error {
+	switch role {
+	case ROLE_ADMIN, ROLE_READ_ONLY, ROLE_TENANT:
+		return nil
+	}
+	return fmt.Errorf("unknown role '%s'", role)
+}
+
+// Authenticator identifies caller of request. Principal is nil if request
+// has no credentials of authenticator scheme, error is returned if it has
+// credentials not valid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Authenticators are tried in turn
+type Authenticators []Authenticator
+
+func (auth Authenticators) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range auth {
+		p, err := a.Authenticate(r)
+		if err != nil || p != nil {
+			return p, err
+		}
+	}
+	return nil, nil
+}
+
+// NewAuthenticators creates authenticators of configuration, admin token
+// is bearer token of admin role. Empty if none is configured.
+func NewAuthenticators(conf *ConfYaml) (Authenticators, error) {
+	var auth Authenticators
+
+	tokens := conf.Auth.Tokens
+	if conf.Admin.Token != "" {
+		tokens = append([]TokenSettings{{Name: "admin", Token: conf.Admin.Token, Role: ROLE_ADMIN}}, tokens...)
+	}
+	if len(tokens) > 0 {
+		a, err := newTokenAuthenticator(tokens)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, a)
+	}
+
+	if len(conf.Auth.HMAC.Keys) > 0 {
+		a, err := newHMACAuthenticator(&conf.Auth.HMAC)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, a)
+	}
+
+	if conf.Auth.JWT.JWKS != "" {
+		a, err := newJWTAuthenticator(&conf.Auth.JWT)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, a)
+	}
+
+	return auth, nil
+}
+
+// tokenAuthenticator accepts static "Authorization: Bearer <token>"
+type tokenAuthenticator struct {
+	tokens []TokenSettings
+}
+
+func newTokenAuthenticator(tokens []TokenSettings) (*tokenAuthenticator, error) {
+	for i, t := range tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("auth token %d: token is empty", i)
+		}
+		if err := checkRole(t.Role); err != nil {
+			return nil, fmt.Errorf("auth token %d: %w", i, err)
+		}
+	}
+	return &tokenAuthenticator{tokens: tokens}, nil
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, nil
+	}
+
+	// every token is compared, time does not tell which one matched
+	var found *TokenSettings
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.tokens[i].Token)) == 1 {
+			found = &a.tokens[i]
+		}
+	}
+	if found == nil {
+		// could be token of another scheme
+		return nil, nil
+	}
+
+	return &Principal{Name: found.Name, Role: found.Role, Buckets: found.Buckets}, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
+
+const principalContextKey = "principal"
+
+// authenticate is middleware of endpoints requiring credentials if
+// authentication is configured
+func (a *Api) authenticate(c *gin.Context) {
+	auth := *a.auth.Load()
+	if len(auth) == 0 {
+		c.Next()
+		return
+	}
+
+	p, err := auth.Authenticate(c.Request)
+	if err != nil || p == nil {
+		message := "Unauthorized"
+		if err != nil {
+			message = fmt.Sprintf("Unauthorized, err:'%s'", err)
+		}
+		c.Header("WWW-Authenticate", "Bearer")
+		a.v1SendError(c, apiError(401, ERROR_UNAUTHORIZED, message))
+		c.Abort()
+		return
+	}
+
+	c.Set(principalContextKey, p)
+	c.Next()
+}
+
+// principal returns caller authenticated, nil if authentication is not
+// configured
+func principal(c *gin.Context) *Principal {
+	if p, ok := c.Get(principalContextKey); ok {
+		return p.(*Principal)
+	}
+	return nil
+}
+
+// caller returns principal of caller with valid credentials of
+// authenticators configured, also on endpoints open to everyone, nil if
+// caller is not authenticated
+func (a *Api) caller(c *gin.Context) *Principal {
+	if p := principal(c); p != nil {
+		return p
+	}
+	auth := *a.auth.Load()
+	if len(auth) == 0 {
+		return nil
+	}
+	p, err := auth.Authenticate(c.Request)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+// authorizeRead returns error unless caller may see bucket of key
+func authorizeRead(c *gin.Context, key string) *ApiError {
+	if p := principal(c); p != nil && !p.CanRead(key) {
+		return apiError(403, ERROR_FORBIDDEN, fmt.Sprintf("Access to subscription '%s' is denied", key))
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HMAC signed requests carry headers
+//
+//	X-Limiter-Key-Id: <key id>
+//	X-Limiter-Timestamp: <unix seconds>
+//	X-Limiter-Signature: hex(HMAC-SHA256(secret, canonical request))
+//
+// where canonical request is "METHOD\nPATH?QUERY\nTIMESTAMP\nhex(SHA256(body))".
+// Requests signed out of time window are rejected, so are signatures seen
+// within window, thus request captured could not be replayed.
+
+const (
+	HEADER_KEY_ID    = "X-Limiter-Key-Id"
+	HEADER_TIMESTAMP = "X-Limiter-Timestamp"
+	HEADER_SIGNATURE = "X-Limiter-Signature"
+)
+
+// seconds, used if "auth.hmac.maxSkew" is not set
+const defaultHMACMaxSkew = 300
+
+type hmacAuthenticator struct {
+	keys    map[string]HMACKeySettings
+	maxSkew time.Duration
+	now     func() time.Time
+
+	mutex sync.Mutex
+	// signatures seen by expiry time
+	seen map[string]time.Time
+}
+
+func newHMACAuthenticator(settings *HMACSettings) (*hmacAuthenticator, error) {
+	a := &hmacAuthenticator{
+		keys:    make(map[string]HMACKeySettings),
+		maxSkew: defaultHMACMaxSkew * time.Second,
+		now:     time.Now,
+		seen:    make(map[string]time.Time),
+	}
+	if settings.MaxSkew > 0 {
+		a.maxSkew = time.Duration(settings.MaxSkew) * time.Second
+	}
+
+	for i, k := range settings.Keys {
+		if k.ID == "" || k.Secret == "" {
+			return nil, fmt.Errorf("auth hmac key %d: id and secret are required", i)
+		}
+		if err := checkRole(k.Role); err != nil {
+			return nil, fmt.Errorf("auth hmac key '%s': %w", k.ID, err)
+		}
+		a.keys[k.ID] = k
+	}
+
+	return a, nil
+}
+
+// SignRequest returns signature of request, body is hashed as given
+func SignRequest(secret string, method string, uri string, timestamp int64, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", method, uri, timestamp, hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *hmacAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	id := r.Header.Get(HEADER_KEY_ID)
+	if id == "" {
+		return nil, nil
+	}
+	key, ok := a.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id '%s'", id)
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get(HEADER_TIMESTAMP), 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+	now := a.now()
+	signed := time.Unix(timestamp, 0)
+	if signed.Before(now.Add(-a.maxSkew)) || signed.After(now.Add(a.maxSkew)) {
+		return nil, errors.New("timestamp is out of window")
+	}
+
+	// body is read to be hashed and given back to handler
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	signature := r.Header.Get(HEADER_SIGNATURE)
+	expected := SignRequest(key.Secret, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	if !a.remember(signature, signed.Add(a.maxSkew), now) {
+		return nil, errors.New("request is replayed")
+	}
+
+	return &Principal{Name: key.ID, Role: key.Role, Buckets: key.Buckets}, nil
+}
+
+// remember returns false if signature is seen already, signatures
+// expired are forgotten
+func (a *hmacAuthenticator) remember(signature string, expiry time.Time, now time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for s, e := range a.seen {
+		if e.Before(now) {
+			delete(a.seen, s)
+		}
+	}
+	if _, ok := a.seen[signature]; ok {
+		return false
+	}
+	a.seen[signature] = expiry
+
+	return true
+}
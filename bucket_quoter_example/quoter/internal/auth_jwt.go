@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWT bearer tokens are verified by public keys of local JWKS file, role
+// and buckets of tenant are taken from claims
+
+type jwtAuthenticator struct {
+	keys         *jwtKeys
+	parser       *jwt.Parser
+	roleClaim    string
+	bucketsClaim string
+}
+
+func newJWTAuthenticator(settings *JWTSettings) (*jwtAuthenticator, error) {
+	keys, err := loadJWKS(settings.JWKS)
+	if err != nil {
+		return nil, fmt.Errorf("auth jwks '%s': %w", settings.JWKS, err)
+	}
+
+	a := &jwtAuthenticator{
+		keys:         keys,
+		parser:       newJWTParser(settings.Issuer, settings.Audience),
+		roleClaim:    settings.RoleClaim,
+		bucketsClaim: settings.BucketsClaim,
+	}
+	if a.roleClaim == "" {
+		a.roleClaim = "role"
+	}
+	if a.bucketsClaim == "" {
+		a.bucketsClaim = "buckets"
+	}
+
+	return a, nil
+}
+
+func newJWTParser(issuer string, audience string) *jwt.Parser {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"}),
+		jwt.WithExpirationRequired(),
+	}
+	if issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+	return jwt.NewParser(opts...)
+}
+
+// isJWT tells JWT from opaque bearer token
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok || !isJWT(token) {
+		return nil, nil
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.keys.keyFunc); err != nil {
+		return nil, err
+	}
+
+	role, _ := claims[a.roleClaim].(string)
+	if err := checkRole(role); err != nil {
+		return nil, err
+	}
+	subject, _ := claims.GetSubject()
+
+	return &Principal{Name: subject, Role: role, Buckets: confStrings(claims[a.bucketsClaim])}, nil
+}
+
+// jwtKeys are verification keys by key id, key of token without "kid"
+// is the only one of the set
+type jwtKeys struct {
+	keys map[string]interface{}
+}
+
+func (k *jwtKeys) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok && kid == "" && len(k.keys) == 1 {
+		for _, key = range k.keys {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key '%s'", kid)
+	}
+
+	// key type has to match algorithm, e.g. RSA public key is not HMAC secret
+	switch key.(type) {
+	case []byte:
+		_, ok = token.Method.(*jwt.SigningMethodHMAC)
+	case *rsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	}
+	if !ok {
+		return nil, fmt.Errorf("algorithm '%s' does not match key '%s'", token.Method.Alg(), kid)
+	}
+
+	return key, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKS reads RSA and EC P-256 public keys of JWKS file, keys of other
+// use than signature are skipped
+func loadJWKS(path string) (*jwtKeys, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+
+	keys := &jwtKeys{keys: make(map[string]interface{})}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+		keys.keys[k.Kid] = key
+	}
+	if len(keys.keys) == 0 {
+		return nil, errors.New("no signature keys")
+	}
+
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64URLInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64URLInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := base64URLInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64URLInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+func base64URLInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
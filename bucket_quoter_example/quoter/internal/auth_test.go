@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuthRoles(t *testing.T) {
+	conf := &ConfYaml{
+		Auth: AuthSection{Tokens: []TokenSettings{
+			{Name: "ops", Token: "admin-token", Role: ROLE_ADMIN},
+			{Name: "dashboard", Token: "read-token", Role: ROLE_READ_ONLY},
+			{Name: "tenant-a", Token: "tenant-token", Role: ROLE_TENANT, Buckets: []string{"a"}},
+		}},
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{
+			"a": {Inflow: 1, Capacity: 5},
+			"b": {Inflow: 1, Capacity: 5},
+		}},
+	}
+	_, r := testApiConf(t, conf)
+
+	cases := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{"GET", "/admin/buckets", "", 401},
+		{"GET", "/admin/buckets", "unknown", 401},
+		{"GET", "/v1/limiters/a", "", 401},
+		{"POST", "/admin/buckets/c", "admin-token", 201},
+		{"GET", "/admin/buckets/b", "read-token", 200},
+		{"POST", "/admin/buckets/b/refill", "read-token", 403},
+		{"GET", "/v1/limiters/b", "read-token", 200},
+		{"GET", "/admin/buckets/a", "tenant-token", 200},
+		{"GET", "/admin/buckets/b", "tenant-token", 403},
+		{"POST", "/admin/buckets/a/refill", "tenant-token", 403},
+		{"GET", "/v1/limiters/a", "tenant-token", 200},
+		{"GET", "/v1/limiters/b", "tenant-token", 403},
+	}
+	for _, c := range cases {
+		body := ""
+		if c.method == "POST" {
+			body = `{"inflow": 1, "capacity": 1}`
+		}
+		if w := adminRequest(r, c.method, c.path, body, c.token); w.Code != c.code {
+			t.Fatalf("%s %s with '%s': expected %d, got %d %s", c.method, c.path, c.token, c.code, w.Code, w.Body.String())
+		}
+	}
+
+	// tenant lists its own buckets only
+	var list AdminBucketsResponse
+	if err := json.Unmarshal(adminRequest(r, "GET", "/admin/buckets", "", "tenant-token").Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Buckets) != 1 || list.Buckets[0].State.Key != "a" {
+		t.Fatalf("unexpected list %+v", list)
+	}
+
+	// decisions are not authenticated
+	if w := v1Request(r, "/v1/consume", `{"key":"b"}`); w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestAuthHMAC(t *testing.T) {
+	conf := &ConfYaml{
+		Auth: AuthSection{HMAC: HMACSettings{Keys: []HMACKeySettings{
+			{ID: "billing", Secret: "shared", Role: ROLE_ADMIN},
+		}}},
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 5}}},
+	}
+	_, r := testApiConf(t, conf)
+
+	signed := func(method string, path string, body string, timestamp int64, signBody string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HEADER_KEY_ID, "billing")
+		req.Header.Set(HEADER_TIMESTAMP, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(HEADER_SIGNATURE, SignRequest("shared", method, path, timestamp, []byte(signBody)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	now := time.Now().Unix()
+	body := `{"inflow": 2, "capacity": 2}`
+	if w := signed("PATCH", "/admin/buckets/a", body, now, body); w.Code != 200 {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	// the same request again
+	if w := signed("PATCH", "/admin/buckets/a", body, now, body); w.Code != 401 {
+		t.Fatalf("expected replay to be rejected, got %d", w.Code)
+	}
+	if w := signed("PATCH", "/admin/buckets/a", body, now-3600, body); w.Code != 401 {
+		t.Fatalf("expected old request to be rejected, got %d", w.Code)
+	}
+	if w := signed("PATCH", "/admin/buckets/a", `{"inflow": 100, "capacity": 100}`, now+1, body); w.Code != 401 {
+		t.Fatalf("expected changed body to be rejected, got %d", w.Code)
+	}
+}
+
+func TestAuthJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := map[string]interface{}{"keys": []map[string]string{{
+		"kty": "EC", "kid": "k1", "use": "sig", "crv": "P-256",
+		"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}}
+	content, _ := json.Marshal(jwks)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &ConfYaml{
+		Auth:    AuthSection{JWT: JWTSettings{JWKS: path, Issuer: "https://issuer.example.org"}},
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 5}, "b": {Inflow: 1, Capacity: 5}}},
+	}
+	_, r := testApiConf(t, conf)
+
+	sign := func(claims jwt.MapClaims, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = kid
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	claims := func(exp time.Duration) jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "tenant-a", "iss": "https://issuer.example.org", "exp": time.Now().Add(exp).Unix(),
+			"role": ROLE_TENANT, "buckets": []string{"a"},
+		}
+	}
+
+	valid := sign(claims(time.Minute), "k1")
+	if w := adminRequest(r, "GET", "/v1/limiters/a", "", valid); w.Code != 200 {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if w := adminRequest(r, "GET", "/v1/limiters/b", "", valid); w.Code != 403 {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+
+	other := claims(time.Minute)
+	other["iss"] = "https://other.example.org"
+	for name, token := range map[string]string{
+		"expired":     sign(claims(-time.Minute), "k1"),
+		"unknown key": sign(claims(time.Minute), "k2"),
+		"issuer":      sign(other, "k1"),
+		"tampered":    valid[:len(valid)-4] + "AAAA",
+	} {
+		if w := adminRequest(r, "GET", "/v1/limiters/a", "", token); w.Code != 401 {
+			t.Fatalf("%s: expected 401, got %d", name, w.Code)
+		}
+	}
+}
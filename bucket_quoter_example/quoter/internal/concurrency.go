@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Concurrency limit caps requests in flight of subscription. Decision
+// allowed takes lease, caller releases it once request is done by
+// "/v1/release". Lease not released expires after lease timeout, so
+// crashed caller does not hold its slot forever.
+
+// milliseconds, used if "concurrency.leaseTimeout" is not set
+const defaultLeaseTimeout = 60000
+
+type concurrencyLimiter struct {
+	mutex   sync.Mutex
+	limit   int
+	timeout time.Duration
+	// expiry time by lease id
+	leases map[string]time.Time
+}
+
+func newConcurrencyLimiter(settings *ConcurrencySettings) *concurrencyLimiter {
+	l := &concurrencyLimiter{leases: make(map[string]time.Time)}
+	l.Reconfigure(settings)
+	return l
+}
+
+// Reconfigure changes limits keeping leases taken
+func (l *concurrencyLimiter) Reconfigure(settings *ConcurrencySettings) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.limit = settings.Limit
+	l.timeout = defaultLeaseTimeout * time.Millisecond
+	if settings.LeaseTimeout > 0 {
+		l.timeout = time.Duration(settings.LeaseTimeout) * time.Millisecond
+	}
+}
+
+// Acquire returns id of lease taken, false if limit is reached
+func (l *concurrencyLimiter) Acquire() (string, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.expireNoLock(now)
+	if len(l.leases) >= l.limit {
+		return "", false
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+	l.leases[id] = now.Add(l.timeout)
+
+	return id, true
+}
+
+// Release returns false if lease is unknown or expired
+func (l *concurrencyLimiter) Release(id string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.expireNoLock(time.Now())
+	if _, ok := l.leases[id]; !ok {
+		return false
+	}
+	delete(l.leases, id)
+
+	return true
+}
+
+// Available reports whether lease could be taken now
+func (l *concurrencyLimiter) Available() bool {
+	return l.InFlight() < l.Limit()
+}
+
+func (l *concurrencyLimiter) InFlight() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.expireNoLock(time.Now())
+	return len(l.leases)
+}
+
+func (l *concurrencyLimiter) Limit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.limit
+}
+
+func (l *concurrencyLimiter) expireNoLock(now time.Time) {
+	for id, expiry := range l.leases {
+		if expiry.Before(now) {
+			delete(l.leases, id)
+		}
+	}
+}
@@ -2,35 +2,275 @@ package internal
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 type CmdGlobal struct {
-	Cmd  *cobra.Command
+	Cmd *cobra.Command
+	// configuration of start, it is not changed while server runs,
+	// configuration reloaded is Api.conf
 	Opts *ConfYaml
 	Log  *TLog
 }
 
 type ConfYaml struct {
+	// configuration file loaded, empty if default configuration is used
+	File string
+
 	LogOptions *TLogOptions
 	Overrides  *ConfigOverrides
 
 	RateLimiter RateLimiterSection `yaml:"rateLimiter"`
 
+	DecisionLog DecisionLogSection `yaml:"decisionLog"`
+
+	Admin AdminSection `yaml:"admin"`
+
+	Auth AuthSection `yaml:"auth"`
+
+	Keys KeysSection `yaml:"keys"`
+
+	Templates TemplatesSection `yaml:"templates"`
+
+	// named limits buckets and templates refer to, see plans.go
+	Plans map[string]*BucketSettings `yaml:"plans"`
+
+	// limits of requests matching attributes, see rules.go
+	Rules []RuleSettings `yaml:"rules"`
+
 	Buckets BucketsSection `yaml:"buckets"`
 }
 
 type RateLimiterSection struct {
+	Listeners []ListenerSettings `yaml:"listeners"`
+
+	// deprecated, TLS listener on port is used if listeners are not set
 	Socket   string `yaml:"socket"`
 	Port     int    `yaml:"port"`
 	Certfile string `yaml:"certfile"`
 	Keyfile  string `yaml:"keyfile"`
-	PidFile  string `yaml:"pidFile"`
+
+	PidFile string `yaml:"pidFile"`
+	// period quotas usage persisted between restarts
+	StateFile string `yaml:"stateFile"`
+	// milliseconds to drain requests in flight on stop
+	ShutdownTimeout int `yaml:"shutdownTimeout"`
+	// addresses or CIDRs of proxies client address is taken from
+	// X-Forwarded-For of, none by default
+	TrustedProxies []string `yaml:"trustedProxies"`
+}
+
+const (
+	LISTENER_TCP  = "tcp"
+	LISTENER_TLS  = "tls"
+	LISTENER_UNIX = "unix"
+)
+
+// ListenerSettings is address API is served on, all listeners run at
+// the same time
+type ListenerSettings struct {
+	// "tcp", "tls" or "unix"
+	Type string `yaml:"type"`
+	// "host:port" or socket path
+	Address  string `yaml:"address"`
+	Certfile string `yaml:"certfile"`
+	Keyfile  string `yaml:"keyfile"`
+	// tls: client certificates signed by CA bundle are required if set
+	ClientCA string `yaml:"clientCA"`
+	// tls: bucket key is taken from client certificate, "cn", "san"
+	// or "spiffe", see identity.go
+	Identity string `yaml:"identity"`
+	// unix socket permissions, e.g. 0660, 0666 if not set
+	Mode os.FileMode `yaml:"mode"`
+}
+
+// listeners returns listeners configured, TLS listener on port is
+// returned for configuration without listeners
+func (r *RateLimiterSection) listeners() []ListenerSettings {
+	if len(r.Listeners) > 0 || r.Port <= 0 {
+		return r.Listeners
+	}
+	return []ListenerSettings{{
+		Type:     LISTENER_TLS,
+		Address:  fmt.Sprintf(":%d", r.Port),
+		Certfile: r.Certfile,
+		Keyfile:  r.Keyfile,
+	}}
+}
+
+// Validate checks listeners API is served on, at least one is required
+func (r *RateLimiterSection) Validate() error {
+	listeners := r.listeners()
+	if len(listeners) == 0 {
+		return errors.New("no listeners configured, 'rateLimiter.listeners' or 'rateLimiter.port' is required")
+	}
+	for i, l := range listeners {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listener %d: %w", i, err)
+		}
+	}
+	for _, proxy := range r.TrustedProxies {
+		if _, err := parseNetwork(proxy); err != nil {
+			return fmt.Errorf("trusted proxy: %w", err)
+		}
+	}
+	return nil
+}
+
+func (l *ListenerSettings) validate() error {
+	switch l.Type {
+	case LISTENER_TCP, LISTENER_UNIX:
+		if l.ClientCA != "" || l.Identity != "" {
+			return errors.New("clientCA and identity require tls listener")
+		}
+	case LISTENER_TLS:
+		if l.Certfile == "" || l.Keyfile == "" {
+			return errors.New("certfile and keyfile are required")
+		}
+	default:
+		return fmt.Errorf("unknown listener type '%s'", l.Type)
+	}
+	if l.Address == "" {
+		return fmt.Errorf("address of '%s' listener is required", l.Type)
+	}
+	return nil
+}
+
+// DecisionLogSection enables decision log if path is set
+type DecisionLogSection struct {
+	Path string `yaml:"path"`
+	// megabytes, 0 disables rotation
+	MaxSize  int `yaml:"maxSize"`
+	MaxFiles int `yaml:"maxFiles"`
+}
+
+// AdminSection enables admin API if token is set
+type AdminSection struct {
+	// expected as "Authorization: Bearer <token>"
+	Token string `yaml:"token"`
+}
+
+// AuthSection configures authentication of admin and introspection
+// endpoints, see auth.go
+type AuthSection struct {
+	Tokens []TokenSettings `yaml:"tokens"`
+	HMAC   HMACSettings    `yaml:"hmac"`
+	JWT    JWTSettings     `yaml:"jwt"`
+}
+
+// TokenSettings is static bearer token
+type TokenSettings struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	// "admin", "read-only" or "tenant"
+	Role string `yaml:"role"`
+	// buckets of tenant
+	Buckets []string `yaml:"buckets"`
+}
+
+type HMACSettings struct {
+	// seconds, requests signed earlier or later are rejected
+	MaxSkew int               `yaml:"maxSkew"`
+	Keys    []HMACKeySettings `yaml:"keys"`
+}
+
+type HMACKeySettings struct {
+	ID      string   `yaml:"id"`
+	Secret  string   `yaml:"secret"`
+	Role    string   `yaml:"role"`
+	Buckets []string `yaml:"buckets"`
+}
+
+// JWTSettings enables JWT bearer tokens if JWKS file is set
+type JWTSettings struct {
+	JWKS     string `yaml:"jwks"`
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// claims of role and of buckets of tenant (string or list), "role"
+	// and "buckets" if not set
+	RoleClaim    string `yaml:"roleClaim"`
+	BucketsClaim string `yaml:"bucketsClaim"`
+}
+
+// KeysSection selects where bucket key of decision requests is taken
+// from, see resolve.go
+type KeysSection struct {
+	// "header" (key sent by caller) or "jwt" (claim of bearer token)
+	Source string         `yaml:"source"`
+	JWT    KeyJWTSettings `yaml:"jwt"`
+}
+
+type KeyJWTSettings struct {
+	// claim of bucket key, "sub" if not set
+	Claim    string           `yaml:"claim"`
+	Issuer   string           `yaml:"issuer"`
+	Audience string           `yaml:"audience"`
+	Keys     []JWTKeySettings `yaml:"keys"`
+}
+
+// JWTKeySettings is verification key of local file: secret of HS256, PEM
+// public key or certificate of RS256 and ES256
+type JWTKeySettings struct {
+	Kid  string `yaml:"kid"`
+	Alg  string `yaml:"alg"`
+	File string `yaml:"file"`
+}
+
+// TemplatesSection creates buckets of keys not configured, see templates.go
+type TemplatesSection struct {
+	// bucket of unknown keys, they are rejected with 403 if not set
+	Default *BucketSettings `yaml:"default"`
+	// bucket per client address of requests without key, they are
+	// rejected with 401 if not set
+	Anonymous *BucketSettings `yaml:"anonymous"`
+	// keys created of templates, 10000 if not set
+	MaxKeys int `yaml:"maxKeys"`
+}
+
+// RuleSettings limits requests matching it by buckets of descriptor
+type RuleSettings struct {
+	Name string `yaml:"name"`
+	// rules of higher priority are checked first, rules of the same
+	// priority in order of configuration
+	Priority int               `yaml:"priority"`
+	Match    RuleMatchSettings `yaml:"match"`
+	// bucket key of request, e.g. "${key}/${method}", of ${key}, ${method},
+	// ${path}, ${ip}, ${header:<name>} and ${query:<name>}
+	Descriptor string `yaml:"descriptor"`
+	// limits of every bucket of rule, plan could be referred
+	Limits *BucketSettings `yaml:"limits"`
+	// buckets of rule, the least recently used are dropped beyond it,
+	// 10000 if not set
+	MaxKeys int `yaml:"maxKeys"`
+}
+
+// RuleMatchSettings are request attributes rule applies to, all of set
+// ones have to match
+type RuleMatchSettings struct {
+	Methods    []string `yaml:"methods"`
+	PathPrefix string   `yaml:"pathPrefix"`
+	// addresses or CIDR networks
+	ClientIPs []string         `yaml:"clientIPs"`
+	Headers   []AttributeMatch `yaml:"headers"`
+	Query     []AttributeMatch `yaml:"query"`
+}
+
+// AttributeMatch matches header or query parameter, any value if value is
+// empty
+type AttributeMatch struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
 }
 
 type BucketsSection struct {
@@ -38,8 +278,68 @@ type BucketsSection struct {
 }
 
 type BucketSettings struct {
-	Inflow   int `yaml:"inflow"`
-	Capacity int `yaml:"capacity"`
+	// plan of limits, values set below override values of plan
+	Plan string `yaml:"plan" json:"plan,omitempty"`
+
+	Inflow   int `yaml:"inflow" json:"inflow"`
+	Capacity int `yaml:"capacity" json:"capacity"`
+
+	Adaptive *AdaptiveSettings `yaml:"adaptive" json:"adaptive,omitempty"`
+	Schedule *ScheduleSettings `yaml:"schedule" json:"schedule,omitempty"`
+	Quota    *QuotaSettings    `yaml:"quota" json:"quota,omitempty"`
+	Warmup   *WarmupSettings   `yaml:"warmup" json:"warmup,omitempty"`
+
+	Concurrency *ConcurrencySettings `yaml:"concurrency" json:"concurrency,omitempty"`
+}
+
+// AdaptiveSettings turns bucket into AIMD limiter driven by outcomes
+// reported by the clients
+type AdaptiveSettings struct {
+	MinInflow      int     `yaml:"minInflow" json:"minInflow"`
+	MaxInflow      int     `yaml:"maxInflow" json:"maxInflow"`
+	IncreaseStep   int     `yaml:"increaseStep" json:"increaseStep"`
+	DecreaseFactor float64 `yaml:"decreaseFactor" json:"decreaseFactor"`
+	// milliseconds
+	LatencyThreshold int `yaml:"latencyThreshold" json:"latencyThreshold"`
+	Interval         int `yaml:"interval" json:"interval"`
+}
+
+// WarmupSettings ramps bucket inflow up from cold one after start or idle
+type WarmupSettings struct {
+	ColdInflow int `yaml:"coldInflow" json:"coldInflow"`
+	// milliseconds
+	Period      int `yaml:"period" json:"period"`
+	IdleTimeout int `yaml:"idleTimeout" json:"idleTimeout"`
+}
+
+// ConcurrencySettings caps requests in flight, see concurrency.go
+type ConcurrencySettings struct {
+	Limit int `yaml:"limit" json:"limit"`
+	// milliseconds lease is held unless released
+	LeaseTimeout int `yaml:"leaseTimeout" json:"leaseTimeout"`
+}
+
+// QuotaSettings is calendar period allowance checked together with bucket
+type QuotaSettings struct {
+	Limit int `yaml:"limit" json:"limit"`
+	// "daily", "weekly", "monthly" or "yearly"
+	Period   string `yaml:"period" json:"period"`
+	Timezone string `yaml:"timezone" json:"timezone"`
+}
+
+// ScheduleSettings overrides bucket limits within cron-like windows
+type ScheduleSettings struct {
+	Timezone string                   `yaml:"timezone" json:"timezone"`
+	Windows  []ScheduleWindowSettings `yaml:"windows" json:"windows,omitempty"`
+}
+
+type ScheduleWindowSettings struct {
+	Name string `yaml:"name" json:"name"`
+	// "minute hour day-of-month month day-of-week", window is
+	// active during every minute matched
+	Cron     string `yaml:"cron" json:"cron"`
+	Inflow   int    `yaml:"inflow" json:"inflow"`
+	Capacity int    `yaml:"capacity" json:"capacity"`
 }
 
 var defaultConf = []byte(`
@@ -54,17 +354,184 @@ log:
   level: "debug"
 
 rateLimiter:
-  socket: "/var/run/ratelimiter.socket"
-  port: 8443
-  certfile: "certs/dns-api.crt"
-  keyfile: "certs/dns-api.key"
+  # API is served on every listener: "tcp", "tls" or "unix"
+  listeners:
+    - type: "tls"
+      address: ":8443"
+      certfile: "certs/dns-api.crt"
+      keyfile: "certs/dns-api.key"
+      # mutual TLS: client certificates signed by CA are required,
+      # with "identity" ("cn", "san" or "spiffe") bucket key is taken
+      # from client certificate instead of request
+      #clientCA: "certs/clients-ca.crt"
+      #identity: "spiffe"
+    # e.g. local sidecars on unix socket
+    #- type: "unix"
+    #  address: "/var/run/ratelimiter.socket"
+    #  mode: "0660"
   # detach process mode: pidfile
   pidfile: "/var/run/ratelimiter.pid"
+  # period quotas usage: file
+  stateFile: "/var/run/ratelimiter.state"
+  # milliseconds to drain requests in flight on SIGTERM/SIGINT,
+  # requests left are cut off and process exits with status 2
+  shutdownTimeout: 30000
+  # client address (anonymous buckets, rules) is taken from
+  # X-Forwarded-For of these proxies only, address of connection otherwise
+  #trustedProxies: ["10.0.0.0/8"]
+
+# decision log (JSON lines) of every limiter decision, for
+# audit and replay with "quoter simulate --trace decisionlog"
+decisionLog:
+  path: ""
+  maxSize: 100
+  maxFiles: 5
+
+# admin API (/admin/buckets) changing buckets at runtime, disabled
+# if token is empty and "auth" is not configured, could be set by
+# RATELIMITER_ADMIN_TOKEN
+admin:
+  token: ""
+
+# authentication of admin and introspection ("/limiter/state",
+# "/v1/limiters") endpoints, roles are "admin", "read-only" and
+# "tenant" (reads its own buckets only), admin token above is
+# token of admin role
+auth:
+  tokens: []
+  #  - name: "dashboard"
+  #    token: "..."
+  #    role: "read-only"
+  #  - name: "tenant-a"
+  #    token: "..."
+  #    role: "tenant"
+  #    buckets: ["897d9f58-6b42-4ca7-8229-2e04056490b7"]
+  # requests signed with "X-Limiter-Key-Id", "X-Limiter-Timestamp"
+  # and "X-Limiter-Signature" headers, "maxSkew" seconds window
+  hmac:
+    maxSkew: 300
+    keys: []
+  #  - id: "billing"
+  #    secret: "..."
+  #    role: "admin"
+  # JWT bearer tokens verified by keys of local JWKS file
+  jwt:
+    jwks: ""
+    issuer: ""
+    audience: ""
+    roleClaim: "role"
+    bucketsClaim: "buckets"
+
+# bucket key of decision requests, "header" is key sent by caller
+# ("X-Limiter-Subscription-ID", "key" of /v1 requests), "jwt" is claim
+# of bearer token verified by keys below, callers without valid
+# token are rejected with 401 before any quota is spent
+keys:
+  source: "header"
+  jwt:
+    claim: "sub"
+    issuer: ""
+    audience: ""
+    keys: []
+  #  - kid: "k1"
+  #    alg: "RS256"
+  #    file: "/etc/ratelimiter/jwt-rs256.pem"
+  #  - kid: "k2"
+  #    alg: "HS256"
+  #    file: "/etc/ratelimiter/jwt-hs256.secret"
+
+# named limits referred by "plan" of buckets and templates, values
+# set on bucket override values of its plan, buckets follow changes
+# of their plan on reload
+plans:
+  #"pro":
+  #  "inflow": 100
+  #  "capacity": 200
+  #  "quota":
+  #    "limit": 1000000
+  #    "period": "monthly"
+  #  # requests in flight, decision allowed takes lease released by
+  #  # "/v1/release" or expired after "leaseTimeout" milliseconds
+  #  "concurrency":
+  #    "limit": 20
+  #    "leaseTimeout": 60000
+
+# limits of requests matching attributes (method, path prefix, client
+# address, headers, query parameters), every rule applying to request
+# has to pass, rules of higher priority are checked first and bucket
+# of subscription the last. Bucket of rule is created per descriptor
+# built of request attributes, up to "maxKeys" of rule. Requests
+# are described by "request" of /v1 decisions, /limiter takes them
+# of "X-Original-Method", "X-Original-URI" and its headers
+rules: []
+#  - name: "uploads"
+#    priority: 10
+#    match:
+#      methods: ["POST", "PUT"]
+#      pathPrefix: "/upload"
+#      clientIPs: ["10.0.0.0/8"]
+#      headers:
+#        - name: "X-Tenant"
+#          value: "acme"
+#    descriptor: "${key}/${method}"
+#    limits:
+#      "inflow": 1
+#      "capacity": 5
+#    maxKeys: 10000
+
+# buckets created on first use of keys not configured below, "default"
+# for unknown keys, "anonymous" per client address for requests without
+# key, up to "maxKeys" (the least recently used are dropped). Without
+# template unknown keys are rejected with 403, missing key with 401
+templates:
+  maxKeys: 10000
+  #default:
+  #  "inflow": 1
+  #  "capacity": 5
+  #anonymous:
+  #  "inflow": 1
+  #  "capacity": 1
 
 buckets:
   "897d9f58-6b42-4ca7-8229-2e04056490b7":
     "inflow": 10
     "capacity": 10
+    # optional plan (see "plans"), values set here override it
+    #"plan": "pro"
+    # optional AIMD mode, inflow is adjusted by outcomes
+    # reported on "/limiter/outcome"
+    #"adaptive":
+    #  "minInflow": 1
+    #  "maxInflow": 50
+    #  "increaseStep": 1
+    #  "decreaseFactor": 0.5
+    #  "latencyThreshold": 500
+    #  "interval": 1000
+    # optional warm-up, inflow ramps from "coldInflow" to
+    # "inflow" within "period" after start or "idleTimeout"
+    #"warmup":
+    #  "coldInflow": 2
+    #  "period": 30000
+    #  "idleTimeout": 60000
+    # optional calendar period allowance, reset on period
+    # boundary in timezone
+    #"quota":
+    #  "limit": 100000
+    #  "period": "monthly"
+    #  "timezone": "UTC"
+    # optional limits by time of day or day of week, first
+    # window matched wins, base limits are used outside of windows
+    #"schedule":
+    #  "timezone": "UTC"
+    #  "windows":
+    #    - "name": "off-peak"
+    #      "cron": "* 0-6,22-23 * * *"
+    #      "inflow": 30
+    #      "capacity": 30
+    #    - "name": "weekend"
+    #      "cron": "* * * * sat,sun"
+    #      "inflow": 30
+    #      "capacity": 30
 `)
 
 func LoadConf(confPath string, Overrides ConfigOverrides) (ConfYaml, error) {
@@ -89,6 +556,7 @@ func LoadConf(confPath string, Overrides ConfigOverrides) (ConfYaml, error) {
 			//fmt.Printf("using config file as: \"%s\"\n", viper.ConfigFileUsed())
 			return conf, err
 		}
+		conf.File = confPath
 	} else {
 		// Search config in home directory with name "hhs"
 		viper.AddConfigPath("/etc/ratelimiter")
@@ -99,6 +567,7 @@ func LoadConf(confPath string, Overrides ConfigOverrides) (ConfYaml, error) {
 		// If a config file is found, read it in.
 		if err := viper.ReadInConfig(); err == nil {
 			//fmt.Printf("using config file as: \"%s\"\n", viper.ConfigFileUsed())
+			conf.File = viper.ConfigFileUsed()
 		} else {
 			// load default config
 			if err := viper.ReadConfig(bytes.NewBuffer(defaultConf)); err != nil {
@@ -131,20 +600,114 @@ func LoadConf(confPath string, Overrides ConfigOverrides) (ConfYaml, error) {
 
 	// limiter settings
 
+	listeners, ok := viper.Get("rateLimiter.listeners").([]interface{})
+	if !ok && viper.Get("rateLimiter.listeners") != nil {
+		return conf, errors.New("rateLimiter.listeners: list of listeners expected")
+	}
+	for i, item := range listeners {
+		l, ok := item.(map[string]interface{})
+		if !ok || l == nil {
+			return conf, fmt.Errorf("listener %d: settings expected", i)
+		}
+		listener := ListenerSettings{
+			Type:     confString(l["type"]),
+			Address:  confString(l["address"]),
+			Certfile: confString(l["certfile"]),
+			Keyfile:  confString(l["keyfile"]),
+			ClientCA: confString(l["clientca"]),
+			Identity: confString(l["identity"]),
+		}
+		if listener.Mode, err = confMode(l["mode"]); err != nil {
+			return conf, fmt.Errorf("listener %d: %w", i, err)
+		}
+		conf.RateLimiter.Listeners = append(conf.RateLimiter.Listeners, listener)
+	}
 	conf.RateLimiter.Socket = viper.GetString("rateLimiter.socket")
 	conf.RateLimiter.Port = viper.GetInt("rateLimiter.port")
 	conf.RateLimiter.Certfile = viper.GetString("rateLimiter.certfile")
 	conf.RateLimiter.Keyfile = viper.GetString("rateLimiter.keyfile")
 	conf.RateLimiter.PidFile = viper.GetString("rateLimiter.pidFile")
+	conf.RateLimiter.StateFile = viper.GetString("rateLimiter.stateFile")
+	conf.RateLimiter.ShutdownTimeout = viper.GetInt("rateLimiter.shutdownTimeout")
+	conf.RateLimiter.TrustedProxies = confStrings(viper.Get("rateLimiter.trustedProxies"))
+
+	conf.DecisionLog.Path = viper.GetString("decisionLog.path")
+	conf.DecisionLog.MaxSize = viper.GetInt("decisionLog.maxSize")
+	conf.DecisionLog.MaxFiles = viper.GetInt("decisionLog.maxFiles")
+
+	conf.Admin.Token = viper.GetString("admin.token")
+
+	tokens, _ := viper.Get("auth.tokens").([]interface{})
+	for _, item := range tokens {
+		if t, ok := item.(map[string]interface{}); ok && t != nil {
+			conf.Auth.Tokens = append(conf.Auth.Tokens, TokenSettings{
+				Name:    confString(t["name"]),
+				Token:   confString(t["token"]),
+				Role:    confString(t["role"]),
+				Buckets: confStrings(t["buckets"]),
+			})
+		}
+	}
+	conf.Auth.HMAC.MaxSkew = viper.GetInt("auth.hmac.maxSkew")
+	keys, _ := viper.Get("auth.hmac.keys").([]interface{})
+	for _, item := range keys {
+		if k, ok := item.(map[string]interface{}); ok && k != nil {
+			conf.Auth.HMAC.Keys = append(conf.Auth.HMAC.Keys, HMACKeySettings{
+				ID:      confString(k["id"]),
+				Secret:  confString(k["secret"]),
+				Role:    confString(k["role"]),
+				Buckets: confStrings(k["buckets"]),
+			})
+		}
+	}
+	conf.Auth.JWT.JWKS = viper.GetString("auth.jwt.jwks")
+	conf.Auth.JWT.Issuer = viper.GetString("auth.jwt.issuer")
+	conf.Auth.JWT.Audience = viper.GetString("auth.jwt.audience")
+	conf.Auth.JWT.RoleClaim = viper.GetString("auth.jwt.roleClaim")
+	conf.Auth.JWT.BucketsClaim = viper.GetString("auth.jwt.bucketsClaim")
+
+	conf.Keys.Source = viper.GetString("keys.source")
+	conf.Keys.JWT.Claim = viper.GetString("keys.jwt.claim")
+	conf.Keys.JWT.Issuer = viper.GetString("keys.jwt.issuer")
+	conf.Keys.JWT.Audience = viper.GetString("keys.jwt.audience")
+	keyFiles, _ := viper.Get("keys.jwt.keys").([]interface{})
+	for _, item := range keyFiles {
+		if k, ok := item.(map[string]interface{}); ok && k != nil {
+			conf.Keys.JWT.Keys = append(conf.Keys.JWT.Keys, JWTKeySettings{
+				Kid:  confString(k["kid"]),
+				Alg:  confString(k["alg"]),
+				File: confString(k["file"]),
+			})
+		}
+	}
+
+	if b, ok := viper.Get("templates.default").(map[string]interface{}); ok && b != nil {
+		conf.Templates.Default = confBucket(b)
+	}
+	if b, ok := viper.Get("templates.anonymous").(map[string]interface{}); ok && b != nil {
+		conf.Templates.Anonymous = confBucket(b)
+	}
+	conf.Templates.MaxKeys = viper.GetInt("templates.maxKeys")
+
+	conf.Plans = make(map[string]*BucketSettings)
+	for name, item := range viper.GetStringMap("plans") {
+		if b, ok := item.(map[string]interface{}); ok && b != nil {
+			conf.Plans[name] = confBucket(b)
+		}
+	}
 
+	rules, _ := viper.Get("rules").([]interface{})
+	for _, item := range rules {
+		if r, ok := item.(map[string]interface{}); ok && r != nil {
+			conf.Rules = append(conf.Rules, confRule(r))
+		}
+	}
+
+	// note: viper lowercases keys of nested maps
 	var buckets = make(map[string]*BucketSettings)
 	for key, item := range viper.GetStringMap("buckets") {
-		b, ok := item.(map[string]interface{})
-		if ok && b != nil {
-			buckets[key] = &BucketSettings{
-				Inflow:   b["inflow"].(int),
-				Capacity: b["capacity"].(int),
-			}
+		if b, ok := item.(map[string]interface{}); ok && b != nil {
+			buckets[key] = confBucket(b)
 		}
 	}
 	conf.Buckets = BucketsSection{
@@ -153,3 +716,202 @@ func LoadConf(confPath string, Overrides ConfigOverrides) (ConfYaml, error) {
 
 	return conf, nil
 }
+
+func (a *AdaptiveSettings) Options() bucket_quoter.AdaptiveOptions {
+	return bucket_quoter.AdaptiveOptions{
+		MinInflow:        int64(a.MinInflow),
+		MaxInflow:        int64(a.MaxInflow),
+		IncreaseStep:     int64(a.IncreaseStep),
+		DecreaseFactor:   a.DecreaseFactor,
+		LatencyThreshold: time.Duration(a.LatencyThreshold) * time.Millisecond,
+		Interval:         time.Duration(a.Interval) * time.Millisecond,
+	}
+}
+
+func confBucket(b map[string]interface{}) *BucketSettings {
+	bucket := &BucketSettings{
+		// plan names are lowercased by viper too
+		Plan:     strings.ToLower(confString(b["plan"])),
+		Inflow:   confInt(b["inflow"]),
+		Capacity: confInt(b["capacity"]),
+	}
+	if a, ok := b["adaptive"].(map[string]interface{}); ok && a != nil {
+		bucket.Adaptive = &AdaptiveSettings{
+			MinInflow:        confInt(a["mininflow"]),
+			MaxInflow:        confInt(a["maxinflow"]),
+			IncreaseStep:     confInt(a["increasestep"]),
+			DecreaseFactor:   confFloat(a["decreasefactor"]),
+			LatencyThreshold: confInt(a["latencythreshold"]),
+			Interval:         confInt(a["interval"]),
+		}
+	}
+	if w, ok := b["warmup"].(map[string]interface{}); ok && w != nil {
+		bucket.Warmup = &WarmupSettings{
+			ColdInflow:  confInt(w["coldinflow"]),
+			Period:      confInt(w["period"]),
+			IdleTimeout: confInt(w["idletimeout"]),
+		}
+	}
+	if qt, ok := b["quota"].(map[string]interface{}); ok && qt != nil {
+		bucket.Quota = &QuotaSettings{
+			Limit:    confInt(qt["limit"]),
+			Period:   confString(qt["period"]),
+			Timezone: confString(qt["timezone"]),
+		}
+	}
+	if sc, ok := b["schedule"].(map[string]interface{}); ok && sc != nil {
+		bucket.Schedule = confSchedule(sc)
+	}
+	if cc, ok := b["concurrency"].(map[string]interface{}); ok && cc != nil {
+		bucket.Concurrency = &ConcurrencySettings{
+			Limit:        confInt(cc["limit"]),
+			LeaseTimeout: confInt(cc["leasetimeout"]),
+		}
+	}
+	return bucket
+}
+
+func confRule(r map[string]interface{}) RuleSettings {
+	rule := RuleSettings{
+		Name:       confString(r["name"]),
+		Priority:   confInt(r["priority"]),
+		Descriptor: confString(r["descriptor"]),
+		MaxKeys:    confInt(r["maxkeys"]),
+	}
+	if m, ok := r["match"].(map[string]interface{}); ok && m != nil {
+		rule.Match = RuleMatchSettings{
+			Methods:    confStrings(m["methods"]),
+			PathPrefix: confString(m["pathprefix"]),
+			ClientIPs:  confStrings(m["clientips"]),
+			Headers:    confAttributes(m["headers"]),
+			Query:      confAttributes(m["query"]),
+		}
+	}
+	if l, ok := r["limits"].(map[string]interface{}); ok && l != nil {
+		rule.Limits = confBucket(l)
+	}
+	return rule
+}
+
+// confAttributes converts list of name and value, names are given as
+// list items, so viper keeps their case
+func confAttributes(v interface{}) []AttributeMatch {
+	var attributes []AttributeMatch
+	items, _ := v.([]interface{})
+	for _, item := range items {
+		if a, ok := item.(map[string]interface{}); ok && a != nil {
+			// value could be given as yaml number
+			value := ""
+			if a["value"] != nil {
+				value = fmt.Sprint(a["value"])
+			}
+			attributes = append(attributes, AttributeMatch{Name: confString(a["name"]), Value: value})
+		}
+	}
+	return attributes
+}
+
+func confSchedule(sc map[string]interface{}) *ScheduleSettings {
+	var schedule ScheduleSettings
+	schedule.Timezone = confString(sc["timezone"])
+
+	windows, _ := sc["windows"].([]interface{})
+	for _, item := range windows {
+		w, ok := item.(map[string]interface{})
+		if !ok || w == nil {
+			continue
+		}
+		var window ScheduleWindowSettings
+		window.Name = confString(w["name"])
+		window.Cron = confString(w["cron"])
+		window.Inflow = confInt(w["inflow"])
+		window.Capacity = confInt(w["capacity"])
+		schedule.Windows = append(schedule.Windows, window)
+	}
+
+	return &schedule
+}
+
+func (w *WarmupSettings) Options() bucket_quoter.WarmupOptions {
+	return bucket_quoter.WarmupOptions{
+		ColdInflow:  int64(w.ColdInflow),
+		Period:      time.Duration(w.Period) * time.Millisecond,
+		IdleTimeout: time.Duration(w.IdleTimeout) * time.Millisecond,
+	}
+}
+
+// NewQuota creates period quota by settings
+func (q *QuotaSettings) NewQuota() (*bucket_quoter.PeriodQuota, error) {
+	period, err := bucket_quoter.ParsePeriod(q.Period)
+	if err != nil {
+		return nil, err
+	}
+	location, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit <= 0 {
+		return nil, errors.New("quota limit must be positive")
+	}
+
+	return bucket_quoter.NewPeriodQuota(int64(q.Limit), period, location), nil
+}
+
+// confInt, confFloat and confString convert loosely typed yaml values, missing
+// values are returned as zero
+func confInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// confMode converts file permissions, given as octal string ("0660") or
+// yaml octal number
+func confMode(v interface{}) (os.FileMode, error) {
+	if s, ok := v.(string); ok {
+		mode, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid mode '%s'", s)
+		}
+		return os.FileMode(mode), nil
+	}
+	return os.FileMode(confInt(v)), nil
+}
+
+// confStrings converts list of strings, a single string is list of one
+func confStrings(v interface{}) []string {
+	if s, ok := v.(string); ok {
+		return []string{s}
+	}
+	var out []string
+	items, _ := v.([]interface{})
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func confString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func confFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	}
+	return 0
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfAdaptive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimiter.yaml")
+	conf := `
+buckets:
+  "a":
+    "inflow": 10
+    "capacity": 10
+    "adaptive":
+      "minInflow": 1
+      "maxInflow": 50
+      "increaseStep": 2
+      "decreaseFactor": 0.5
+      "latencyThreshold": 500
+      "interval": 1000
+`
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadConf(path, ConfigOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := c.Buckets.Buckets["a"].Adaptive
+	if a == nil {
+		t.Fatalf("expected adaptive settings")
+	}
+	if a.MinInflow != 1 || a.MaxInflow != 50 || a.IncreaseStep != 2 || a.DecreaseFactor != 0.5 ||
+		a.LatencyThreshold != 500 || a.Interval != 1000 {
+		t.Fatalf("unexpected adaptive settings %+v", a)
+	}
+}
@@ -1,14 +1,16 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
-	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -19,6 +21,9 @@ type Core struct {
 	httpapi *Api
 }
 
+// waited by "server stop" above shutdown timeout of the process
+const stopGracePeriod = 5 * time.Second
+
 type CoreOverrides struct {
 	Detach bool `json:"detach"`
 }
@@ -125,13 +130,13 @@ func (c *Core) StopCore(Overrides *CoreOverrides) error {
 		var p *os.Process
 
 		if run, pid, p, err = c.IfProcessRun(); err != nil {
-			c.g.Log.Error(fmt.Sprintf("%s error detecting run process, pid:'%d', err:'%s'", pid, err))
+			c.g.Log.Error(fmt.Sprintf("error detecting run process, pid:'%d', err:'%s'", pid, err))
 			return err
 		}
 
 		if !run {
 			err = errors.New("no running process detected")
-			c.g.Log.Error(fmt.Sprintf("%s no detecting run process, pid:'%d', err:'%s'", pid, err))
+			c.g.Log.Error(fmt.Sprintf("no detecting run process, pid:'%d', err:'%s'", pid, err))
 			return err
 		}
 
@@ -139,6 +144,17 @@ func (c *Core) StopCore(Overrides *CoreOverrides) error {
 			c.g.Log.Error(fmt.Sprintf("error signalling pid:'%d', err:'%s'", pid, err))
 			return err
 		}
+
+		// process drains requests in flight before exit
+		deadline := time.Now().Add(c.g.Opts.RateLimiter.shutdownTimeout() + stopGracePeriod)
+		for p.Signal(syscall.SIGCONT) == nil {
+			if time.Now().After(deadline) {
+				err = errors.New("process not stopped")
+				c.g.Log.Error(fmt.Sprintf("error stopping pid:'%d', err:'%s'", pid, err))
+				return err
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
 	}
 
 	return nil
@@ -170,20 +186,60 @@ func (c *Core) StartCore(Overrides *CoreOverrides) error {
 
 	c.g.Log.Debug(fmt.Sprintf("starting core, overrides:'%s'", Overrides.AsString()))
 
-	var waitGroup sync.WaitGroup
-	count := 1
-	waitGroup.Add(count)
-
-	api, _ := CreateApi(c.g)
+	api, err := CreateApi(c.g)
+	if err != nil {
+		c.g.Log.Error(fmt.Sprintf("error creating api, err:'%s'", err))
+		return err
+	}
 	api.core = c
 	c.httpapi = api
 
-	// API methods: unix socket and https
-	// (for remote calls)
-	//go api.Apiloop(&waitGroup, API_UNIXSOCKET)
-	go api.Apiloop(&waitGroup, API_HTTPS)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
 
-	waitGroup.Wait()
+	served := make(chan error, 1)
+	go api.scheduler.Run(api.stop)
+	go api.stateLoop(api.stop)
+	go api.reloadLoop(api.stop)
+	go func() { served <- api.RunListeners() }()
 
-	return nil
+	select {
+	case s := <-signals:
+		c.g.Log.Info(fmt.Sprintf("(shutdown) signal:'%s' received, draining requests", s))
+	case err = <-served:
+	}
+
+	return c.shutdown(api, err)
+}
+
+// shutdown drains api within configured timeout, ErrDrainTimeout is
+// returned if requests are cut off
+func (c *Core) shutdown(api *Api, serveErr error) error {
+	timeout := c.g.Opts.RateLimiter.shutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := api.Shutdown(ctx)
+	c.removePidFile()
+
+	if err != nil {
+		c.g.Log.Error(fmt.Sprintf("(shutdown) requests in flight cut off after:'%s'", timeout))
+		return err
+	}
+	c.g.Log.Info("(shutdown) server stopped")
+
+	return serveErr
+}
+
+// removePidFile removes pidfile written by this process
+func (c *Core) removePidFile() {
+	pidfile := c.g.Opts.RateLimiter.PidFile
+	content, err := os.ReadFile(pidfile)
+	if err != nil || string(content) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err = os.Remove(pidfile); err != nil {
+		c.g.Log.Error(fmt.Sprintf("error removing pidfile '%s', err:'%s'", pidfile, err))
+	}
 }
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter/simulator"
+)
+
+// Decision log is JSON lines file, one record per limiter decision, to
+// audit and to replay production traffic through simulator
+
+const (
+	DECISION_ALLOWED = "allowed"
+	DECISION_DENIED  = "denied"
+)
+
+// DecisionRecord is final decision of request, one per request
+type DecisionRecord struct {
+	Time     time.Time `json:"ts"`
+	Key      string    `json:"key"`
+	Cost     int64     `json:"cost"`
+	Decision string    `json:"decision"`
+	// error code of request denied, rule denying it if any
+	Reason string `json:"reason,omitempty"`
+	Rule   string `json:"rule,omitempty"`
+	// subscription bucket tokens before and after decision, zero if
+	// request is denied before bucket is charged
+	Before int64 `json:"before"`
+	After  int64 `json:"after"`
+}
+
+type DecisionLog struct {
+	mutex sync.Mutex
+
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+// NewDecisionLog opens log for append, file is rotated when it grows above
+// maxSize bytes, up to maxFiles rotated files ("path.1" is the newest)
+// are kept
+func NewDecisionLog(path string, maxSize int64, maxFiles int) (*DecisionLog, error) {
+	l := &DecisionLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *DecisionLog) Write(r *DecisionRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return errors.New("decision log is closed")
+	}
+	if l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize && l.size > 0 {
+		if err = l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+
+	return err
+}
+
+func (l *DecisionLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+// Reopen opens file again, e.g. after it is moved away by logrotate
+func (l *DecisionLog) Reopen() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	return l.open()
+}
+
+func (l *DecisionLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+
+	return nil
+}
+
+func (l *DecisionLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	if l.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+		for i := l.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+// DecisionLogFiles returns files of log at path, rotated ones ("path.1",
+// "path.2", ...) first from the oldest one, so records are in order of time
+func DecisionLogFiles(path string) []string {
+	files := []string{path}
+	for i := 1; ; i++ {
+		rotated := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(rotated); err != nil {
+			break
+		}
+		files = append([]string{rotated}, files...)
+	}
+	return files
+}
+
+type DecisionLogReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewDecisionLogReader(r io.Reader) *DecisionLogReader {
+	return &DecisionLogReader{scanner: bufio.NewScanner(r)}
+}
+
+// Next returns next record, io.EOF at the end of log
+func (r *DecisionLogReader) Next() (*DecisionRecord, error) {
+	for r.scanner.Scan() {
+		r.line += 1
+		if len(r.scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record DecisionRecord
+		if err := json.Unmarshal(r.scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("decision log line %d: %w", r.line, err)
+		}
+		return &record, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+type decisionTrace struct {
+	reader *DecisionLogReader
+	key    string
+	start  *time.Time
+	last   time.Duration
+	err    error
+}
+
+// DecisionTrace replays requests of the key recorded (all keys if empty)
+// as simulator trace, the first record is trace start
+func DecisionTrace(r io.Reader, key string) simulator.Trace {
+	return &decisionTrace{reader: NewDecisionLogReader(r), key: key}
+}
+
+func (t *decisionTrace) Next() (simulator.Arrival, bool) {
+	for t.err == nil {
+		record, err := t.reader.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.err = err
+			}
+			break
+		}
+		if t.key != "" && record.Key != t.key {
+			continue
+		}
+
+		if t.start == nil {
+			t.start = &record.Time
+		}
+		// records of concurrent requests may be slightly out of order
+		at := record.Time.Sub(*t.start)
+		if at < t.last {
+			at = t.last
+		}
+		t.last = at
+		return simulator.Arrival{At: at, Cost: record.Cost}, true
+	}
+
+	return simulator.Arrival{}, false
+}
+
+func (t *decisionTrace) Err() error {
+	return t.err
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecisionLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	l, err := NewDecisionLog(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		err := l.Write(&DecisionRecord{
+			Time:     start.Add(time.Duration(i) * time.Second),
+			Key:      []string{"a", "b"}[i%2],
+			Cost:     int64(i + 1),
+			Decision: DECISION_ALLOWED,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ~110 bytes per record, two records per file, two rotated kept
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only two rotated files, err:'%v'", err)
+	}
+
+	f, err := os.Open(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	trace := DecisionTrace(f, "b")
+	a, ok := trace.Next()
+	if !ok || a.At != 0 || a.Cost != 8 {
+		t.Fatalf("unexpected arrival %+v", a)
+	}
+	if _, ok := trace.Next(); ok || trace.Err() != nil {
+		t.Fatalf("expected end of trace, err:'%v'", trace.Err())
+	}
+
+	// rotated files are replayed from the oldest one
+	files := DecisionLogFiles(path)
+	if len(files) != 3 || files[0] != path+".2" || files[2] != path {
+		t.Fatalf("unexpected files %v", files)
+	}
+	var readers []io.Reader
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	trace = DecisionTrace(io.MultiReader(readers...), "b")
+	for _, cost := range []int64{6, 8, 10} {
+		if a, ok := trace.Next(); !ok || a.Cost != cost {
+			t.Fatalf("expected arrival of cost %d, got %+v", cost, a)
+		}
+	}
+	if _, ok := trace.Next(); ok || trace.Err() != nil {
+		t.Fatalf("expected end of trace, err:'%v'", trace.Err())
+	}
+}
+
+func TestDecisionLogDecisions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	conf := &ConfYaml{
+		DecisionLog: DecisionLogSection{Path: path},
+		Buckets:     BucketsSection{Buckets: map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 10}}},
+		Rules: []RuleSettings{
+			{
+				Name: "writes", Descriptor: "${key}",
+				Match:  RuleMatchSettings{Methods: []string{"POST"}},
+				Limits: &BucketSettings{Inflow: 1, Capacity: 10},
+			},
+		},
+	}
+	api, r := testApiConf(t, conf)
+	sub, _ := api.subscription("a")
+	sub.limiter.SetTokens(10)
+
+	for _, body := range []string{
+		`{"key":"a","request":{"method":"POST"}}`,
+		`{"key":"a","request":{"method":"POST"}}`,
+		`{"key":"b"}`,
+		`{"key":"a","cost":11}`,
+	} {
+		v1Request(r, "/v1/consume", body)
+	}
+	// dry run is not a decision
+	v1Request(r, "/v1/check", `{"key":"a"}`)
+	api.decisionLog.Load().Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader := NewDecisionLogReader(f)
+	for i, expected := range []DecisionRecord{
+		{Key: "a", Cost: 1, Decision: DECISION_ALLOWED, Before: 10, After: 9},
+		{Key: "a", Cost: 1, Decision: DECISION_DENIED, Reason: ERROR_RATE_LIMITED, Rule: "writes"},
+		{Key: "b", Cost: 1, Decision: DECISION_DENIED, Reason: ERROR_UNKNOWN_KEY},
+		{Key: "a", Cost: 11, Decision: DECISION_DENIED, Reason: ERROR_COST_EXCEEDS_CAPACITY},
+	} {
+		record, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		record.Time = time.Time{}
+		if *record != expected {
+			t.Fatalf("unexpected record %d %+v", i, record)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("expected one record per decision, err:'%v'", err)
+	}
+}
@@ -1,6 +1,14 @@
 package internal
 
 import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+	"github.com/alexgaas/bucket_quoter/httplimit"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -21,19 +29,325 @@ func (a *Api) isAPIAvailableWithLimiter(c *gin.Context) {
 		return
 	}
 
-	if limiter, ok := a.limiterMap[c.Request.Header.Get("X-Limiter-Subscription-ID")]; ok {
-		if !limiter.IsAvailable() {
-			// TODO - send metrics
-			a.apiSendError(c, 429, "Too Many Requests")
+	key, keyErr := a.requestKey(c, c.Request.Header.Get("X-Limiter-Subscription-ID"))
+	if keyErr != nil {
+		a.apiSendError(c, keyErr.Status, keyErr.Message)
+		return
+	}
+
+	cost, err := requestCost(c)
+	if err != nil {
+		a.apiSendError(c, 400, err.Error())
+		return
+	}
 
-			return
+	// callers of /limiter do not release leases, concurrency limit is
+	// checked without taking one
+	var r Response
+	d := a.decide(key, limiterAttributes(c), cost, false, false)
+	if d.limiter != nil {
+		r.RateLimit = rateLimitInfo(c, d.limiter, d.err != nil)
+	}
+	if d.quota != nil {
+		r.Quota = quotaInfo(c, d.quota)
+	}
+	if d.err != nil {
+		if d.err.Code == ERROR_QUOTA_EXCEEDED {
+			// bucket does not help, retry once quota is reset
+			r.RateLimit.retryAfter(c, time.Until(r.Quota.Reset))
 		}
-		limiter.UseWithSleep(1)
 		// TODO - send metrics
+		a.apiSendErrorResponse(c, d.err.Status, d.err.Message, r)
+		return
+	}
+	// TODO - send metrics
+
+	a.apiSendOKResponse(c, 200, "", r)
+}
+
+// limiterDecision is outcome of charging subscription, err is set if
+// request is denied or invalid
+type limiterDecision struct {
+	limiter *bucket_quoter.BucketQuoter
+	quota   *bucket_quoter.PeriodQuota
+	// lease of request in flight, empty if concurrency is not limited
+	lease       string
+	concurrency *concurrencyLimiter
+	// rule denying request, empty if it is denied by subscription
+	rule string
+	// bucket tokens of decision, nil unless bucket is charged
+	result *bucket_quoter.Result
+	// template bucket would be created of, set by dry run of key not added
+	template string
+	err      *ApiError
+}
+
+// bucketAvailable reports whether bucket is not in debt, unlike IsAvailable
+// underflow is not counted
+func bucketAvailable(limiter *bucket_quoter.BucketQuoter) bool {
+	var r bucket_quoter.Result
+	limiter.GetAvailableWithResult(&r)
+	return r.After >= 0
+}
+
+// consume charges concurrency limit, quota and bucket of subscription,
+// with dryRun it only checks whether request would pass, no bucket is
+// created or changed. Without takeLease concurrency limit is checked, but
+// lease is not taken.
+func (a *Api) consume(key string, cost int64, dryRun bool, takeLease bool) *limiterDecision {
+	var d limiterDecision
+
+	var sub *subscription
+	var subErr *ApiError
+	if dryRun {
+		sub, d.template, subErr = a.peekSubscription(key)
 	} else {
-		a.apiSendError(c, 503, "Service Unavailable")
+		sub, subErr = a.decisionSubscription(key)
+	}
+	if subErr != nil {
+		d.err = subErr
+		return &d
+	}
+	limiter := sub.limiter
+	d.limiter = limiter
+
+	if cost > limiter.BucketTokensCapacity.Load() {
+		// would never fit, retrying does not help
+		d.err = apiError(400, ERROR_COST_EXCEEDS_CAPACITY, fmt.Sprintf("Cost %d exceeds bucket capacity %d",
+			cost, limiter.BucketTokensCapacity.Load()))
+		return &d
+	}
+
+	quota := sub.quota
+	if quota != nil {
+		d.quota = quota
+		if cost > quota.Limit {
+			d.err = apiError(400, ERROR_COST_EXCEEDS_QUOTA, fmt.Sprintf("Cost %d exceeds quota limit %d", cost, quota.Limit))
+			return &d
+		}
+	}
+
+	concurrency := sub.concurrency
+	if concurrency != nil && (dryRun || !takeLease) && !concurrency.Available() {
+		d.err = apiError(429, ERROR_CONCURRENCY_LIMITED, "Too Many Requests In Flight")
+		return &d
+	}
+	if dryRun {
+		if quota != nil && quota.Remaining() < cost {
+			d.err = apiError(429, ERROR_QUOTA_EXCEEDED, "Quota Exceeded")
+		} else if !bucketAvailable(limiter) {
+			d.err = apiError(429, ERROR_RATE_LIMITED, "Too Many Requests")
+		}
+		return &d
+	}
+
+	if concurrency != nil && takeLease {
+		lease, ok := concurrency.Acquire()
+		if !ok {
+			d.err = apiError(429, ERROR_CONCURRENCY_LIMITED, "Too Many Requests In Flight")
+			return &d
+		}
+		d.lease = lease
+		d.concurrency = concurrency
+	}
+	// lease is given back if request is denied
+	release := func() {
+		if d.lease != "" {
+			concurrency.Release(d.lease)
+			d.lease = ""
+		}
+	}
+
+	if quota != nil && !quota.TryUse(cost) {
+		release()
+		d.err = apiError(429, ERROR_QUOTA_EXCEEDED, "Quota Exceeded")
+		return &d
+	}
+
+	// weighted request passes while bucket is not in debt, like a single
+	// token, and takes its whole cost, so it may put bucket into debt
+	var result bucket_quoter.Result
+	allowed := limiter.TryUseWithResult(cost, &result)
+	d.result = &result
+	if !allowed {
+		if quota != nil {
+			// request is not passed, does not count against quota
+			quota.Refund(cost)
+		}
+		release()
+		d.err = apiError(429, ERROR_RATE_LIMITED, "Too Many Requests")
+	}
+
+	return &d
+}
+
+// quotaInfo returns quota state and sets quota headers
+func quotaInfo(c *gin.Context, quota *bucket_quoter.PeriodQuota) *QuotaInfo {
+	info := newQuotaInfo(quota)
+
+	c.Header("X-Limiter-Quota-Limit", strconv.FormatInt(info.Limit, 10))
+	c.Header("X-Limiter-Quota-Remaining", strconv.FormatInt(info.Remaining, 10))
+	c.Header("X-Limiter-Quota-Reset", info.Reset.Format(time.RFC3339))
+
+	return info
+}
+
+func newQuotaInfo(quota *bucket_quoter.PeriodQuota) *QuotaInfo {
+	return &QuotaInfo{
+		Limit:     quota.Limit,
+		Remaining: quota.Remaining(),
+		Reset:     quota.ResetTime().UTC(),
+	}
+}
+
+// rateLimitInfo returns bucket state and sets "RateLimit-*" headers, with
+// "Retry-After" if request is denied and bucket is not available
+func rateLimitInfo(c *gin.Context, limiter *bucket_quoter.BucketQuoter, denied bool) *RateLimitInfo {
+	return bucketInfo(c.Writer.Header(), limiter, denied)
+}
+
+// bucketInfo returns bucket state and sets its headers to h
+func bucketInfo(h http.Header, limiter *bucket_quoter.BucketQuoter, denied bool) *RateLimitInfo {
+	s := httplimit.BucketState(limiter)
+	httplimit.SetHeaders(h, s, denied)
+
+	return &RateLimitInfo{
+		Limit:        s.Limit,
+		Remaining:    s.Remaining,
+		Reset:        httplimit.Seconds(s.Reset),
+		Policy:       h.Get(httplimit.HeaderPolicy),
+		RetryAfter:   httplimit.Seconds(s.RetryAfter),
+		RetryAfterMs: s.RetryAfter.Milliseconds(),
+	}
+}
+
+// retryAfter overrides "Retry-After" with longer delay
+func (i *RateLimitInfo) retryAfter(c *gin.Context, d time.Duration) {
+	if d.Milliseconds() <= i.RetryAfterMs {
+		return
+	}
+	i.RetryAfter = httplimit.Seconds(d)
+	i.RetryAfterMs = d.Milliseconds()
+	c.Header(httplimit.HeaderRetryAfter, strconv.FormatInt(i.RetryAfter, 10))
+}
+
+// requestCost returns tokens to charge for request, supplied either as
+// "X-Limiter-Cost" header or "cost" query parameter, default is 1
+func requestCost(c *gin.Context) (int64, error) {
+	value := c.Request.Header.Get("X-Limiter-Cost")
+	if value == "" {
+		value = c.Query("cost")
+	}
+	if value == "" {
+		return 1, nil
+	}
+
+	cost, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || cost <= 0 {
+		return 0, fmt.Errorf("Invalid cost '%s', positive integer expected", value)
+	}
+
+	return cost, nil
+}
+
+// OutcomeRequest is reported by clients after calling backend
+// protected by an adaptive bucket
+type OutcomeRequest struct {
+	Success bool `json:"success"`
+	// milliseconds
+	Latency int64 `json:"latency"`
+}
+
+// api limiter outcome (AIMD feedback)
+func (a *Api) reportLimiterOutcome(c *gin.Context) {
+	if a.core == nil {
+		a.apiSendError(c, 502, "Internal error")
+		return
+	}
+
+	key, keyErr := a.requestKey(c, c.Request.Header.Get("X-Limiter-Subscription-ID"))
+	if keyErr != nil {
+		a.apiSendError(c, keyErr.Status, keyErr.Message)
+		return
+	}
+	sub, subErr := a.decisionSubscription(key)
+	if subErr != nil {
+		a.apiSendError(c, subErr.Status, subErr.Message)
+		return
+	}
+
+	adaptive := sub.adaptive
+	if adaptive == nil {
+		a.apiSendError(c, 409, "Adaptive limiting is not enabled for subscription")
 		return
 	}
 
+	var outcome OutcomeRequest
+	if err := c.ShouldBindJSON(&outcome); err != nil || outcome.Latency < 0 {
+		a.apiSendError(c, 400, "Bad Request")
+		return
+	}
+
+	adaptive.Report(bucket_quoter.Outcome{
+		Success: outcome.Success,
+		Latency: time.Duration(outcome.Latency) * time.Millisecond,
+	})
+
 	a.apiSendOK(c, 200, "")
 }
+
+// BucketState is a snapshot of bucket limits and tokens
+type BucketState struct {
+	Key       string `json:"key"`
+	Inflow    int64  `json:"inflow"`
+	Capacity  int64  `json:"capacity"`
+	Available int64  `json:"available"`
+	// schedule window applied now, empty if bucket has no schedule
+	Window string `json:"window,omitempty"`
+}
+
+type BucketStateResponse struct {
+	Response
+	State *BucketState `json:"state,omitempty"`
+}
+
+// api limiter state
+func (a *Api) getLimiterState(c *gin.Context) {
+	if a.core == nil {
+		a.apiSendError(c, 502, "Internal error")
+		return
+	}
+
+	key, keyErr := subscriptionKey(c, c.Request.Header.Get("X-Limiter-Subscription-ID"))
+	if keyErr != nil {
+		a.apiSendError(c, keyErr.Status, keyErr.Message)
+		return
+	}
+	if authErr := authorizeRead(c, key); authErr != nil {
+		a.apiSendError(c, authErr.Status, authErr.Message)
+		return
+	}
+	sub, ok := a.subscription(key)
+	if !ok {
+		a.apiSendError(c, 404, fmt.Sprintf("Unknown subscription '%s'", key))
+		return
+	}
+
+	var r BucketStateResponse
+	r.Success = true
+	r.RateLimit = rateLimitInfo(c, sub.limiter, false)
+	state := a.bucketState(key, sub.limiter)
+	r.State = &state
+
+	a.apiSendJSON(c, 200, r)
+}
+
+func (a *Api) bucketState(key string, limiter *bucket_quoter.BucketQuoter) BucketState {
+	return BucketState{
+		Key:       key,
+		Inflow:    limiter.InflowTokensPerSecond.Load(),
+		Capacity:  limiter.BucketTokensCapacity.Load(),
+		Available: limiter.GetAvailable(),
+		Window:    a.scheduler.ActiveWindow(key),
+	}
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// testApi creates api over buckets given, without running server
+func testApi(t *testing.T, buckets map[string]*BucketSettings) (*Api, *gin.Engine) {
+	return testApiConf(t, &ConfYaml{Buckets: BucketsSection{Buckets: buckets}})
+}
+
+func testApiConf(t *testing.T, conf *ConfYaml) (*Api, *gin.Engine) {
+	log := logrus.New()
+	log.Out = io.Discard
+
+	g := &CmdGlobal{Opts: conf, Log: &TLog{Log: log}}
+	api, err := CreateApi(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.core = &Core{g: g, httpapi: api}
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.SetTrustedProxies(conf.RateLimiter.TrustedProxies)
+	r.GET("/limiter", api.isAPIAvailableWithLimiter)
+	r.GET("/limiter/state", api.authenticate, api.getLimiterState)
+	api.registerV1(r)
+	api.registerAdmin(r)
+
+	return api, r
+}
+
+func testRequest(r *gin.Engine, method string, path string, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if key != "" {
+		req.Header.Set("X-Limiter-Subscription-ID", key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestLimiterRateLimitHeaders(t *testing.T) {
+	_, r := testApi(t, map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 2}})
+
+	// bucket starts empty, the first request makes debt, request allowed
+	// is not told to retry
+	w := testRequest(r, "GET", "/limiter", "a")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "0" ||
+		w.Header().Get("RateLimit-Policy") != "2;w=2" || w.Header().Get("Retry-After") != "" {
+		t.Fatalf("unexpected headers %v", w.Header())
+	}
+
+	w = testRequest(r, "GET", "/limiter", "a")
+	if w.Code != 429 {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+
+	var response Response
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	info := response.RateLimit
+	if info == nil || info.Limit != 2 || info.Remaining != 0 || info.RetryAfter != 1 ||
+		info.RetryAfterMs <= 0 || info.RetryAfterMs > 1000 || info.Policy != "2;w=2" {
+		t.Fatalf("unexpected rate limit %+v", info)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected Retry-After, got %v", w.Header())
+	}
+
+	// unknown subscription has no bucket to report
+	if w := testRequest(r, "GET", "/limiter", "b"); w.Code != 403 || w.Header().Get("RateLimit-Limit") != "" {
+		t.Fatalf("expected 403 without headers, got %d %v", w.Code, w.Header())
+	}
+
+	if w := testRequest(r, "GET", "/limiter/state", "a"); w.Header().Get("RateLimit-Limit") != "2" ||
+		w.Header().Get("Retry-After") != "" {
+		t.Fatalf("expected headers on state without Retry-After, got %v", w.Header())
+	}
+}
+
+func TestLimiterQuotaRetryAfter(t *testing.T) {
+	_, r := testApi(t, map[string]*BucketSettings{"a": {
+		Inflow: 10, Capacity: 10, Quota: &QuotaSettings{Limit: 1, Period: "daily", Timezone: "UTC"},
+	}})
+
+	testRequest(r, "GET", "/limiter", "a")
+	w := testRequest(r, "GET", "/limiter", "a")
+	if w.Code != 429 {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+
+	// retry once quota is reset, not once bucket is available
+	var response Response
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	info := response.RateLimit
+	if info == nil || info.RetryAfter < 1 || info.RetryAfter > 86400 ||
+		w.Header().Get("Retry-After") != strconv.FormatInt(info.RetryAfter, 10) {
+		t.Fatalf("unexpected rate limit %+v, headers %v", info, w.Header())
+	}
+}
+
+func TestLimiterCost(t *testing.T) {
+	api, r := testApi(t, map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 10}})
+	sub, _ := api.subscription("a")
+	sub.limiter.SetTokens(10)
+
+	req := httptest.NewRequest("GET", "/limiter", nil)
+	req.Header.Set("X-Limiter-Subscription-ID", "a")
+	req.Header.Set("X-Limiter-Cost", "4")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 || sub.limiter.GetAvailable() != 6 {
+		t.Fatalf("expected 4 tokens to be taken, got %d, available %d", w.Code, sub.limiter.GetAvailable())
+	}
+
+	if w := testRequest(r, "GET", "/limiter?cost=5", "a"); w.Code != 200 || sub.limiter.GetAvailable() != 1 {
+		t.Fatalf("expected 5 tokens to be taken, got %d, available %d", w.Code, sub.limiter.GetAvailable())
+	}
+
+	// the whole cost is taken while bucket is not in debt
+	if w := testRequest(r, "GET", "/limiter?cost=3", "a"); w.Code != 200 || sub.limiter.GetAvailable() != 0 {
+		t.Fatalf("expected request to pass into debt, got %d", w.Code)
+	}
+	if w := testRequest(r, "GET", "/limiter?cost=1", "a"); w.Code != 429 {
+		t.Fatalf("expected 429 in debt, got %d", w.Code)
+	}
+
+	for _, path := range []string{"/limiter?cost=0", "/limiter?cost=-1", "/limiter?cost=x", "/limiter?cost=11"} {
+		if w := testRequest(r, "GET", path, "a"); w.Code != 400 {
+			t.Fatalf("%s: expected 400, got %d", path, w.Code)
+		}
+	}
+}
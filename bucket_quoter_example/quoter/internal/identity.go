@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Mutual TLS: listener with "clientCA" requires client certificate signed
+// by the CA, with "identity" set bucket key is taken from the certificate,
+// so a client can only spend its own quota
+
+const (
+	IDENTITY_CN     = "cn"
+	IDENTITY_SAN    = "san"
+	IDENTITY_SPIFFE = "spiffe"
+)
+
+const ERROR_FORBIDDEN = "forbidden"
+
+type identityContextKey struct{}
+
+// tlsConfig returns TLS configuration of listener, nil if client
+// certificates are not verified
+func (s *ListenerSettings) tlsConfig() (*tls.Config, error) {
+	switch s.Identity {
+	case "", IDENTITY_CN, IDENTITY_SAN, IDENTITY_SPIFFE:
+	default:
+		return nil, fmt.Errorf("unknown identity '%s'", s.Identity)
+	}
+	if s.ClientCA == "" {
+		if s.Identity != "" {
+			return nil, fmt.Errorf("identity '%s' requires clientCA", s.Identity)
+		}
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(s.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificates in clientCA '%s'", s.ClientCA)
+	}
+
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}, nil
+}
+
+// certIdentity returns identity of client certificate, empty if
+// certificate has none. Identity is lower case, like keys of buckets
+// configured (configuration keys are not case sensitive).
+func certIdentity(cert *x509.Certificate, identity string) string {
+	switch identity {
+	case IDENTITY_CN:
+		return strings.ToLower(cert.Subject.CommonName)
+	case IDENTITY_SAN:
+		if len(cert.DNSNames) > 0 {
+			return strings.ToLower(cert.DNSNames[0])
+		}
+		if len(cert.EmailAddresses) > 0 {
+			return strings.ToLower(cert.EmailAddresses[0])
+		}
+	case IDENTITY_SPIFFE:
+		for _, uri := range cert.URIs {
+			if uri.Scheme == "spiffe" {
+				return strings.ToLower(uri.String())
+			}
+		}
+	}
+	return ""
+}
+
+// withIdentity passes identity of verified client certificate to handler
+// in request context
+func withIdentity(identity string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var key string
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			key = certIdentity(r.TLS.VerifiedChains[0][0], identity)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, key)))
+	})
+}
+
+// subscriptionKey returns key request is charged to: identity of client
+// certificate on listeners taking keys from it, key requested otherwise.
+// Key requested is optional then, but has to match identity.
+func subscriptionKey(c *gin.Context, requested string) (string, *ApiError) {
+	identity, ok := c.Request.Context().Value(identityContextKey{}).(string)
+	if !ok {
+		return requested, nil
+	}
+	if identity == "" {
+		return "", apiError(401, ERROR_UNAUTHORIZED, "Client certificate has no identity")
+	}
+	if requested != "" && !strings.EqualFold(requested, identity) {
+		return "", apiError(403, ERROR_FORBIDDEN, fmt.Sprintf("Key '%s' does not match client certificate", requested))
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert issues certificate by template, self-signed if parent is nil
+func testCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writePEM(t *testing.T, path string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	var b bytes.Buffer
+	if cert != nil {
+		pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	if key != nil {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pem.Encode(&b, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/tenant-a")
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "tenant-a"},
+		DNSNames: []string{"tenant-a.example.org"},
+		URIs:     []*url.URL{{Scheme: "https", Host: "example.org"}, spiffe},
+	}
+
+	for identity, expected := range map[string]string{
+		IDENTITY_CN:     "tenant-a",
+		IDENTITY_SAN:    "tenant-a.example.org",
+		IDENTITY_SPIFFE: "spiffe://example.org/tenant-a",
+	} {
+		if key := certIdentity(cert, identity); key != expected {
+			t.Fatalf("expected '%s' by %s, got '%s'", expected, identity, key)
+		}
+	}
+	if key := certIdentity(&x509.Certificate{}, IDENTITY_SPIFFE); key != "" {
+		t.Fatalf("expected no identity, got '%s'", key)
+	}
+
+	// keys of configuration are lower case
+	mixed, _ := url.Parse("spiffe://Example.org/Billing")
+	cert = &x509.Certificate{Subject: pkix.Name{CommonName: "Billing"}, URIs: []*url.URL{mixed}}
+	if key := certIdentity(cert, IDENTITY_CN); key != "billing" {
+		t.Fatalf("expected lower case identity, got '%s'", key)
+	}
+	if key := certIdentity(cert, IDENTITY_SPIFFE); key != "spiffe://example.org/billing" {
+		t.Fatalf("expected lower case identity, got '%s'", key)
+	}
+}
+
+func TestMutualTLSIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "clients"}, IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	writePEM(t, filepath.Join(dir, "ca.crt"), ca, nil)
+
+	server, serverKey := testCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "quoter"}, IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writePEM(t, filepath.Join(dir, "server.crt"), server, nil)
+	writePEM(t, filepath.Join(dir, "server.key"), nil, serverKey)
+
+	spiffe, _ := url.Parse("spiffe://Example.org/Tenant-A")
+	client, clientKey := testCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "tenant-a"}, URIs: []*url.URL{spiffe},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	api, _ := testApiConf(t, &ConfYaml{
+		RateLimiter: RateLimiterSection{Listeners: []ListenerSettings{{
+			Type: LISTENER_TLS, Address: address,
+			Certfile: filepath.Join(dir, "server.crt"), Keyfile: filepath.Join(dir, "server.key"),
+			ClientCA: filepath.Join(dir, "ca.crt"), Identity: IDENTITY_SPIFFE,
+		}}},
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{
+			"spiffe://example.org/tenant-a": {Inflow: 1, Capacity: 10},
+			"spiffe://example.org/tenant-b": {Inflow: 1, Capacity: 10},
+		}},
+	})
+	go api.RunListeners()
+	t.Cleanup(func() { api.Shutdown(context.Background()) })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+	authenticated := newClient(tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey})
+
+	consume := func(c *http.Client, key string) (int, error) {
+		resp, err := c.Post("https://"+address+"/v1/consume", "application/json",
+			bytes.NewBufferString(`{"key": "`+key+`"}`))
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// key is taken from certificate
+	var code int
+	for i := 0; i < 50; i++ {
+		if code, err = consume(authenticated, ""); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || code != 200 {
+		t.Fatalf("expected 200, got %d %v", code, err)
+	}
+	if code, err := consume(authenticated, "spiffe://Example.org/Tenant-A"); err != nil || code != 429 {
+		t.Fatalf("expected own bucket to be charged, got %d %v", code, err)
+	}
+
+	// quota of other client could not be spent
+	if code, err := consume(authenticated, "spiffe://example.org/tenant-b"); err != nil || code != 403 {
+		t.Fatalf("expected 403, got %d %v", code, err)
+	}
+
+	// client certificate is required
+	if _, err := consume(newClient(), ""); err == nil {
+		t.Fatalf("expected request without client certificate to fail")
+	}
+}
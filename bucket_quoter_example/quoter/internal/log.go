@@ -3,6 +3,7 @@ package internal
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log/syslog"
 	"os"
 	"strings"
@@ -92,6 +93,15 @@ func (log *TLog) Error(str string) {
 	}
 }
 
+// ErrorFields logs error with structured fields
+func (log *TLog) ErrorFields(fields logrus.Fields, str string) {
+	if log.LogType == LOGTYPE_STDOUT || log.LogType == LOGTYPE_FILE {
+		if log.Log != nil {
+			log.Log.WithFields(fields).Error(str)
+		}
+	}
+}
+
 func (log *TLog) SetLogLevel(level string) error {
 	if log.Log == nil {
 		return errors.New("log not initialized")
@@ -132,6 +142,43 @@ func (log *TLog) SetLogOut(out string) error {
 	return nil
 }
 
+// Reopen switches log to options of reloaded configuration, log file is
+// opened again, so file moved away by logrotate is created again. Options
+// are checked before anything is changed.
+func (log *TLog) Reopen(opts *TLogOptions) error {
+	if log.Log == nil {
+		return errors.New("log not initialized")
+	}
+	level, err := logrus.ParseLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer
+	var file *os.File
+	switch opts.Log {
+	case "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		if file, err = os.OpenFile(opts.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+		out = file
+	}
+
+	log.Log.SetLevel(level)
+	log.Log.SetOutput(out)
+	if log.File != nil {
+		log.File.Close()
+	}
+	log.File = file
+	log.LogOptions = opts
+
+	return nil
+}
+
 type LogrotateOptions struct {
 	// if we need move file to old
 	// named file or not, if not
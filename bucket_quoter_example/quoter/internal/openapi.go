@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenAPI 3 document of /v1 routes, schemas are built by reflection of
+// request and response types, so the document follows the code
+
+const openAPIVersion = "3.0.3"
+
+type openAPI struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       map[string]string               `json:"info"`
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components map[string]map[string]*schema   `json:"components"`
+}
+
+type operation struct {
+	Summary     string              `json:"summary"`
+	Parameters  []parameter         `json:"parameters,omitempty"`
+	RequestBody *content            `json:"requestBody,omitempty"`
+	Responses   map[string]*content `json:"responses"`
+}
+
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *schema `json:"schema"`
+}
+
+type content struct {
+	Description string                        `json:"description,omitempty"`
+	Required    bool                          `json:"required,omitempty"`
+	Content     map[string]map[string]*schema `json:"content,omitempty"`
+}
+
+type schema struct {
+	Ref        string             `json:"$ref,omitempty"`
+	Type       string             `json:"type,omitempty"`
+	Format     string             `json:"format,omitempty"`
+	Properties map[string]*schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	Items      *schema            `json:"items,omitempty"`
+	Nullable   bool               `json:"nullable,omitempty"`
+}
+
+func openAPISpec(routes []v1Route) *openAPI {
+	spec := &openAPI{
+		OpenAPI:    openAPIVersion,
+		Info:       map[string]string{"title": "quoter", "version": "v1"},
+		Paths:      make(map[string]map[string]operation),
+		Components: map[string]map[string]*schema{"schemas": {}},
+	}
+	schemas := spec.Components["schemas"]
+
+	for _, route := range routes {
+		var op operation
+		op.Summary = route.summary
+
+		// gin ":param" is OpenAPI "{param}"
+		segments := strings.Split(route.path, "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ":") {
+				name := segment[1:]
+				segments[i] = "{" + name + "}"
+				op.Parameters = append(op.Parameters, parameter{
+					Name: name, In: "path", Required: true, Schema: &schema{Type: "string"},
+				})
+			}
+		}
+		path := strings.Join(segments, "/")
+
+		if route.request != nil {
+			op.RequestBody = jsonContent("", schemaOf(route.request, schemas))
+			op.RequestBody.Required = true
+		}
+
+		op.Responses = make(map[string]*content)
+		for status, t := range route.responses {
+			description, ok := route.descriptions[status]
+			if !ok {
+				description = http.StatusText(status)
+			}
+			op.Responses[strconv.Itoa(status)] = jsonContent(description, schemaOf(t, schemas))
+		}
+
+		if spec.Paths[path] == nil {
+			spec.Paths[path] = make(map[string]operation)
+		}
+		spec.Paths[path][strings.ToLower(route.method)] = op
+	}
+
+	return spec
+}
+
+func jsonContent(description string, s *schema) *content {
+	return &content{
+		Description: description,
+		Content:     map[string]map[string]*schema{"application/json": {"schema": s}},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf returns schema of type, structs are put into components and
+// referenced
+func schemaOf(t reflect.Type, schemas map[string]*schema) *schema {
+	if t == timeType {
+		return &schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := schemaOf(t.Elem(), schemas)
+		if s.Ref != "" {
+			return s
+		}
+		s.Nullable = true
+		return s
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int, reflect.Int32:
+		return &schema{Type: "integer", Format: "int32"}
+	case reflect.Int64:
+		return &schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &schema{Type: "number"}
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &schema{Type: "array", Items: schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return &schema{Type: "object"}
+	case reflect.Struct:
+		ref := &schema{Ref: "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; ok {
+			return ref
+		}
+
+		s := &schema{Type: "object", Properties: make(map[string]*schema)}
+		// placeholder first, type may refer to itself
+		schemas[t.Name()] = s
+		structFields(t, s, schemas)
+		return ref
+	}
+
+	return &schema{}
+}
+
+func structFields(t reflect.Type, s *schema, schemas map[string]*schema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			// embedded fields are fields of the struct in JSON
+			structFields(f.Type, s, schemas)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		s.Properties[name] = schemaOf(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Plans are named limits (rate bucket, period quota, concurrency, ...)
+// buckets and templates refer to by "plan". Values set on bucket override
+// values of its plan, sections (quota, concurrency, ...) are merged value
+// by value, lists (schedule windows) are replaced. Buckets follow changes
+// of their plan on reload, tokens and quota usage are kept.
+
+// resolvePlan returns settings of plan overridden by settings, settings
+// not referring to plan are returned as they are
+func resolvePlan(plans map[string]*BucketSettings, settings *BucketSettings) (*BucketSettings, error) {
+	if settings.Plan == "" {
+		return settings, nil
+	}
+	plan, ok := plans[settings.Plan]
+	if !ok {
+		return nil, fmt.Errorf("unknown plan '%s'", settings.Plan)
+	}
+
+	var resolved BucketSettings
+	mergeSettings(reflect.ValueOf(&resolved).Elem(), reflect.ValueOf(plan).Elem())
+	mergeSettings(reflect.ValueOf(&resolved).Elem(), reflect.ValueOf(settings).Elem())
+
+	return &resolved, nil
+}
+
+// mergeSettings sets values of src which are not zero to dst, sections
+// are copied, so dst shares nothing with src
+func mergeSettings(dst reflect.Value, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		s, d := src.Field(i), dst.Field(i)
+		switch {
+		case s.Kind() == reflect.Pointer && s.Type().Elem().Kind() == reflect.Struct:
+			if s.IsNil() {
+				continue
+			}
+			if d.IsNil() {
+				d.Set(reflect.New(s.Type().Elem()))
+			}
+			mergeSettings(d.Elem(), s.Elem())
+		case s.Kind() == reflect.Slice:
+			if s.Len() > 0 {
+				d.Set(reflect.AppendSlice(reflect.MakeSlice(s.Type(), 0, s.Len()), s))
+			}
+		default:
+			if !s.IsZero() {
+				d.Set(s)
+			}
+		}
+	}
+}
+
+// checkPlans returns error if plan refers to another plan
+func (c *ConfYaml) checkPlans() error {
+	for name, plan := range c.Plans {
+		if plan.Plan != "" {
+			return fmt.Errorf("plan '%s': plan could not refer to plan", name)
+		}
+	}
+	return nil
+}
+
+// resolvedBuckets returns settings of configured buckets with their plans
+// applied
+func (c *ConfYaml) resolvedBuckets() (map[string]*BucketSettings, error) {
+	if err := c.checkPlans(); err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[string]*BucketSettings, len(c.Buckets.Buckets))
+	for key, settings := range c.Buckets.Buckets {
+		resolved, err := resolvePlan(c.Plans, settings)
+		if err != nil {
+			return nil, fmt.Errorf("bucket '%s': %w", key, err)
+		}
+		buckets[key] = resolved
+	}
+	return buckets, nil
+}
+
+// Bucket returns settings of configured bucket with its plan applied, nil
+// if key is not configured
+func (c *ConfYaml) Bucket(key string) (*BucketSettings, error) {
+	settings, ok := c.Buckets.Buckets[key]
+	if !ok {
+		return nil, nil
+	}
+	if err := c.checkPlans(); err != nil {
+		return nil, err
+	}
+	return resolvePlan(c.Plans, settings)
+}
+
+// resolvedTemplates returns templates with their plans applied
+func (c *ConfYaml) resolvedTemplates() (*TemplatesSection, error) {
+	templates := c.Templates
+	for _, t := range []**BucketSettings{&templates.Default, &templates.Anonymous} {
+		if *t == nil {
+			continue
+		}
+		resolved, err := resolvePlan(c.Plans, *t)
+		if err != nil {
+			return nil, fmt.Errorf("template: %w", err)
+		}
+		*t = resolved
+	}
+	if err := templates.validate(); err != nil {
+		return nil, err
+	}
+	return &templates, nil
+}
+
+// resolvePlan applies plan of current configuration to settings
+func (a *Api) resolvePlan(settings *BucketSettings) (*BucketSettings, error) {
+	a.plansMutex.RLock()
+	defer a.plansMutex.RUnlock()
+
+	return resolvePlan(a.plans, settings)
+}
+
+// applyPlans updates buckets created by admin API on plans changed,
+// buckets of configuration and templates are updated by their sections
+func (a *Api) applyPlans(plans map[string]*BucketSettings) {
+	a.plansMutex.Lock()
+	a.plans = plans
+	a.plansMutex.Unlock()
+
+	a.limiterMutex.Lock()
+	defer a.limiterMutex.Unlock()
+
+	for key, prev := range a.limiterMap {
+		if prev.overrides == nil {
+			continue
+		}
+		settings, err := resolvePlan(plans, prev.overrides)
+		if err == nil && reflect.DeepEqual(settings, prev.settings) {
+			continue
+		}
+		var sub *subscription
+		if err == nil {
+			sub, err = newSubscription(key, settings)
+		}
+		if err != nil {
+			a.g.Log.Error(fmt.Sprintf("(reload) bucket:'%s' is kept on its former plan, err:'%s'", key, err))
+			continue
+		}
+		sub.overrides = prev.overrides
+		carryOver(prev, sub)
+		a.addSubscriptionNoLock(key, sub)
+		a.g.Log.Info(fmt.Sprintf("(reload) bucket:'%s' changed by plan:'%s'", key, settings.Plan))
+	}
+}
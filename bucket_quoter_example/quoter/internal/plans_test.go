@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePlan(t *testing.T) {
+	plans := map[string]*BucketSettings{
+		"pro": {
+			Inflow: 10, Capacity: 20,
+			Quota:       &QuotaSettings{Limit: 1000, Period: "monthly"},
+			Concurrency: &ConcurrencySettings{Limit: 2},
+		},
+	}
+
+	settings, err := resolvePlan(plans, &BucketSettings{Plan: "pro", Capacity: 40, Quota: &QuotaSettings{Limit: 5000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Plan != "pro" || settings.Inflow != 10 || settings.Capacity != 40 {
+		t.Fatalf("unexpected limits %+v", settings)
+	}
+	if settings.Quota.Limit != 5000 || settings.Quota.Period != "monthly" || settings.Concurrency.Limit != 2 {
+		t.Fatalf("unexpected sections %+v %+v", settings.Quota, settings.Concurrency)
+	}
+	// plan is not changed
+	if plans["pro"].Capacity != 20 || plans["pro"].Quota.Limit != 1000 {
+		t.Fatalf("plan is changed %+v", plans["pro"])
+	}
+
+	if _, err := resolvePlan(plans, &BucketSettings{Plan: "free"}); err == nil {
+		t.Fatalf("expected unknown plan error")
+	}
+	conf := &ConfYaml{Plans: map[string]*BucketSettings{"a": {Plan: "b"}, "b": {Inflow: 1}}}
+	if _, err := conf.resolvedBuckets(); err == nil {
+		t.Fatalf("expected error of plan referring plan")
+	}
+}
+
+const plansConf = `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+plans:
+  "Pro":
+    "inflow": 1
+    "capacity": 100
+    "quota":
+      "limit": 1000
+      "period": "monthly"
+buckets:
+  "a":
+    "plan": "Pro"
+  "b":
+    "plan": "Pro"
+    "capacity": 50
+`
+
+func TestPlansReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimiter.yaml")
+	writeConf(t, path, plansConf)
+	conf, err := LoadConf(path, ConfigOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, _ := testApiConf(t, &conf)
+
+	a, _ := api.subscription("a")
+	b, _ := api.subscription("b")
+	if a.limiter.BucketTokensCapacity.Load() != 100 || b.limiter.BucketTokensCapacity.Load() != 50 || a.quota.Limit != 1000 {
+		t.Fatalf("expected limits of plan")
+	}
+	a.limiter.SetTokens(30)
+	a.quota.TryUse(10)
+
+	// plan is changed, so is bucket on it not overriding the value
+	writeConf(t, path, `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+plans:
+  "Pro":
+    "inflow": 1
+    "capacity": 200
+    "quota":
+      "limit": 2000
+      "period": "monthly"
+buckets:
+  "a":
+    "plan": "Pro"
+  "b":
+    "plan": "Pro"
+    "capacity": 50
+`)
+	if err := api.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	a, _ = api.subscription("a")
+	if a.limiter.BucketTokensCapacity.Load() != 200 || a.limiter.GetAvailable() < 30 {
+		t.Fatalf("expected bucket 'a' to be changed keeping tokens")
+	}
+	if a.quota.Limit != 2000 || a.quota.Remaining() != 1990 {
+		t.Fatalf("expected quota of 'a' to be changed keeping usage, remaining %d", a.quota.Remaining())
+	}
+	if sub, _ := api.subscription("b"); sub.limiter.BucketTokensCapacity.Load() != 50 || sub.quota.Limit != 2000 {
+		t.Fatalf("expected bucket 'b' to keep its capacity")
+	}
+
+	// bucket referring unknown plan is not applied
+	writeConf(t, path, `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+buckets:
+  "a":
+    "plan": "Pro"
+`)
+	if err := api.Reload(); err == nil {
+		t.Fatalf("expected error of unknown plan")
+	}
+}
+
+func TestPlansAdmin(t *testing.T) {
+	conf := &ConfYaml{
+		Admin: AdminSection{Token: "secret"},
+		Plans: map[string]*BucketSettings{"pro": {Inflow: 1, Capacity: 100}},
+	}
+	api, r := testApiConf(t, conf)
+
+	if w := adminRequest(r, "POST", "/admin/buckets/x", `{"plan":"pro","inflow":5}`, "secret"); w.Code != 201 {
+		t.Fatalf("expected 201, got %d %s", w.Code, w.Body.String())
+	}
+	if w := adminRequest(r, "POST", "/admin/buckets/y", `{"plan":"free"}`, "secret"); w.Code != 400 {
+		t.Fatalf("expected 400 of unknown plan, got %d", w.Code)
+	}
+
+	api.applyPlans(map[string]*BucketSettings{"pro": {Inflow: 1, Capacity: 10}})
+	sub, _ := api.subscription("x")
+	if sub.limiter.BucketTokensCapacity.Load() != 10 || sub.limiter.InflowTokensPerSecond.Load() != 5 {
+		t.Fatalf("expected bucket 'x' to follow its plan")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	api, r := testApi(t, map[string]*BucketSettings{
+		"a": {Inflow: 1000, Capacity: 1000, Concurrency: &ConcurrencySettings{Limit: 2}},
+	})
+	sub, _ := api.subscription("a")
+	sub.limiter.SetTokens(1000)
+
+	consume := func(path string) (int, DecisionResponse) {
+		w := v1Request(r, path, `{"key":"a"}`)
+		var d DecisionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, d
+	}
+
+	var leases []string
+	for i := 0; i < 2; i++ {
+		code, d := consume("/v1/consume")
+		if code != 200 || d.Lease == "" {
+			t.Fatalf("expected lease, got %d %+v", code, d)
+		}
+		leases = append(leases, d.Lease)
+	}
+	if code, d := consume("/v1/check"); code != 429 || d.Reason != ERROR_CONCURRENCY_LIMITED {
+		t.Fatalf("expected check to be limited, got %d %+v", code, d)
+	}
+	if code, d := consume("/v1/consume"); code != 429 || d.Reason != ERROR_CONCURRENCY_LIMITED || d.Lease != "" {
+		t.Fatalf("expected concurrency limit, got %d %+v", code, d)
+	}
+
+	if w := v1Request(r, "/v1/release", `{"key":"a","lease":"`+leases[0]+`"}`); w.Code != 200 {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if w := v1Request(r, "/v1/release", `{"key":"a","lease":"`+leases[0]+`"}`); w.Code != 404 {
+		t.Fatalf("expected lease released to be unknown, got %d", w.Code)
+	}
+	if code, _ := consume("/v1/consume"); code != 200 {
+		t.Fatalf("expected 200 after release, got %d", code)
+	}
+}
+
+func TestConcurrencyLeaseTimeout(t *testing.T) {
+	l := newConcurrencyLimiter(&ConcurrencySettings{Limit: 1, LeaseTimeout: 60000})
+	if _, ok := l.Acquire(); !ok {
+		t.Fatalf("expected lease")
+	}
+	if _, ok := l.Acquire(); ok {
+		t.Fatalf("expected limit")
+	}
+	// lease expires
+	l.mutex.Lock()
+	for id := range l.leases {
+		l.leases[id] = l.leases[id].Add(-2 * l.timeout)
+	}
+	l.mutex.Unlock()
+	if _, ok := l.Acquire(); !ok {
+		t.Fatalf("expected lease after expiry")
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	api, r := testApi(t, map[string]*BucketSettings{
+		"a": {Inflow: 1000, Capacity: 1000, Concurrency: &ConcurrencySettings{Limit: 1}},
+	})
+	sub, _ := api.subscription("a")
+	sub.limiter.SetTokens(1000)
+
+	// callers of /limiter do not release, no lease is taken
+	for i := 0; i < 3; i++ {
+		if w := testRequest(r, "GET", "/limiter", "a"); w.Code != 200 || w.Header().Get("X-Limiter-Lease") != "" {
+			t.Fatalf("expected 200 without lease, got %d %v", w.Code, w.Header())
+		}
+	}
+	if sub.concurrency.InFlight() != 0 {
+		t.Fatalf("expected no lease taken, in flight %d", sub.concurrency.InFlight())
+	}
+
+	// leases of /v1/consume are respected
+	if w := v1Request(r, "/v1/consume", `{"key":"a"}`); w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if w := testRequest(r, "GET", "/limiter", "a"); w.Code != 429 {
+		t.Fatalf("expected concurrency limit, got %d", w.Code)
+	}
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// Configuration is reloaded on SIGHUP and on change of configuration file.
+// Buckets added, removed or changed in configuration are applied, buckets
+// not changed keep their tokens. Listener settings ("rateLimiter" section)
+// need restart.
+
+// file is reloaded once it is not changed for reloadDelay, editors
+// write it in several steps
+const reloadDelay = 500 * time.Millisecond
+
+// Reload loads configuration file again and applies it, on error server
+// keeps running on the current configuration
+func (a *Api) Reload() error {
+	current := a.conf.Load()
+	path := current.File
+
+	var overrides ConfigOverrides
+	if current.Overrides != nil {
+		overrides = *current.Overrides
+	}
+
+	conf, err := LoadConf(path, overrides)
+	if err == nil {
+		err = a.applyConf(&conf)
+	}
+	if err != nil {
+		a.g.Log.ErrorFields(logrus.Fields{"config": path, "error": err.Error()},
+			"(reload) configuration is not applied, running on the current one")
+		return err
+	}
+
+	a.g.Log.Info(fmt.Sprintf("(reload) configuration:'%s' applied", path))
+	return nil
+}
+
+// applyConf switches api to configuration, nothing is changed unless all
+// buckets and log outputs of it are valid
+func (a *Api) applyConf(conf *ConfYaml) error {
+	old := a.conf.Load()
+
+	// buckets are compared with plans applied, so change of plan changes
+	// its buckets
+	buckets, err := conf.resolvedBuckets()
+	if err != nil {
+		return err
+	}
+	oldBuckets, err := old.resolvedBuckets()
+	if err != nil {
+		return err
+	}
+	templates, err := conf.resolvedTemplates()
+	if err != nil {
+		return err
+	}
+	rules, err := newRules(conf)
+	if err != nil {
+		return err
+	}
+
+	// buckets added or changed are created before anything is applied
+	created := make(map[string]*subscription)
+	for key, settings := range buckets {
+		if prev, ok := oldBuckets[key]; ok && reflect.DeepEqual(prev, settings) {
+			continue
+		}
+		sub, err := newSubscription(key, settings)
+		if err != nil {
+			return err
+		}
+		created[key] = sub
+	}
+
+	auth, err := NewAuthenticators(conf)
+	if err != nil {
+		return err
+	}
+	resolver, err := newKeyResolver(&conf.Keys)
+	if err != nil {
+		return err
+	}
+
+	var decisionLog *DecisionLog
+	reopen := conf.DecisionLog == old.DecisionLog
+	if l := conf.DecisionLog; !reopen && l.Path != "" {
+		if decisionLog, err = NewDecisionLog(l.Path, int64(l.MaxSize)*1024*1024, l.MaxFiles); err != nil {
+			return fmt.Errorf("opening decision log: %w", err)
+		}
+	}
+
+	if err := a.g.Log.Reopen(conf.LogOptions); err != nil {
+		if decisionLog != nil {
+			decisionLog.Close()
+		}
+		return fmt.Errorf("opening log: %w", err)
+	}
+
+	if prev := a.decisionLog.Load(); reopen && prev != nil {
+		if err := prev.Reopen(); err != nil {
+			a.g.Log.Error(fmt.Sprintf("(reload) error reopening decision log, err:'%s'", err))
+		}
+	} else if !reopen {
+		a.decisionLog.Store(decisionLog)
+		if prev != nil {
+			prev.Close()
+		}
+	}
+
+	for key, sub := range created {
+		if prev, ok := a.subscription(key); ok {
+			carryOver(prev, sub)
+			a.g.Log.Info(fmt.Sprintf("(reload) bucket:'%s' changed", key))
+		} else {
+			a.g.Log.Info(fmt.Sprintf("(reload) bucket:'%s' added", key))
+		}
+		a.addSubscription(key, sub)
+	}
+	// buckets created by admin API are not in configuration, they are kept
+	for key := range old.Buckets.Buckets {
+		if _, ok := conf.Buckets.Buckets[key]; !ok && a.removeSubscription(key) {
+			a.g.Log.Info(fmt.Sprintf("(reload) bucket:'%s' removed", key))
+		}
+	}
+	a.applyTemplates(a.templates.Swap(templates), *a.rules.Swap(&rules), templates, rules)
+	a.applyPlans(conf.Plans)
+	a.scheduler.Apply()
+
+	a.auth.Store(&auth)
+	a.keyResolver.Store(resolver)
+
+	if !reflect.DeepEqual(conf.RateLimiter, old.RateLimiter) {
+		a.g.Log.Info("(reload) changes of 'rateLimiter' section are applied on restart")
+		conf.RateLimiter = old.RateLimiter
+	}
+	// configuration is replaced, not copied over, requests and shutdown
+	// read it meanwhile
+	a.conf.Store(conf)
+
+	return nil
+}
+
+// carryOver moves tokens (debt included), quota usage and leases of
+// subscription replaced to the new one
+func carryOver(prev *subscription, sub *subscription) {
+	var r bucket_quoter.Result
+	prev.limiter.GetAvailableWithResult(&r)
+	sub.limiter.SetTokens(r.After)
+
+	if prev.quota != nil && sub.quota != nil {
+		sub.quota.Restore(prev.quota.State())
+	}
+	if prev.concurrency != nil && sub.concurrency != nil {
+		// leases taken are released to the same limiter
+		prev.concurrency.Reconfigure(sub.settings.Concurrency)
+		sub.concurrency = prev.concurrency
+	}
+}
+
+func (a *Api) reloadLoop(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// nil channels if configuration file is not watched
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+
+	path := a.conf.Load().File
+	if path != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			defer watcher.Close()
+			// directory is watched, file is often replaced by rename
+			err = watcher.Add(filepath.Dir(path))
+		}
+		if err != nil {
+			a.g.Log.Error(fmt.Sprintf("(reload) error watching configuration:'%s', err:'%s'", path, err))
+		} else {
+			events, errs = watcher.Events, watcher.Errors
+		}
+	}
+
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			a.Reload()
+		case e := <-events:
+			if filepath.Clean(e.Name) == filepath.Clean(path) && (e.Has(fsnotify.Write) || e.Has(fsnotify.Create)) {
+				delay = time.After(reloadDelay)
+			}
+		case err := <-errs:
+			a.g.Log.Error(fmt.Sprintf("(reload) error watching configuration:'%s', err:'%s'", path, err))
+		case <-delay:
+			delay = nil
+			a.Reload()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConf(t *testing.T, path string, conf string) {
+	dir := filepath.Dir(path)
+	conf = strings.ReplaceAll(conf, "$DIR", dir)
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const reloadConf = `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+admin:
+  token: "secret"
+buckets:
+  "a":
+    "inflow": 1
+    "capacity": 100
+  "b":
+    "inflow": 1
+    "capacity": 100
+  "c":
+    "inflow": 1
+    "capacity": 100
+`
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimiter.yaml")
+	writeConf(t, path, reloadConf)
+	conf, err := LoadConf(path, ConfigOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, r := testApiConf(t, &conf)
+
+	for _, key := range []string{"a", "b", "c"} {
+		sub, _ := api.subscription(key)
+		sub.limiter.SetTokens(50)
+	}
+	a, _ := api.subscription("a")
+
+	// "a" is not changed, "b" is changed, "c" is removed, "d" is added
+	writeConf(t, path, `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+admin:
+  token: "rotated"
+buckets:
+  "a":
+    "inflow": 1
+    "capacity": 100
+  "b":
+    "inflow": 1
+    "capacity": 20
+  "d":
+    "inflow": 1
+    "capacity": 100
+`)
+	if err := api.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sub, _ := api.subscription("a"); sub != a || sub.limiter.GetAvailable() < 50 {
+		t.Fatalf("expected bucket 'a' to be kept")
+	}
+	if sub, _ := api.subscription("b"); sub.limiter.BucketTokensCapacity.Load() != 20 || sub.limiter.GetAvailable() != 20 {
+		t.Fatalf("expected bucket 'b' to be changed keeping tokens up to capacity")
+	}
+	if _, ok := api.subscription("c"); ok {
+		t.Fatalf("expected bucket 'c' to be removed")
+	}
+	if _, ok := api.subscription("d"); !ok {
+		t.Fatalf("expected bucket 'd' to be added")
+	}
+	if w := adminRequest(r, "GET", "/admin/buckets", "", "rotated"); w.Code != 200 {
+		t.Fatalf("expected admin token to be changed, got %d", w.Code)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ratelimiter.yaml")
+	writeConf(t, path, reloadConf)
+	conf, err := LoadConf(path, ConfigOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, _ := testApiConf(t, &conf)
+
+	for _, invalid := range []string{
+		// bucket "b" is not valid
+		strings.Replace(reloadConf, `"capacity": 100
+  "c"`, `"capacity": 0
+  "c"`, 1),
+		// log level is not valid
+		strings.Replace(reloadConf, `"info"`, `"verbose"`, 1),
+		// not a yaml
+		"buckets: [",
+	} {
+		writeConf(t, path, invalid)
+		if err := api.Reload(); err == nil {
+			t.Fatalf("expected reload to fail")
+		}
+
+		for _, key := range []string{"a", "b", "c"} {
+			if sub, ok := api.subscription(key); !ok || sub.limiter.BucketTokensCapacity.Load() != 100 {
+				t.Fatalf("expected bucket '%s' to be kept", key)
+			}
+		}
+		if api.g.Opts.LogOptions.Level != "info" {
+			t.Fatalf("expected current configuration to be kept")
+		}
+	}
+}
+
+func TestReloadConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimiter.yaml")
+	writeConf(t, path, reloadConf)
+	conf, err := LoadConf(path, ConfigOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, r := testApiConf(t, &conf)
+
+	// requests and shutdown read configuration while it is reloaded
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			writeConf(t, path, strings.ReplaceAll(reloadConf, `"capacity": 100`, fmt.Sprintf(`"capacity": %d`, 100+i)))
+			if err := api.Reload(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		testRequest(r, "GET", "/limiter", "a")
+		if api.core.g.Opts.RateLimiter.shutdownTimeout() <= 0 || api.conf.Load().Buckets.Buckets["a"] == nil {
+			t.Fatalf("expected configuration to be read")
+		}
+	}
+
+	if capacity := api.conf.Load().Buckets.Buckets["a"].Capacity; capacity != 119 {
+		t.Fatalf("expected configuration of the last reload, capacity %d", capacity)
+	}
+}
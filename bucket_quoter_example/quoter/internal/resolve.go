@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key resolution of decision requests: by default bucket key is what caller
+// sends, with "keys.source: jwt" it is claim of bearer JWT verified by keys
+// configured, so callers could not choose bucket to spend
+
+const (
+	KEY_SOURCE_HEADER = "header"
+	KEY_SOURCE_JWT    = "jwt"
+)
+
+type jwtKeyResolver struct {
+	keys   *jwtKeys
+	parser *jwt.Parser
+	claim  string
+}
+
+// newKeyResolver returns resolver of configuration, nil if keys are sent
+// by callers
+func newKeyResolver(settings *KeysSection) (*jwtKeyResolver, error) {
+	switch settings.Source {
+	case "", KEY_SOURCE_HEADER:
+		return nil, nil
+	case KEY_SOURCE_JWT:
+	default:
+		return nil, fmt.Errorf("unknown keys source '%s'", settings.Source)
+	}
+
+	keys := &jwtKeys{keys: make(map[string]interface{})}
+	for i, k := range settings.JWT.Keys {
+		key, err := loadJWTKey(&k)
+		if err != nil {
+			return nil, fmt.Errorf("keys jwt key %d: %w", i, err)
+		}
+		if _, ok := keys.keys[k.Kid]; ok {
+			return nil, fmt.Errorf("keys jwt key %d: duplicate kid '%s'", i, k.Kid)
+		}
+		keys.keys[k.Kid] = key
+	}
+	if len(keys.keys) == 0 {
+		return nil, errors.New("keys jwt: no keys configured")
+	}
+
+	r := &jwtKeyResolver{
+		keys:   keys,
+		parser: newJWTParser(settings.JWT.Issuer, settings.JWT.Audience),
+		claim:  settings.JWT.Claim,
+	}
+	if r.claim == "" {
+		r.claim = "sub"
+	}
+
+	return r, nil
+}
+
+// loadJWTKey reads secret of HS256 or PEM public key (or certificate) of
+// RS256 and ES256
+func loadJWTKey(k *JWTKeySettings) (interface{}, error) {
+	content, err := os.ReadFile(k.File)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k.Alg {
+	case "HS256":
+		secret := []byte(strings.TrimSpace(string(content)))
+		if len(secret) < 32 {
+			return nil, errors.New("HS256 secret is shorter than 32 bytes")
+		}
+		return secret, nil
+	case "RS256", "ES256":
+		key, err := parsePublicKey(content)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if k.Alg == "RS256" {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if k.Alg == "ES256" {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("key of '%s' does not match algorithm '%s'", k.File, k.Alg)
+	}
+	return nil, fmt.Errorf("unsupported algorithm '%s'", k.Alg)
+}
+
+func parsePublicKey(content []byte) (interface{}, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// Resolve returns bucket key of request bearer token
+func (r *jwtKeyResolver) Resolve(req *http.Request) (string, error) {
+	token, ok := bearerToken(req)
+	if !ok {
+		return "", errors.New("bearer token is required")
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := r.parser.ParseWithClaims(token, claims, r.keys.keyFunc); err != nil {
+		return "", err
+	}
+	key, _ := claims[r.claim].(string)
+	if key == "" {
+		return "", fmt.Errorf("token has no claim '%s'", r.claim)
+	}
+
+	return key, nil
+}
+
+// requestKey returns key decision request is charged to, taken from
+// client certificate or bearer token if configured. Key requested is
+// optional then, but has to match. Request without key is charged to
+// anonymous bucket of client address if template is configured.
+func (a *Api) requestKey(c *gin.Context, requested string) (string, *ApiError) {
+	key, keyErr := subscriptionKey(c, requested)
+	if keyErr != nil {
+		return "", keyErr
+	}
+
+	if resolver := a.keyResolver.Load(); resolver != nil {
+		resolved, err := resolver.Resolve(c.Request)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			return "", apiError(401, ERROR_UNAUTHORIZED, fmt.Sprintf("Unauthorized, err:'%s'", err))
+		}
+		if key != "" && key != resolved {
+			return "", apiError(403, ERROR_FORBIDDEN, fmt.Sprintf("Key '%s' does not match token", key))
+		}
+		key = resolved
+	}
+
+	if reservedKey(key) {
+		return "", apiError(403, ERROR_FORBIDDEN, fmt.Sprintf("Key '%s' is reserved", key))
+	}
+	if key == "" {
+		if key = a.anonymousKey(c.ClientIP()); key == "" {
+			return "", apiError(401, ERROR_UNAUTHORIZED, "Subscription key is required")
+		}
+	}
+
+	return key, nil
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestKeyResolverJWT(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaFile := filepath.Join(dir, "rs256.pem")
+	if err = os.WriteFile(rsaFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	secret := "0123456789abcdef0123456789abcdef"
+	hsFile := filepath.Join(dir, "hs256.secret")
+	if err = os.WriteFile(hsFile, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &ConfYaml{
+		Keys: KeysSection{Source: KEY_SOURCE_JWT, JWT: KeyJWTSettings{
+			Claim: "tenant",
+			Keys: []JWTKeySettings{
+				{Kid: "rs", Alg: "RS256", File: rsaFile},
+				{Kid: "hs", Alg: "HS256", File: hsFile},
+			},
+		}},
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{
+			"a": {Inflow: 1, Capacity: 5},
+			"b": {Inflow: 1, Capacity: 5},
+		}},
+	}
+	_, r := testApiConf(t, conf)
+
+	sign := func(method jwt.SigningMethod, kid string, signKey interface{}, tenant string, exp time.Duration) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{"tenant": tenant, "exp": time.Now().Add(exp).Unix()})
+		token.Header["kid"] = kid
+		s, err := token.SignedString(signKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// rejected tokens do not spend bucket, it starts empty and allows
+	// the only request
+	valid := sign(jwt.SigningMethodRS256, "rs", key, "a", time.Minute)
+	for name, token := range map[string]string{
+		"none":         "",
+		"expired":      sign(jwt.SigningMethodRS256, "rs", key, "a", -time.Minute),
+		"tampered":     valid[:len(valid)-4] + "AAAA",
+		"wrong key":    sign(jwt.SigningMethodHS256, "rs", []byte(secret), "a", time.Minute),
+		"no claim":     sign(jwt.SigningMethodHS256, "hs", []byte(secret), "", time.Minute),
+		"other secret": sign(jwt.SigningMethodHS256, "hs", []byte("fedcba9876543210fedcba9876543210"), "a", time.Minute),
+		"unknown kid":  sign(jwt.SigningMethodRS256, "other", key, "a", time.Minute),
+		"key type":     sign(jwt.SigningMethodRS256, "hs", key, "a", time.Minute),
+	} {
+		if w := adminRequest(r, "POST", "/v1/consume", `{"key":"a"}`, token); w.Code != 401 {
+			t.Fatalf("%s: expected 401, got %d %s", name, w.Code, w.Body.String())
+		}
+		if w := adminRequest(r, "GET", "/limiter", "", token); w.Code != 401 {
+			t.Fatalf("%s: expected 401 of /limiter, got %d", name, w.Code)
+		}
+	}
+
+	if w := adminRequest(r, "POST", "/v1/consume", `{}`, valid); w.Code != 200 {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if w := adminRequest(r, "POST", "/v1/consume", `{"key":"a"}`, valid); w.Code != 429 {
+		t.Fatalf("expected 429, got %d %s", w.Code, w.Body.String())
+	}
+	// key requested has to match token
+	if w := adminRequest(r, "POST", "/v1/consume", `{"key":"b"}`, valid); w.Code != 403 {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+
+	hs := sign(jwt.SigningMethodHS256, "hs", []byte(secret), "b", time.Minute)
+	if w := adminRequest(r, "GET", "/limiter", "", hs); w.Code != 200 {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestKeyResolverConf(t *testing.T) {
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short.secret")
+	if err := os.WriteFile(short, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, keys := range map[string]KeysSection{
+		"source":    {Source: "query"},
+		"no keys":   {Source: KEY_SOURCE_JWT},
+		"short":     {Source: KEY_SOURCE_JWT, JWT: KeyJWTSettings{Keys: []JWTKeySettings{{Alg: "HS256", File: short}}}},
+		"algorithm": {Source: KEY_SOURCE_JWT, JWT: KeyJWTSettings{Keys: []JWTKeySettings{{Alg: "none", File: short}}}},
+		"pem":       {Source: KEY_SOURCE_JWT, JWT: KeyJWTSettings{Keys: []JWTKeySettings{{Alg: "RS256", File: short}}}},
+		"missing":   {Source: KEY_SOURCE_JWT, JWT: KeyJWTSettings{Keys: []JWTKeySettings{{Alg: "HS256", File: filepath.Join(dir, "none")}}}},
+	} {
+		if _, err := newKeyResolver(&keys); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+
+	if r, err := newKeyResolver(&KeysSection{}); err != nil || r != nil {
+		t.Fatalf("expected no resolver, got %v %v", r, err)
+	}
+}
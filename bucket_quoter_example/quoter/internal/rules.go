@@ -0,0 +1,402 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rules limit requests by their attributes: method, path prefix, client
+// address, headers and query parameters. Rule applying to request charges
+// bucket of descriptor built of request attributes, e.g. "${key}/${method}"
+// is bucket per subscription and method. Buckets of rules are created on
+// first use like buckets of templates, up to "maxKeys" of every rule.
+//
+// Every rule applying to request has to pass as well as bucket of
+// subscription. Rules of higher priority are checked first, rules of the
+// same priority in order of configuration, bucket of subscription is
+// checked the last. Denial is reported by the first limit denying request
+// and nothing is charged then.
+
+// prefix of keys of rule buckets, "rule:<name>:<descriptor>", callers
+// could not request them
+const ruleKeyPrefix = "rule:"
+
+// placeholders of descriptor, ${key}, ${header:X-Tenant}, ...
+var descriptorPattern = regexp.MustCompile(`\$\{([a-z]+)(?::([^}]+))?\}`)
+
+// RequestAttributes describe request of client decision is made for
+type RequestAttributes struct {
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// taken from callers authenticated as admin only, address of decision
+	// request otherwise
+	ClientIP string            `json:"clientIP,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Query    map[string]string `json:"query,omitempty"`
+}
+
+// requestAttributes returns attributes of request described, client
+// address is address of decision request unless caller is authenticated as
+// admin, so tenants could not dodge or charge rules of client address
+func (a *Api) requestAttributes(c *gin.Context, described *RequestAttributes) *RequestAttributes {
+	var attrs RequestAttributes
+	if described != nil {
+		attrs = *described
+	}
+	if p := a.caller(c); attrs.ClientIP == "" || p == nil || !p.CanDescribeClient() {
+		attrs.ClientIP = c.ClientIP()
+	}
+	headers := make(map[string]string, len(attrs.Headers))
+	for name, value := range attrs.Headers {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	attrs.Headers = headers
+
+	return &attrs
+}
+
+// limiterAttributes returns attributes of /limiter request: method and URI
+// of original request are given by proxy (e.g. nginx auth_request),
+// headers are headers of request itself
+func limiterAttributes(c *gin.Context) *RequestAttributes {
+	attrs := &RequestAttributes{
+		Method:   c.GetHeader("X-Original-Method"),
+		ClientIP: c.ClientIP(),
+		Headers:  make(map[string]string, len(c.Request.Header)),
+		Query:    make(map[string]string),
+	}
+	for name, values := range c.Request.Header {
+		attrs.Headers[name] = values[0]
+	}
+	if uri, err := url.ParseRequestURI(c.GetHeader("X-Original-URI")); err == nil {
+		attrs.Path = uri.Path
+		for name, values := range uri.Query() {
+			attrs.Query[name] = values[0]
+		}
+	}
+
+	return attrs
+}
+
+// value returns attribute of descriptor placeholder
+func (attrs *RequestAttributes) value(key string, kind string, name string) string {
+	switch kind {
+	case "key":
+		return key
+	case "method":
+		return strings.ToUpper(attrs.Method)
+	case "path":
+		return attrs.Path
+	case "ip":
+		return attrs.ClientIP
+	case "header":
+		return attrs.Headers[http.CanonicalHeaderKey(name)]
+	case "query":
+		return attrs.Query[name]
+	}
+	return ""
+}
+
+type rule struct {
+	name     string
+	priority int
+
+	methods    []string
+	pathPrefix string
+	networks   []netip.Prefix
+	headers    []AttributeMatch
+	query      []AttributeMatch
+
+	descriptor string
+	// plan applied
+	settings *BucketSettings
+	// cap of buckets of rule
+	maxKeys int
+}
+
+// Rules are in order of precedence
+type Rules []*rule
+
+func newRules(conf *ConfYaml) (Rules, error) {
+	rules := make(Rules, 0, len(conf.Rules))
+	names := make(map[string]bool)
+	for i := range conf.Rules {
+		r, err := newRule(conf.Plans, &conf.Rules[i])
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if names[r.name] {
+			return nil, fmt.Errorf("rule %d: duplicate name '%s'", i, r.name)
+		}
+		names[r.name] = true
+		rules = append(rules, r)
+	}
+
+	// stable, so rules of the same priority keep order of configuration
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].priority > rules[j].priority
+	})
+
+	return rules, nil
+}
+
+func newRule(plans map[string]*BucketSettings, settings *RuleSettings) (*rule, error) {
+	if settings.Name == "" || strings.Contains(settings.Name, ":") {
+		return nil, fmt.Errorf("name '%s' is empty or has ':'", settings.Name)
+	}
+	if settings.Descriptor == "" {
+		return nil, fmt.Errorf("rule '%s': descriptor is required", settings.Name)
+	}
+	for _, p := range descriptorPattern.FindAllStringSubmatch(settings.Descriptor, -1) {
+		switch p[1] {
+		case "key", "method", "path", "ip":
+			if p[2] == "" {
+				continue
+			}
+		case "header", "query":
+			if p[2] != "" {
+				continue
+			}
+		}
+		return nil, fmt.Errorf("rule '%s': invalid placeholder '%s'", settings.Name, p[0])
+	}
+
+	if settings.Limits == nil {
+		return nil, fmt.Errorf("rule '%s': limits are required", settings.Name)
+	}
+	limits, err := resolvePlan(plans, settings.Limits)
+	if err != nil {
+		return nil, fmt.Errorf("rule '%s': %w", settings.Name, err)
+	}
+	if limits.Concurrency != nil {
+		// lease is taken of subscription bucket only
+		return nil, fmt.Errorf("rule '%s': concurrency is not supported by rules", settings.Name)
+	}
+	if _, err = newSubscription("rule "+settings.Name, limits); err != nil {
+		return nil, err
+	}
+
+	r := &rule{
+		name:       settings.Name,
+		priority:   settings.Priority,
+		pathPrefix: settings.Match.PathPrefix,
+		query:      settings.Match.Query,
+		descriptor: settings.Descriptor,
+		settings:   limits,
+		maxKeys:    settings.MaxKeys,
+	}
+	if r.maxKeys <= 0 {
+		r.maxKeys = defaultTemplateMaxKeys
+	}
+	for _, method := range settings.Match.Methods {
+		r.methods = append(r.methods, strings.ToUpper(method))
+	}
+	for _, ip := range settings.Match.ClientIPs {
+		var network netip.Prefix
+		if strings.Contains(ip, "/") {
+			network, err = netip.ParsePrefix(ip)
+		} else {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(ip); err == nil {
+				network = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s': %w", settings.Name, err)
+		}
+		r.networks = append(r.networks, network.Masked())
+	}
+	for _, h := range settings.Match.Headers {
+		r.headers = append(r.headers, AttributeMatch{Name: http.CanonicalHeaderKey(h.Name), Value: h.Value})
+	}
+
+	return r, nil
+}
+
+// match returns why rule does not apply to request, empty if it does
+func (r *rule) match(attrs *RequestAttributes) string {
+	if len(r.methods) > 0 && !slices.Contains(r.methods, strings.ToUpper(attrs.Method)) {
+		return fmt.Sprintf("method '%s' is not one of '%s'", attrs.Method, strings.Join(r.methods, ","))
+	}
+	if r.pathPrefix != "" && !strings.HasPrefix(attrs.Path, r.pathPrefix) {
+		return fmt.Sprintf("path '%s' has no prefix '%s'", attrs.Path, r.pathPrefix)
+	}
+	if len(r.networks) > 0 {
+		addr, err := netip.ParseAddr(attrs.ClientIP)
+		if err != nil || !slices.ContainsFunc(r.networks, func(network netip.Prefix) bool {
+			return network.Contains(addr.Unmap())
+		}) {
+			return fmt.Sprintf("client address '%s' is not in networks of rule", attrs.ClientIP)
+		}
+	}
+	for _, h := range r.headers {
+		if mismatch := matchAttribute("header", h, attrs.Headers); mismatch != "" {
+			return mismatch
+		}
+	}
+	for _, q := range r.query {
+		if mismatch := matchAttribute("query parameter", q, attrs.Query); mismatch != "" {
+			return mismatch
+		}
+	}
+	return ""
+}
+
+func matchAttribute(kind string, m AttributeMatch, values map[string]string) string {
+	value, ok := values[m.Name]
+	if !ok {
+		return fmt.Sprintf("%s '%s' is missing", kind, m.Name)
+	}
+	if m.Value != "" && value != m.Value {
+		return fmt.Sprintf("%s '%s' is '%s', not '%s'", kind, m.Name, value, m.Value)
+	}
+	return ""
+}
+
+// bucket returns key of rule bucket of request, or why rule does not
+// apply if descriptor refers to attribute request does not have
+func (r *rule) bucket(key string, attrs *RequestAttributes) (string, string) {
+	var missing string
+	descriptor := descriptorPattern.ReplaceAllStringFunc(r.descriptor, func(placeholder string) string {
+		p := descriptorPattern.FindStringSubmatch(placeholder)
+		value := attrs.value(key, p[1], p[2])
+		if value == "" && missing == "" {
+			missing = placeholder
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Sprintf("descriptor value '%s' is empty", missing)
+	}
+	return ruleKeyPrefix + r.name + ":" + descriptor, ""
+}
+
+// settings returns limits of rule, nil if there is no rule of name
+func (rules Rules) settings(name string) *BucketSettings {
+	for _, r := range rules {
+		if r.name == name {
+			return r.settings
+		}
+	}
+	return nil
+}
+
+// maxKeys returns cap of buckets of rule, 0 if there is no rule of name
+func (rules Rules) maxKeys(name string) int {
+	for _, r := range rules {
+		if r.name == name {
+			return r.maxKeys
+		}
+	}
+	return 0
+}
+
+// ruleLimit is bucket of rule applying to request
+type ruleLimit struct {
+	rule   *rule
+	bucket string
+}
+
+// apply returns buckets of rules applying to request in order of
+// precedence, with explanation of every rule
+func (rules Rules) apply(key string, attrs *RequestAttributes) ([]ruleLimit, []RuleExplanation) {
+	var limits []ruleLimit
+	explanations := make([]RuleExplanation, 0, len(rules))
+	for _, r := range rules {
+		explanation := RuleExplanation{Rule: r.name, Priority: r.priority}
+		explanation.Mismatch = r.match(attrs)
+		var bucket string
+		if explanation.Mismatch == "" {
+			bucket, explanation.Mismatch = r.bucket(key, attrs)
+		}
+		if explanation.Mismatch == "" {
+			explanation.Matched = true
+			explanation.Limit = &LimitExplanation{Bucket: bucket}
+			limits = append(limits, ruleLimit{rule: r, bucket: bucket})
+		}
+		explanations = append(explanations, explanation)
+	}
+	return limits, explanations
+}
+
+// decide charges buckets of rules applying to request and bucket of
+// subscription, nothing is charged unless all of them allow request.
+// Decision made is written to decision log unless it is dry run.
+func (a *Api) decide(key string, attrs *RequestAttributes, cost int64, dryRun bool, takeLease bool) *limiterDecision {
+	d := a.decideRules(key, attrs, cost, dryRun, takeLease)
+	if !dryRun {
+		a.logDecision(key, cost, d)
+	}
+	return d
+}
+
+func (a *Api) decideRules(key string, attrs *RequestAttributes, cost int64, dryRun bool, takeLease bool) *limiterDecision {
+	// buckets of rules are not created for unknown keys
+	var err *ApiError
+	if dryRun {
+		_, _, err = a.peekSubscription(key)
+	} else {
+		_, err = a.decisionSubscription(key)
+	}
+	if err != nil {
+		return &limiterDecision{err: err}
+	}
+	limits, _ := (*a.rules.Load()).apply(key, attrs)
+
+	// every limit is checked before any is charged, so request denied does
+	// not hold tokens other requests are decided on meanwhile
+	for _, l := range limits {
+		if d := a.consume(l.bucket, cost, true, false); d.err != nil {
+			return ruleDecision(d, l.rule.name)
+		}
+	}
+	if d := a.consume(key, cost, true, false); d.err != nil || dryRun {
+		return d
+	}
+
+	// limits may be taken by concurrent requests since they are checked
+	charged := make([]*limiterDecision, 0, len(limits))
+	for _, l := range limits {
+		d := a.consume(l.bucket, cost, false, takeLease)
+		if d.err != nil {
+			a.refund(charged, cost)
+			return ruleDecision(d, l.rule.name)
+		}
+		charged = append(charged, d)
+	}
+
+	d := a.consume(key, cost, false, takeLease)
+	if d.err != nil {
+		a.refund(charged, cost)
+	}
+	return d
+}
+
+// ruleDecision returns decision of rule denying request
+func ruleDecision(d *limiterDecision, rule string) *limiterDecision {
+	d.rule = rule
+	// tokens of rule bucket are not of subscription
+	d.result = nil
+	return d
+}
+
+// refund gives back tokens, quota and leases taken by decisions allowed
+func (a *Api) refund(decisions []*limiterDecision, cost int64) {
+	for _, d := range decisions {
+		d.limiter.Refund(cost)
+		if d.quota != nil {
+			d.quota.Refund(cost)
+		}
+		if d.lease != "" {
+			d.concurrency.Release(d.lease)
+		}
+	}
+}
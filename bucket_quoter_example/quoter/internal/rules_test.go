@@ -0,0 +1,425 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// limiterRequest is /limiter request of proxy describing original request
+func limiterRequest(r *gin.Engine, key string, method string, uri string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/limiter", nil)
+	req.Header.Set("X-Limiter-Subscription-ID", key)
+	req.Header.Set("X-Original-Method", method)
+	req.Header.Set("X-Original-URI", uri)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRulesMatch(t *testing.T) {
+	rules, err := newRules(&ConfYaml{Rules: []RuleSettings{
+		{
+			Name: "uploads", Descriptor: "${key}/${method}",
+			Match: RuleMatchSettings{
+				Methods: []string{"post"}, PathPrefix: "/upload", ClientIPs: []string{"10.0.0.0/8", "192.0.2.1"},
+				Headers: []AttributeMatch{{Name: "x-tenant", Value: "acme"}},
+			},
+			Limits: &BucketSettings{Inflow: 1, Capacity: 5},
+		},
+		{
+			Name: "search", Priority: 10, Descriptor: "${query:q}",
+			Match:  RuleMatchSettings{Query: []AttributeMatch{{Name: "q"}}},
+			Limits: &BucketSettings{Inflow: 1, Capacity: 5},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[0].name != "search" {
+		t.Fatalf("expected rule of higher priority first")
+	}
+
+	attrs := &RequestAttributes{
+		Method: "POST", Path: "/upload/file", ClientIP: "10.1.2.3",
+		Headers: map[string]string{"X-Tenant": "acme"},
+	}
+	limits, explanations := rules.apply("a", attrs)
+	if len(limits) != 1 || limits[0].bucket != "rule:uploads:a/POST" {
+		t.Fatalf("unexpected limits %+v", limits)
+	}
+	if explanations[0].Matched || explanations[0].Mismatch != "query parameter 'q' is missing" {
+		t.Fatalf("unexpected explanation %+v", explanations[0])
+	}
+
+	for _, mismatch := range []RequestAttributes{
+		{Method: "GET", Path: "/upload", ClientIP: "10.1.2.3", Headers: attrs.Headers},
+		{Method: "POST", Path: "/download", ClientIP: "10.1.2.3", Headers: attrs.Headers},
+		{Method: "POST", Path: "/upload", ClientIP: "192.0.2.2", Headers: attrs.Headers},
+		{Method: "POST", Path: "/upload", ClientIP: "10.1.2.3", Headers: map[string]string{"X-Tenant": "other"}},
+	} {
+		if r := rules[1].match(&mismatch); r == "" {
+			t.Fatalf("expected %+v not to match", mismatch)
+		}
+	}
+
+	// descriptor value is required
+	if _, r := rules[0].bucket("a", &RequestAttributes{Query: map[string]string{"q": ""}}); r == "" {
+		t.Fatalf("expected empty descriptor value not to match")
+	}
+
+	for _, invalid := range []RuleSettings{
+		{Name: "a:b", Descriptor: "${key}", Limits: &BucketSettings{Inflow: 1, Capacity: 1}},
+		{Name: "a", Descriptor: "${header}", Limits: &BucketSettings{Inflow: 1, Capacity: 1}},
+		{Name: "a", Descriptor: "${key}"},
+		{Name: "a", Descriptor: "${key}", Limits: &BucketSettings{Inflow: 1, Capacity: 1, Concurrency: &ConcurrencySettings{Limit: 1}}},
+		{Name: "a", Descriptor: "${key}", Limits: &BucketSettings{Inflow: 1, Capacity: 1}, Match: RuleMatchSettings{ClientIPs: []string{"10.0.0"}}},
+	} {
+		if _, err := newRules(&ConfYaml{Rules: []RuleSettings{invalid}}); err == nil {
+			t.Fatalf("expected error of rule %+v", invalid)
+		}
+	}
+}
+
+func TestRulesDecide(t *testing.T) {
+	conf := &ConfYaml{
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 100}}},
+		Rules: []RuleSettings{
+			{
+				Name: "writes", Descriptor: "${key}",
+				Match:  RuleMatchSettings{Methods: []string{"POST"}},
+				Limits: &BucketSettings{Inflow: 1, Capacity: 10},
+			},
+		},
+	}
+	api, r := testApiConf(t, conf)
+	sub, _ := api.subscription("a")
+	sub.limiter.SetTokens(100)
+
+	decide := func(path string, body string) (int, DecisionResponse) {
+		w := v1Request(r, path, body)
+		var d DecisionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, d
+	}
+
+	// bucket of rule is created empty, the first request makes debt
+	post := `{"key":"a","cost":5,"request":{"method":"POST"}}`
+	if code, d := decide("/v1/consume", post); code != 200 || d.Rule != "" {
+		t.Fatalf("expected 200, got %d %+v", code, d)
+	}
+	if sub.limiter.GetAvailable() != 95 {
+		t.Fatalf("expected subscription to be charged, available %d", sub.limiter.GetAvailable())
+	}
+
+	// denied by rule, subscription is not charged
+	code, d := decide("/v1/consume", post)
+	if code != 429 || d.Rule != "writes" || d.Reason != ERROR_RATE_LIMITED || d.RateLimit.Limit != 10 {
+		t.Fatalf("expected rule to deny, got %d %+v", code, d)
+	}
+	if sub.limiter.GetAvailable() != 95 {
+		t.Fatalf("expected subscription not to be charged, available %d", sub.limiter.GetAvailable())
+	}
+
+	// rule does not apply
+	if code, _ := decide("/v1/consume", `{"key":"a","cost":5,"request":{"method":"GET"}}`); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	// denied by subscription, rule is refunded
+	ruleSub, ok := api.subscription("rule:writes:a")
+	if !ok || ruleSub.template != "rule:writes" {
+		t.Fatalf("expected bucket of rule")
+	}
+	ruleSub.limiter.SetTokens(10)
+	sub.limiter.SetTokens(-1)
+	stat := *ruleSub.limiter.Stat
+	if code, d := decide("/v1/consume", post); code != 429 || d.Rule != "" {
+		t.Fatalf("expected subscription to deny, got %d %+v", code, d)
+	}
+	if ruleSub.limiter.GetAvailable() != 10 || ruleSub.limiter.Stat.TokensUsed != stat.TokensUsed ||
+		ruleSub.limiter.Stat.MsgPassed != stat.MsgPassed {
+		t.Fatalf("expected rule not to be charged, available %d, stat %+v", ruleSub.limiter.GetAvailable(), *ruleSub.limiter.Stat)
+	}
+
+	if w := v1Request(r, "/v1/consume", `{"key":"rule:writes:a"}`); w.Code != 403 {
+		t.Fatalf("expected reserved key to be rejected, got %d", w.Code)
+	}
+}
+
+func TestRulesClientIP(t *testing.T) {
+	conf := &ConfYaml{
+		Auth: AuthSection{Tokens: []TokenSettings{
+			{Name: "proxy", Token: "proxy-token", Role: ROLE_ADMIN},
+			{Name: "tenant", Token: "tenant-token", Role: ROLE_TENANT, Buckets: []string{"a"}},
+			{Name: "reader", Token: "reader-token", Role: ROLE_READ_ONLY},
+		}},
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 100}}},
+		Rules: []RuleSettings{
+			{
+				Name: "internal", Descriptor: "${ip}",
+				Match:  RuleMatchSettings{ClientIPs: []string{"10.0.0.0/8"}},
+				Limits: &BucketSettings{Inflow: 1, Capacity: 10},
+			},
+		},
+	}
+	api, r := testApiConf(t, conf)
+	sub, _ := api.subscription("a")
+	sub.limiter.SetTokens(100)
+
+	// client address described by caller not authenticated as admin is
+	// ignored, address of connection is 192.0.2.1
+	body := `{"key":"a","request":{"clientIP":"10.1.2.3"}}`
+	for _, token := range []string{"", "wrong-token", "tenant-token", "reader-token"} {
+		if w := adminRequest(r, "POST", "/v1/consume", body, token); w.Code != 200 {
+			t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+		}
+		if _, ok := api.subscription("rule:internal:10.1.2.3"); ok {
+			t.Fatalf("%s: expected client address of caller not admin to be ignored", token)
+		}
+	}
+
+	if w := adminRequest(r, "POST", "/v1/consume", body, "proxy-token"); w.Code != 200 {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := api.subscription("rule:internal:10.1.2.3"); !ok {
+		t.Fatalf("expected client address of admin to be taken")
+	}
+}
+
+func TestRulesKeys(t *testing.T) {
+	conf := &ConfYaml{
+		Templates: TemplatesSection{Default: &BucketSettings{Inflow: 1, Capacity: 100}, MaxKeys: 1},
+		Rules: []RuleSettings{
+			{
+				Name: "tenant", Descriptor: "${header:X-Tenant}", MaxKeys: 2,
+				Limits: &BucketSettings{Inflow: 1, Capacity: 10},
+			},
+		},
+	}
+	api, r := testApiConf(t, conf)
+	// bucket of template is created empty, rules are not charged while it
+	// denies
+	v1Request(r, "/v1/consume", `{"key":"x"}`)
+	sub, _ := api.subscription("x")
+	sub.limiter.SetTokens(100)
+
+	for _, tenant := range []string{"t1", "t2", "t3"} {
+		w := v1Request(r, "/v1/consume", `{"key":"x","request":{"headers":{"X-Tenant":"`+tenant+`"}}}`)
+		if w.Code != 200 {
+			t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+		}
+	}
+	// buckets of rule have cap of their own
+	if _, ok := api.subscription("x"); !ok {
+		t.Fatalf("expected bucket of template to be kept")
+	}
+	if _, ok := api.subscription("rule:tenant:t1"); ok {
+		t.Fatalf("expected the least recently used bucket of rule to be dropped")
+	}
+	if _, ok := api.subscription("rule:tenant:t3"); !ok {
+		t.Fatalf("expected bucket of rule")
+	}
+
+	// no bucket of rule for unknown key
+	api.applyTemplates(api.templates.Swap(&TemplatesSection{}), *api.rules.Load(), &TemplatesSection{}, *api.rules.Load())
+	if w := v1Request(r, "/v1/consume", `{"key":"y","request":{"headers":{"X-Tenant":"t4"}}}`); w.Code != 403 {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	if _, ok := api.subscription("rule:tenant:t4"); ok {
+		t.Fatalf("expected no bucket of rule for unknown key")
+	}
+}
+
+func TestRulesExplain(t *testing.T) {
+	conf := &ConfYaml{
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 100}}},
+		Rules: []RuleSettings{
+			{
+				Name: "tenant", Descriptor: "${header:X-Tenant}",
+				Limits: &BucketSettings{Inflow: 1, Capacity: 10},
+			},
+			{
+				Name: "writes", Priority: 10, Descriptor: "${key}",
+				Match:  RuleMatchSettings{Methods: []string{"POST"}},
+				Limits: &BucketSettings{Inflow: 1, Capacity: 10},
+			},
+		},
+	}
+	api, r := testApiConf(t, conf)
+	sub, _ := api.subscription("a")
+	sub.limiter.SetTokens(50)
+
+	w := v1Request(r, "/v1/explain", `{"key":"a","cost":5,"request":{"method":"GET","headers":{"x-tenant":"acme"}}}`)
+	var e ExplainResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 || len(e.Rules) != 2 || e.Rules[0].Rule != "writes" || e.Rules[0].Matched {
+		t.Fatalf("unexpected explanation %d %s", w.Code, w.Body.String())
+	}
+	tenant := e.Rules[1]
+	if !tenant.Matched || tenant.Limit.Bucket != "rule:tenant:acme" || !tenant.Limit.Allowed || tenant.Limit.Template != "rule:tenant" {
+		t.Fatalf("unexpected explanation of rule %+v", tenant)
+	}
+	if !e.Allowed || e.Subscription.Bucket != "a" || e.Subscription.RateLimit.Remaining != 50 {
+		t.Fatalf("unexpected explanation %s", w.Body.String())
+	}
+	// nothing is charged or created
+	if sub.limiter.GetAvailable() != 50 || e.Subscription.Template != "" {
+		t.Fatalf("expected subscription not to be charged")
+	}
+	if _, ok := api.subscription("rule:tenant:acme"); ok {
+		t.Fatalf("expected rule bucket not to be created")
+	}
+
+	if w := v1Request(r, "/v1/consume", `{"key":"a","request":{"headers":{"X-Tenant":"acme"}}}`); w.Code != 200 {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	ruleSub, _ := api.subscription("rule:tenant:acme")
+	ruleSub.limiter.SetTokens(-1)
+	sub.limiter.SetTokens(-1)
+	underflows := sub.limiter.Stat.BucketUnderflows
+	w = v1Request(r, "/v1/explain", `{"key":"a","request":{"headers":{"X-Tenant":"acme"}}}`)
+	e = ExplainResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	// the first limit denying is reported, every limit is evaluated
+	if e.Allowed || e.Rule != "tenant" || e.Reason != ERROR_RATE_LIMITED || e.Subscription.Allowed {
+		t.Fatalf("unexpected explanation %s", w.Body.String())
+	}
+	if e.Rules[1].Limit.Template != "" || sub.limiter.Stat.BucketUnderflows != underflows {
+		t.Fatalf("expected explanation of existing buckets not counting underflows")
+	}
+}
+
+func TestRulesCheck(t *testing.T) {
+	conf := &ConfYaml{
+		Templates: TemplatesSection{Default: &BucketSettings{Inflow: 1, Capacity: 10}},
+		Rules: []RuleSettings{
+			{Name: "tenant", Descriptor: "${header:X-Tenant}", Limits: &BucketSettings{Inflow: 1, Capacity: 10}},
+		},
+	}
+	api, r := testApiConf(t, conf)
+
+	// dry run does not create buckets of template or rule
+	body := `{"key":"x","request":{"headers":{"X-Tenant":"acme"}}}`
+	for _, path := range []string{"/v1/check", "/v1/explain"} {
+		if w := v1Request(r, path, body); w.Code != 200 {
+			t.Fatalf("%s: expected 200, got %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	if n := api.templateKeys.Len(); n != 0 {
+		t.Fatalf("expected no bucket created, got %d", n)
+	}
+	for _, key := range []string{"x", "rule:tenant:acme"} {
+		if _, ok := api.subscription(key); ok {
+			t.Fatalf("expected bucket '%s' not to be created", key)
+		}
+	}
+	if w := v1Request(r, "/v1/check", `{"key":"anonymous:192.0.2.2"}`); w.Code != 403 {
+		t.Fatalf("expected 403 of unknown key, got %d", w.Code)
+	}
+}
+
+func TestRulesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimiter.yaml")
+	writeConf(t, path, `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+buckets:
+  "a":
+    "inflow": 1
+    "capacity": 100
+rules:
+  - name: "uploads"
+    priority: 10
+    match:
+      methods: ["POST"]
+      pathPrefix: "/upload"
+      clientIPs: ["192.0.2.0/24"]
+      headers:
+        - name: "X-Tenant"
+      query:
+        - name: "v"
+          value: 2
+    descriptor: "${key}/${header:X-Tenant}"
+    limits:
+      "inflow": 1
+      "capacity": 5
+    maxKeys: 100
+`)
+	conf, err := LoadConf(path, ConfigOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Rules) != 1 || conf.Rules[0].MaxKeys != 100 {
+		t.Fatalf("expected rule, got %+v", conf.Rules)
+	}
+	m := conf.Rules[0].Match
+	if m.PathPrefix != "/upload" || len(m.ClientIPs) != 1 || m.Headers[0].Name != "X-Tenant" || m.Query[0].Value != "2" {
+		t.Fatalf("unexpected match %+v", m)
+	}
+	api, r := testApiConf(t, &conf)
+
+	// proxy describes original request
+	w := limiterRequest(r, "a", "POST", "/upload/x?v=2", map[string]string{"X-Tenant": "acme"})
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	sub, ok := api.subscription("rule:uploads:a/acme")
+	if !ok || sub.limiter.BucketTokensCapacity.Load() != 5 {
+		t.Fatalf("expected bucket of rule")
+	}
+	sub.limiter.SetTokens(4)
+
+	// limits of rule are changed keeping tokens
+	writeConf(t, path, `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+buckets:
+  "a":
+    "inflow": 1
+    "capacity": 100
+rules:
+  - name: "uploads"
+    descriptor: "${key}/${header:X-Tenant}"
+    limits:
+      "inflow": 1
+      "capacity": 3
+`)
+	if err := api.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if sub, _ := api.subscription("rule:uploads:a/acme"); sub.limiter.BucketTokensCapacity.Load() != 3 || sub.limiter.GetAvailable() != 3 {
+		t.Fatalf("expected bucket of rule to be changed keeping tokens up to capacity")
+	}
+
+	// rule is removed, so are its buckets
+	writeConf(t, path, `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+buckets:
+  "a":
+    "inflow": 1
+    "capacity": 100
+`)
+	if err := api.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.subscription("rule:uploads:a/acme"); ok {
+		t.Fatalf("expected bucket of rule to be removed")
+	}
+}
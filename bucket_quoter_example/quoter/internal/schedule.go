@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	// zone database for images without system one
+	_ "time/tzdata"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+// Clock is the time source of scheduler, replaced by fake one in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// cronSpec is five field cron expression: minute, hour, day of month,
+// month and day of week. Window is active during every minute matched.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+
+	// day of month and day of week restricted both, cron matches any
+	domRestricted, dowRestricted bool
+}
+
+var cronDowNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron '%s': 5 fields expected", expr)
+	}
+
+	var spec cronSpec
+	var err error
+	if spec.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron '%s' minute: %w", expr, err)
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron '%s' hour: %w", expr, err)
+	}
+	if spec.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron '%s' day of month: %w", expr, err)
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12, nil); err != nil {
+		return nil, fmt.Errorf("cron '%s' month: %w", expr, err)
+	}
+	if spec.dow, err = parseCronField(fields[4], 0, 7, cronDowNames); err != nil {
+		return nil, fmt.Errorf("cron '%s' day of week: %w", expr, err)
+	}
+	// 7 is sunday too
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.domRestricted = fields[2] != "*"
+	spec.dowRestricted = fields[4] != "*"
+
+	return &spec, nil
+}
+
+// parseCronField supports "*", "N", "N-M", "*/S", "N-M/S" and lists
+func parseCronField(field string, min int, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid value '%s'", s)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step, stepped := 1, false
+		if i := strings.Index(part, "/"); i >= 0 {
+			stepped = true
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step '%s'", part)
+			}
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if from, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			to = from
+			if stepped {
+				// "N/S" is "N-max/S" like in standard cron
+				to = max
+			}
+			if len(bounds) == 2 {
+				if to, err = value(bounds[1]); err != nil {
+					return 0, err
+				}
+			}
+			if to < from {
+				return 0, fmt.Errorf("invalid range '%s'", part)
+			}
+		}
+
+		for n := from; n <= to; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s *cronSpec) match(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+type ScheduleWindow struct {
+	Name     string
+	Inflow   int64
+	Capacity int64
+
+	cron *cronSpec
+}
+
+// BucketSchedule changes bucket limits by time windows, first window
+// matched wins, outside of all windows bucket runs on base limits
+type BucketSchedule struct {
+	Location *time.Location
+	Windows  []*ScheduleWindow
+
+	Base ScheduleWindow
+}
+
+func NewBucketSchedule(settings *BucketSettings) (*BucketSchedule, error) {
+	if settings.Schedule == nil {
+		return nil, errors.New("no schedule configured")
+	}
+
+	var s BucketSchedule
+	var err error
+	if s.Location, err = time.LoadLocation(settings.Schedule.Timezone); err != nil {
+		return nil, err
+	}
+
+	s.Base = ScheduleWindow{Name: "base", Inflow: int64(settings.Inflow), Capacity: int64(settings.Capacity)}
+	for i, w := range settings.Schedule.Windows {
+		spec, err := parseCron(w.Cron)
+		if err != nil {
+			return nil, err
+		}
+		if w.Inflow <= 0 || w.Capacity <= 0 {
+			return nil, fmt.Errorf("window '%s': inflow and capacity must be positive", w.Name)
+		}
+
+		name := w.Name
+		if name == "" {
+			name = fmt.Sprintf("window-%d", i)
+		}
+		s.Windows = append(s.Windows, &ScheduleWindow{
+			Name:     name,
+			Inflow:   int64(w.Inflow),
+			Capacity: int64(w.Capacity),
+			cron:     spec,
+		})
+	}
+
+	return &s, nil
+}
+
+func (s *BucketSchedule) Active(now time.Time) *ScheduleWindow {
+	now = now.In(s.Location)
+	for _, w := range s.Windows {
+		if w.cron.match(now) {
+			return w
+		}
+	}
+	return &s.Base
+}
+
+type scheduledBucket struct {
+	schedule *BucketSchedule
+	quoter   *bucket_quoter.BucketQuoter
+	active   *ScheduleWindow
+}
+
+// Scheduler applies schedules through quoter reconfiguration, windows
+// have minute granularity, so it wakes up on every minute boundary
+type Scheduler struct {
+	g     *CmdGlobal
+	clock Clock
+
+	mutex   sync.Mutex
+	buckets map[string]*scheduledBucket
+}
+
+func NewScheduler(g *CmdGlobal, clock Clock) *Scheduler {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &Scheduler{
+		g:       g,
+		clock:   clock,
+		buckets: make(map[string]*scheduledBucket),
+	}
+}
+
+func (s *Scheduler) Add(key string, schedule *BucketSchedule, quoter *bucket_quoter.BucketQuoter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.buckets[key] = &scheduledBucket{schedule: schedule, quoter: quoter}
+}
+
+func (s *Scheduler) Remove(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.buckets, key)
+}
+
+// Apply switches every bucket to the window active now
+func (s *Scheduler) Apply() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	for key, b := range s.buckets {
+		w := b.schedule.Active(now)
+		if w == b.active {
+			continue
+		}
+		b.quoter.Reconfigure(w.Inflow, w.Capacity)
+		b.active = w
+
+		if s.g != nil && s.g.Log != nil {
+			s.g.Log.Info(fmt.Sprintf("(schedule) bucket:'%s' window:'%s' inflow:'%d' capacity:'%d'",
+				key, w.Name, w.Inflow, w.Capacity))
+		}
+	}
+}
+
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	for {
+		s.Apply()
+
+		now := s.clock.Now()
+		select {
+		case <-s.clock.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ActiveWindow returns name of the window applied to bucket, empty for
+// buckets without schedule
+func (s *Scheduler) ActiveWindow(key string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if b, ok := s.buckets[key]; ok && b.active != nil {
+		return b.active.Name
+	}
+	return ""
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, ch)
+	return ch
+}
+
+// Set moves clock and wakes up everyone waiting
+func (c *fakeClock) Set(now time.Time) {
+	c.mutex.Lock()
+	c.now = now
+	waiters := c.waiters
+	c.waiters = nil
+	c.mutex.Unlock()
+
+	for _, ch := range waiters {
+		ch <- now
+	}
+}
+
+func (c *fakeClock) waiting() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.waiters)
+}
+
+func TestParseCron(t *testing.T) {
+	spec, err := parseCron("*/15 0-6,22-23 * * mon-fri")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2026-10-19 is monday
+	cases := map[string]bool{
+		"2026-10-19T22:15:00Z": true,
+		"2026-10-19T22:16:00Z": false,
+		"2026-10-19T12:00:00Z": false,
+		"2026-10-24T23:00:00Z": false,
+	}
+	for at, expected := range cases {
+		now, _ := time.Parse(time.RFC3339, at)
+		if spec.match(now) != expected {
+			t.Errorf("cron match at %s, expected %t", at, expected)
+		}
+	}
+
+	// "N/S" runs from N to the end of range
+	bits, err := parseCronField("5/20", 0, 59, nil)
+	if err != nil || bits != 1<<5|1<<25|1<<45 {
+		t.Errorf("expected minutes 5, 25 and 45, got %b %v", bits, err)
+	}
+	if bits, err := parseCronField("5", 0, 59, nil); err != nil || bits != 1<<5 {
+		t.Errorf("expected minute 5, got %b %v", bits, err)
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 5-1 * * *", "* * * * foo", "*/0 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("cron '%s' expected to be invalid", expr)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	settings := &BucketSettings{
+		Inflow:   10,
+		Capacity: 10,
+		Schedule: &ScheduleSettings{
+			Timezone: "Europe/Berlin",
+			Windows: []ScheduleWindowSettings{
+				{Name: "off-peak", Cron: "* 0-6,22-23 * * *", Inflow: 30, Capacity: 30},
+			},
+		},
+	}
+	schedule, err := NewBucketSchedule(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 21:59 in Berlin (CEST)
+	clock := &fakeClock{now: time.Date(2026, 10, 19, 19, 59, 30, 0, time.UTC)}
+	quoter := bucket_quoter.NewBucketQuoter(10, 10, false, nil)
+
+	scheduler := NewScheduler(nil, clock)
+	scheduler.Add("sub", schedule, quoter)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		scheduler.Run(stop)
+		close(done)
+	}()
+
+	wait := func() {
+		for clock.waiting() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	wait()
+	if scheduler.ActiveWindow("sub") != "base" || quoter.InflowTokensPerSecond.Load() != 10 {
+		t.Fatalf("expected base window, got '%s'", scheduler.ActiveWindow("sub"))
+	}
+
+	// window boundary
+	clock.Set(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	wait()
+	if scheduler.ActiveWindow("sub") != "off-peak" ||
+		quoter.InflowTokensPerSecond.Load() != 30 || quoter.BucketTokensCapacity.Load() != 30 {
+		t.Fatalf("expected off-peak window, got '%s'", scheduler.ActiveWindow("sub"))
+	}
+
+	// 07:00 in Berlin
+	clock.Set(time.Date(2026, 10, 20, 5, 0, 0, 0, time.UTC))
+	wait()
+	if scheduler.ActiveWindow("sub") != "base" || quoter.InflowTokensPerSecond.Load() != 10 {
+		t.Fatalf("expected base window, got '%s'", scheduler.ActiveWindow("sub"))
+	}
+
+	close(stop)
+	<-done
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Graceful shutdown: listeners are closed, requests in flight are drained
+// within timeout, then state is saved and files of the server are removed
+
+// ErrDrainTimeout is returned by Shutdown if requests in flight are cut
+// off, process exits with ExitCodeDrainFailed then
+var ErrDrainTimeout = errors.New("requests in flight are not drained")
+
+// milliseconds, used if "rateLimiter.shutdownTimeout" is not set
+const defaultShutdownTimeout = 30000
+
+func (r *RateLimiterSection) shutdownTimeout() time.Duration {
+	if r.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout * time.Millisecond
+	}
+	return time.Duration(r.ShutdownTimeout) * time.Millisecond
+}
+
+// serve runs server on listener until Shutdown, TLS is served if
+// certfile is set
+func (a *Api) serve(srv *http.Server, l net.Listener, certfile string, keyfile string) error {
+	a.serverMutex.Lock()
+	if a.closed {
+		a.serverMutex.Unlock()
+		l.Close()
+		return nil
+	}
+	a.servers = append(a.servers, srv)
+	a.serverMutex.Unlock()
+
+	var err error
+	if certfile != "" {
+		err = srv.ServeTLS(l, certfile, keyfile)
+	} else {
+		err = srv.Serve(l)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// addSocket registers unix socket to remove on Shutdown
+func (a *Api) addSocket(socket string) {
+	a.serverMutex.Lock()
+	defer a.serverMutex.Unlock()
+
+	a.sockets = append(a.sockets, socket)
+}
+
+// Shutdown stops accepting requests and waits for requests in flight until
+// ctx is done, requests left are cut off then. State is saved anyway.
+func (a *Api) Shutdown(ctx context.Context) error {
+	a.serverMutex.Lock()
+	if a.closed {
+		a.serverMutex.Unlock()
+		return nil
+	}
+	a.closed = true
+	servers, sockets := a.servers, a.sockets
+	a.serverMutex.Unlock()
+
+	var wg sync.WaitGroup
+	var drained = true
+	var drainedMutex sync.Mutex
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+				drainedMutex.Lock()
+				drained = false
+				drainedMutex.Unlock()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	close(a.stop)
+
+	if err := a.SaveState(); err != nil {
+		a.g.Log.Error(fmt.Sprintf("(shutdown) error saving state, err:'%s'", err))
+	}
+	if l := a.decisionLog.Swap(nil); l != nil {
+		l.Close()
+	}
+	for _, socket := range sockets {
+		if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			a.g.Log.Error(fmt.Sprintf("(shutdown) error removing socket:'%s', err:'%s'", socket, err))
+		}
+	}
+
+	if !drained {
+		return ErrDrainTimeout
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testServe runs handler on api server, started signals request in flight
+func testServe(t *testing.T, api *Api, release chan struct{}) (string, chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{}, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})}
+	go api.serve(srv, l, "", "")
+
+	return "http://" + l.Addr().String(), started
+}
+
+func TestShutdownDrains(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "ratelimiter.state")
+	api, _ := testApiConf(t, &ConfYaml{RateLimiter: RateLimiterSection{StateFile: state}})
+
+	release := make(chan struct{})
+	url, started := testServe(t, api, release)
+
+	done := make(chan int)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() { shutdown <- api.Shutdown(context.Background()) }()
+
+	// listener is closed, request in flight is completed
+	time.Sleep(50 * time.Millisecond)
+	if _, err := http.Get(url); err == nil {
+		t.Fatalf("expected new requests to be refused")
+	}
+	close(release)
+
+	if code := <-done; code != 200 {
+		t.Fatalf("expected request in flight to complete, got %d", code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(state); err != nil {
+		t.Fatalf("expected state to be saved, err:'%s'", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	api, _ := testApi(t, nil)
+
+	release := make(chan struct{})
+	defer close(release)
+	url, started := testServe(t, api, release)
+
+	go http.Get(url)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := api.Shutdown(ctx); !errors.Is(err, ErrDrainTimeout) {
+		t.Fatalf("expected drain to time out, got %v", err)
+	}
+}
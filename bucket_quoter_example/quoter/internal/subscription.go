@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/alexgaas/bucket_quoter"
+)
+
+// subscription is bucket of key with its optional adaptive (AIMD) mode,
+// schedule, calendar period quota and concurrency limit
+type subscription struct {
+	// plan applied, see plans.go
+	settings *BucketSettings
+	// settings of bucket created by admin API on plan, resolved again
+	// when plan changes, nil otherwise
+	overrides *BucketSettings
+
+	limiter *bucket_quoter.BucketQuoter
+	// shares quoter with limiter, nil if bucket is not adaptive
+	adaptive *bucket_quoter.AdaptiveQuoter
+	schedule *BucketSchedule
+	// checked together with bucket, nil if bucket has no quota
+	quota *bucket_quoter.PeriodQuota
+	// nil if requests in flight are not limited
+	concurrency *concurrencyLimiter
+	// name of template bucket is created of, empty if configured
+	template string
+}
+
+func newSubscription(key string, l *BucketSettings) (*subscription, error) {
+	if l.Inflow <= 0 || l.Capacity <= 0 {
+		return nil, fmt.Errorf("bucket '%s': inflow and capacity must be positive", key)
+	}
+
+	sub := &subscription{
+		settings: l,
+		limiter:  bucket_quoter.NewBucketQuoter(int64(l.Inflow), int64(l.Capacity), false, nil),
+	}
+
+	if l.Warmup != nil {
+		if err := sub.limiter.SetWarmup(l.Warmup.Options()); err != nil {
+			return nil, fmt.Errorf("bucket '%s' warmup: %w", key, err)
+		}
+	}
+
+	if l.Adaptive != nil {
+		adaptive, err := bucket_quoter.NewAdaptiveQuoter(sub.limiter, l.Adaptive.Options())
+		if err != nil {
+			return nil, fmt.Errorf("bucket '%s': %w", key, err)
+		}
+		sub.adaptive = adaptive
+	}
+
+	if l.Schedule != nil {
+		schedule, err := NewBucketSchedule(l)
+		if err != nil {
+			return nil, fmt.Errorf("bucket '%s' schedule: %w", key, err)
+		}
+		sub.schedule = schedule
+	}
+
+	if l.Quota != nil {
+		quota, err := l.Quota.NewQuota()
+		if err != nil {
+			return nil, fmt.Errorf("bucket '%s' quota: %w", key, err)
+		}
+		sub.quota = quota
+	}
+
+	if l.Concurrency != nil {
+		if l.Concurrency.Limit <= 0 {
+			return nil, fmt.Errorf("bucket '%s' concurrency: limit must be positive", key)
+		}
+		if l.Concurrency.LeaseTimeout < 0 {
+			return nil, fmt.Errorf("bucket '%s' concurrency: lease timeout must not be negative", key)
+		}
+		sub.concurrency = newConcurrencyLimiter(l.Concurrency)
+	}
+
+	return sub, nil
+}
+
+// subscription returns subscription of key
+func (a *Api) subscription(key string) (*subscription, bool) {
+	a.limiterMutex.RLock()
+	defer a.limiterMutex.RUnlock()
+
+	sub, ok := a.limiterMap[key]
+	return sub, ok
+}
+
+// addSubscription adds or replaces subscription of key
+func (a *Api) addSubscription(key string, sub *subscription) {
+	a.limiterMutex.Lock()
+	defer a.limiterMutex.Unlock()
+
+	a.addSubscriptionNoLock(key, sub)
+}
+
+func (a *Api) addSubscriptionNoLock(key string, sub *subscription) {
+	a.limiterMap[key] = sub
+	if sub.template == "" {
+		// configured bucket replaces one created of template
+		a.templateKeys.remove(key)
+	}
+	if sub.schedule != nil {
+		a.scheduler.Add(key, sub.schedule, sub.limiter)
+	} else {
+		a.scheduler.Remove(key)
+	}
+}
+
+func (a *Api) removeSubscription(key string) bool {
+	a.limiterMutex.Lock()
+	defer a.limiterMutex.Unlock()
+
+	if _, ok := a.limiterMap[key]; !ok {
+		return false
+	}
+	delete(a.limiterMap, key)
+	a.scheduler.Remove(key)
+	a.templateKeys.remove(key)
+	delete(a.pendingStates, key)
+
+	return true
+}
+
+// subscriptionKeys returns keys of all subscriptions
+func (a *Api) subscriptionKeys() []string {
+	a.limiterMutex.RLock()
+	defer a.limiterMutex.RUnlock()
+
+	keys := make([]string, 0, len(a.limiterMap))
+	for key := range a.limiterMap {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// createSubscription adds subscription unless key exists
+func (a *Api) createSubscription(key string, sub *subscription) bool {
+	a.limiterMutex.Lock()
+	defer a.limiterMutex.Unlock()
+
+	if _, ok := a.limiterMap[key]; ok {
+		return false
+	}
+	a.addSubscriptionNoLock(key, sub)
+
+	return true
+}
+
+// updateSubscription changes limits of bucket keeping its tokens, returns
+// nil if key is unknown
+func (a *Api) updateSubscription(key string, inflow int, capacity int) (*subscription, error) {
+	a.limiterMutex.Lock()
+	defer a.limiterMutex.Unlock()
+
+	sub, ok := a.limiterMap[key]
+	if !ok {
+		return nil, nil
+	}
+	if inflow <= 0 || capacity <= 0 {
+		return nil, fmt.Errorf("bucket '%s': inflow and capacity must be positive", key)
+	}
+
+	settings := *sub.settings
+	settings.Inflow = inflow
+	settings.Capacity = capacity
+
+	updated := *sub
+	updated.settings = &settings
+	if sub.overrides != nil {
+		overrides := *sub.overrides
+		overrides.Inflow = inflow
+		overrides.Capacity = capacity
+		updated.overrides = &overrides
+	}
+	if sub.schedule != nil {
+		// limits are base of schedule, applied outside of windows
+		schedule, err := NewBucketSchedule(&settings)
+		if err != nil {
+			return nil, fmt.Errorf("bucket '%s' schedule: %w", key, err)
+		}
+		updated.schedule = schedule
+		a.scheduler.Add(key, schedule, sub.limiter)
+	} else {
+		sub.limiter.Reconfigure(int64(inflow), int64(capacity))
+	}
+	a.limiterMap[key] = &updated
+
+	return &updated, nil
+}
@@ -0,0 +1,343 @@
+package internal
+
+import (
+	"container/list"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Buckets of keys not configured are created on first use of templates:
+// "default" of unknown keys, "anonymous" of requests without key, bucket
+// per client address. Number of keys created is capped ("maxKeys" of
+// templates, of every rule for its buckets), the least recently used one
+// is dropped to make room for a new one. Without template unknown
+// keys are rejected with 403 and requests without key with 401.
+
+const (
+	TEMPLATE_DEFAULT   = "default"
+	TEMPLATE_ANONYMOUS = "anonymous"
+)
+
+// prefix of keys of anonymous buckets, callers could not request them
+const anonymousKeyPrefix = "anonymous:"
+
+// used if "templates.maxKeys" is not set
+const defaultTemplateMaxKeys = 10000
+
+func (t *TemplatesSection) template(name string) *BucketSettings {
+	switch name {
+	case TEMPLATE_DEFAULT:
+		return t.Default
+	case TEMPLATE_ANONYMOUS:
+		return t.Anonymous
+	}
+	return nil
+}
+
+func (t *TemplatesSection) maxKeys() int {
+	if t.MaxKeys > 0 {
+		return t.MaxKeys
+	}
+	return defaultTemplateMaxKeys
+}
+
+// validate creates bucket of every template to check settings
+func (t *TemplatesSection) validate() error {
+	for _, name := range []string{TEMPLATE_DEFAULT, TEMPLATE_ANONYMOUS} {
+		if settings := t.template(name); settings != nil {
+			if _, err := newSubscription("template "+name, settings); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// templateKeys are keys created of templates and rules, the least
+// recently used at back. Keys of templates share one cap, keys of every
+// rule have cap of their own, see keyGroup.
+type templateKeys struct {
+	mutex sync.Mutex
+	keys  map[string]*list.Element
+	lru   map[string]*list.List
+}
+
+func newTemplateKeys() *templateKeys {
+	return &templateKeys{keys: make(map[string]*list.Element), lru: make(map[string]*list.List)}
+}
+
+// keyGroup returns group of keys sharing cap, "rule:<name>" of rule
+// buckets, empty of buckets of templates
+func keyGroup(key string) string {
+	if name := keyTemplate(key); strings.HasPrefix(name, ruleKeyPrefix) {
+		return name
+	}
+	return ""
+}
+
+func (t *templateKeys) touch(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if e, ok := t.keys[key]; ok {
+		t.lru[keyGroup(key)].MoveToFront(e)
+	}
+}
+
+// add tracks key and returns keys of its group to be dropped beyond maxKeys
+func (t *templateKeys) add(key string, maxKeys int) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	group := keyGroup(key)
+	lru, ok := t.lru[group]
+	if !ok {
+		lru = list.New()
+		t.lru[group] = lru
+	}
+	if e, ok := t.keys[key]; ok {
+		lru.MoveToFront(e)
+		return nil
+	}
+	t.keys[key] = lru.PushFront(key)
+
+	return t.trimNoLock(group, maxKeys)
+}
+
+// trim returns keys of group to be dropped beyond maxKeys
+func (t *templateKeys) trim(group string, maxKeys int) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.trimNoLock(group, maxKeys)
+}
+
+func (t *templateKeys) trimNoLock(group string, maxKeys int) []string {
+	lru, ok := t.lru[group]
+	if !ok {
+		return nil
+	}
+	var evicted []string
+	for lru.Len() > maxKeys {
+		oldest := lru.Back()
+		lru.Remove(oldest)
+		delete(t.keys, oldest.Value.(string))
+		evicted = append(evicted, oldest.Value.(string))
+	}
+	return evicted
+}
+
+func (t *templateKeys) remove(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if e, ok := t.keys[key]; ok {
+		group := keyGroup(key)
+		t.lru[group].Remove(e)
+		delete(t.keys, key)
+		if t.lru[group].Len() == 0 {
+			delete(t.lru, group)
+		}
+	}
+}
+
+func (t *templateKeys) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.keys)
+}
+
+// anonymousKey returns key of request without key of client address,
+// empty unless anonymous template is configured
+func (a *Api) anonymousKey(clientIP string) string {
+	if a.templates.Load().Anonymous == nil {
+		return ""
+	}
+	return anonymousKeyPrefix + clientIP
+}
+
+// reservedKey reports whether key is of bucket created of anonymous
+// template or rule, such keys are not given by clients or admin
+func reservedKey(key string) bool {
+	return strings.HasPrefix(key, anonymousKeyPrefix) || strings.HasPrefix(key, ruleKeyPrefix)
+}
+
+// keyTemplate returns name of template bucket of key is created of, rule
+// buckets are created of limits of their rule, "rule:<name>"
+func keyTemplate(key string) string {
+	switch {
+	case strings.HasPrefix(key, anonymousKeyPrefix):
+		return TEMPLATE_ANONYMOUS
+	case strings.HasPrefix(key, ruleKeyPrefix):
+		name, _, _ := strings.Cut(strings.TrimPrefix(key, ruleKeyPrefix), ":")
+		return ruleKeyPrefix + name
+	}
+	return TEMPLATE_DEFAULT
+}
+
+// templateSettings returns settings of template or rule, nil if it is not
+// configured
+func templateSettings(templates *TemplatesSection, rules Rules, name string) *BucketSettings {
+	if rule, ok := strings.CutPrefix(name, ruleKeyPrefix); ok {
+		return rules.settings(rule)
+	}
+	return templates.template(name)
+}
+
+// templateMaxKeys returns cap of keys of template or rule
+func templateMaxKeys(templates *TemplatesSection, rules Rules, name string) int {
+	if rule, ok := strings.CutPrefix(name, ruleKeyPrefix); ok {
+		return rules.maxKeys(rule)
+	}
+	return templates.maxKeys()
+}
+
+// decisionSubscription returns subscription decision of key is charged to,
+// creating it of template if key is not configured
+func (a *Api) decisionSubscription(key string) (*subscription, *ApiError) {
+	if sub, ok := a.subscription(key); ok {
+		if sub.template != "" {
+			a.templateKeys.touch(key)
+		}
+		return sub, nil
+	}
+
+	name := keyTemplate(key)
+	templates, rules := a.templates.Load(), *a.rules.Load()
+	settings := templateSettings(templates, rules, name)
+	if settings == nil {
+		return nil, apiError(403, ERROR_UNKNOWN_KEY, fmt.Sprintf("Unknown subscription '%s'", key))
+	}
+	sub, err := newSubscription(key, settings)
+	if err != nil {
+		// templates are validated on load
+		return nil, apiError(500, ERROR_INTERNAL, fmt.Sprintf("Internal error, err:'%s'", err))
+	}
+	sub.template = name
+
+	return a.addTemplateSubscription(key, sub, templateMaxKeys(templates, rules, name)), nil
+}
+
+// peekSubscription returns subscription of key without creating it, if key
+// is not configured subscription is of template and not added, name of the
+// template is returned then
+func (a *Api) peekSubscription(key string) (*subscription, string, *ApiError) {
+	if sub, ok := a.subscription(key); ok {
+		return sub, "", nil
+	}
+
+	name := keyTemplate(key)
+	settings := templateSettings(a.templates.Load(), *a.rules.Load(), name)
+	if settings == nil {
+		return nil, "", apiError(403, ERROR_UNKNOWN_KEY, fmt.Sprintf("Unknown subscription '%s'", key))
+	}
+	sub, err := newSubscription(key, settings)
+	if err != nil {
+		// templates are validated on load
+		return nil, "", apiError(500, ERROR_INTERNAL, fmt.Sprintf("Internal error, err:'%s'", err))
+	}
+	sub.template = name
+
+	a.limiterMutex.RLock()
+	state, ok := a.pendingStates[key]
+	a.limiterMutex.RUnlock()
+	if ok && sub.quota != nil {
+		sub.quota.Restore(state)
+	}
+	return sub, name, nil
+}
+
+// addTemplateSubscription adds subscription created of template unless
+// key was added meanwhile, subscriptions beyond maxKeys are dropped
+func (a *Api) addTemplateSubscription(key string, sub *subscription, maxKeys int) *subscription {
+	a.limiterMutex.Lock()
+	defer a.limiterMutex.Unlock()
+
+	if existing, ok := a.limiterMap[key]; ok {
+		return existing
+	}
+	if state, ok := a.pendingStates[key]; ok && sub.quota != nil {
+		// quota of key saved before restart
+		sub.quota.Restore(state)
+		delete(a.pendingStates, key)
+	}
+	a.addSubscriptionNoLock(key, sub)
+
+	a.dropTemplateKeysNoLock(a.templateKeys.add(key, maxKeys))
+
+	return sub
+}
+
+// dropTemplateKeysNoLock drops buckets of keys, quota usage is kept
+// pending, so key created again does not get quota of period again
+func (a *Api) dropTemplateKeysNoLock(keys []string) {
+	for _, key := range keys {
+		if sub, ok := a.limiterMap[key]; ok && sub.quota != nil {
+			a.pendingStates[key] = sub.quota.State()
+		}
+		delete(a.limiterMap, key)
+		a.scheduler.Remove(key)
+	}
+}
+
+// prunePendingStatesNoLock drops quota usage pending of keys which would
+// not be created with quota of the same period any more
+func (a *Api) prunePendingStatesNoLock(templates *TemplatesSection, rules Rules) {
+	for key, state := range a.pendingStates {
+		settings := templateSettings(templates, rules, keyTemplate(key))
+		if settings == nil || settings.Quota == nil {
+			delete(a.pendingStates, key)
+			continue
+		}
+		quota, err := settings.Quota.NewQuota()
+		if err != nil {
+			// validated before
+			continue
+		}
+		// usage of the past period is dropped on restore
+		if quota.Restore(state); quota.State().Used == 0 {
+			delete(a.pendingStates, key)
+		}
+	}
+}
+
+// applyTemplates recreates buckets of templates and rules changed keeping
+// their tokens and quota usage, buckets of templates and rules removed or
+// beyond maxKeys are dropped
+func (a *Api) applyTemplates(old *TemplatesSection, oldRules Rules, conf *TemplatesSection, rules Rules) {
+	a.limiterMutex.Lock()
+	defer a.limiterMutex.Unlock()
+
+	for key, prev := range a.limiterMap {
+		if prev.template == "" {
+			continue
+		}
+		settings := templateSettings(conf, rules, prev.template)
+		if settings == nil {
+			delete(a.limiterMap, key)
+			a.scheduler.Remove(key)
+			a.templateKeys.remove(key)
+			continue
+		}
+		if reflect.DeepEqual(settings, templateSettings(old, oldRules, prev.template)) {
+			continue
+		}
+		sub, err := newSubscription(key, settings)
+		if err != nil {
+			// validated before
+			continue
+		}
+		sub.template = prev.template
+		carryOver(prev, sub)
+		a.addSubscriptionNoLock(key, sub)
+	}
+
+	a.dropTemplateKeysNoLock(a.templateKeys.trim("", conf.maxKeys()))
+	for _, r := range rules {
+		a.dropTemplateKeysNoLock(a.templateKeys.trim(ruleKeyPrefix+r.name, r.maxKeys))
+	}
+	a.prunePendingStatesNoLock(conf, rules)
+}
@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	conf := &ConfYaml{
+		Templates: TemplatesSection{
+			Default:   &BucketSettings{Inflow: 1, Capacity: 5},
+			Anonymous: &BucketSettings{Inflow: 1, Capacity: 1},
+			MaxKeys:   2,
+		},
+		Buckets: BucketsSection{Buckets: map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 5}}},
+	}
+	api, r := testApiConf(t, conf)
+
+	for _, key := range []string{"x", "y", "x", "z"} {
+		if w := v1Request(r, "/v1/consume", `{"key":"`+key+`"}`); w.Code != 200 && w.Code != 429 {
+			t.Fatalf("%s: expected decision, got %d %s", key, w.Code, w.Body.String())
+		}
+	}
+	// "y" is the least recently used one
+	if _, ok := api.subscription("y"); ok {
+		t.Fatalf("expected bucket 'y' to be dropped")
+	}
+	for _, key := range []string{"a", "x", "z"} {
+		if _, ok := api.subscription(key); !ok {
+			t.Fatalf("expected bucket '%s'", key)
+		}
+	}
+	if sub, _ := api.subscription("x"); sub.template != TEMPLATE_DEFAULT || sub.limiter.BucketTokensCapacity.Load() != 5 {
+		t.Fatalf("expected bucket 'x' of default template")
+	}
+
+	// requests without key share bucket of client address
+	w := v1Request(r, "/v1/consume", `{}`)
+	var d DecisionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 || d.Key != "anonymous:192.0.2.1" {
+		t.Fatalf("expected anonymous decision, got %d %s", w.Code, w.Body.String())
+	}
+	if w := v1Request(r, "/v1/consume", `{"key":"anonymous:192.0.2.2"}`); w.Code != 403 {
+		t.Fatalf("expected reserved key to be rejected, got %d", w.Code)
+	}
+}
+
+func TestTemplatesTrustedProxies(t *testing.T) {
+	for _, c := range []struct {
+		proxies []string
+		key     string
+	}{
+		// X-Forwarded-For of client is spoofed
+		{nil, "anonymous:192.0.2.1"},
+		{[]string{"192.0.2.0/24"}, "anonymous:198.51.100.7"},
+	} {
+		api, _ := testApiConf(t, &ConfYaml{
+			RateLimiter: RateLimiterSection{TrustedProxies: c.proxies},
+			Templates:   TemplatesSection{Anonymous: &BucketSettings{Inflow: 1, Capacity: 1}},
+		})
+		r := api.routerEngine()
+
+		req := httptest.NewRequest("POST", "/v1/consume", strings.NewReader(`{}`))
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		var d DecisionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 || d.Key != c.key {
+			t.Fatalf("proxies %v: expected decision of '%s', got %d %s", c.proxies, c.key, w.Code, w.Body.String())
+		}
+	}
+
+	invalid := RateLimiterSection{Port: 8443, Certfile: "server.crt", Keyfile: "server.key", TrustedProxies: []string{"10.0.0"}}
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error of trusted proxy")
+	}
+}
+
+func TestTemplatesReject(t *testing.T) {
+	_, r := testApi(t, map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 5}})
+
+	if w := v1Request(r, "/v1/consume", `{}`); w.Code != 401 {
+		t.Fatalf("expected 401 without key, got %d", w.Code)
+	}
+	if w := testRequest(r, "GET", "/limiter", ""); w.Code != 401 {
+		t.Fatalf("expected 401 without key, got %d", w.Code)
+	}
+	if w := v1Request(r, "/v1/check", `{"key":"x"}`); w.Code != 403 {
+		t.Fatalf("expected 403 of unknown key, got %d", w.Code)
+	}
+}
+
+func TestTemplatesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimiter.yaml")
+	writeConf(t, path, `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+templates:
+  default:
+    "inflow": 1
+    "capacity": 10
+buckets:
+  "a":
+    "inflow": 1
+    "capacity": 5
+`)
+	conf, err := LoadConf(path, ConfigOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, r := testApiConf(t, &conf)
+
+	if w := v1Request(r, "/v1/consume", `{"key":"x"}`); w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	prev, _ := api.subscription("x")
+	prev.limiter.SetTokens(8)
+
+	// template is changed, bucket keeps its tokens
+	writeConf(t, path, `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+templates:
+  default:
+    "inflow": 1
+    "capacity": 4
+buckets:
+  "a":
+    "inflow": 1
+    "capacity": 5
+`)
+	if err := api.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if sub, _ := api.subscription("x"); sub == prev || sub.limiter.BucketTokensCapacity.Load() != 4 || sub.limiter.GetAvailable() != 4 {
+		t.Fatalf("expected bucket 'x' to be changed keeping tokens up to capacity")
+	}
+
+	// template is removed, so are its buckets
+	writeConf(t, path, `
+log:
+  log: "$DIR/quoter.log"
+  level: "info"
+buckets:
+  "a":
+    "inflow": 1
+    "capacity": 5
+`)
+	if err := api.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.subscription("x"); ok {
+		t.Fatalf("expected bucket 'x' to be removed")
+	}
+	if w := v1Request(r, "/v1/consume", `{"key":"x"}`); w.Code != 403 {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+}
+
+func TestTemplatesQuotaEvicted(t *testing.T) {
+	settings := &BucketSettings{Inflow: 1, Capacity: 10, Quota: &QuotaSettings{Limit: 3, Period: "daily", Timezone: "UTC"}}
+	api, r := testApiConf(t, &ConfYaml{Templates: TemplatesSection{Default: settings, MaxKeys: 1}})
+
+	decide := func(key string, cost int) DecisionResponse {
+		w := v1Request(r, "/v1/consume", fmt.Sprintf(`{"key":"%s","cost":%d}`, key, cost))
+		var d DecisionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	if d := decide("x", 3); !d.Allowed {
+		t.Fatalf("expected 'x' to be allowed, got %+v", d)
+	}
+	// "x" is dropped for "y", its quota usage is kept
+	decide("y", 1)
+	if _, ok := api.subscription("x"); ok {
+		t.Fatalf("expected bucket 'x' to be dropped")
+	}
+	if d := decide("x", 1); d.Allowed || d.Reason != ERROR_QUOTA_EXCEEDED {
+		t.Fatalf("expected quota of 'x' to be exceeded, got %+v", d)
+	}
+
+	// usage of "y" is pending, it is dropped once template has no quota
+	if _, ok := api.pendingStates["y"]; !ok {
+		t.Fatalf("expected quota usage of 'y' to be pending")
+	}
+	noQuota := &TemplatesSection{Default: &BucketSettings{Inflow: 1, Capacity: 10}, MaxKeys: 1}
+	rules := *api.rules.Load()
+	api.applyTemplates(api.templates.Swap(noQuota), rules, noQuota, rules)
+	if len(api.pendingStates) != 0 {
+		t.Fatalf("expected pending quota usage to be dropped, got %v", api.pendingStates)
+	}
+}
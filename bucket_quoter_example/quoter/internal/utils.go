@@ -1,6 +1,10 @@
 package internal
 
-import "os"
+import (
+	"net/netip"
+	"os"
+	"strings"
+)
 
 func Exists(name string) bool {
 	if _, err := os.Stat(name); err != nil {
@@ -10,3 +14,16 @@ func Exists(name string) bool {
 	}
 	return true
 }
+
+// parseNetwork parses CIDR or address, which is network of one address
+func parseNetwork(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		network, err := netip.ParsePrefix(s)
+		return network.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
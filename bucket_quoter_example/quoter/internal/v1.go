@@ -0,0 +1,396 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Versioned limiter API, request and response types below are the
+// contract, OpenAPI document is generated from them (see openapi.go)
+
+// machine-readable error codes
+const (
+	ERROR_BAD_REQUEST           = "bad_request"
+	ERROR_INVALID_COST          = "invalid_cost"
+	ERROR_UNKNOWN_KEY           = "unknown_key"
+	ERROR_COST_EXCEEDS_CAPACITY = "cost_exceeds_capacity"
+	ERROR_COST_EXCEEDS_QUOTA    = "cost_exceeds_quota"
+	ERROR_RATE_LIMITED          = "rate_limited"
+	ERROR_QUOTA_EXCEEDED        = "quota_exceeded"
+	ERROR_CONCURRENCY_LIMITED   = "concurrency_limited"
+	ERROR_UNKNOWN_LEASE         = "unknown_lease"
+	ERROR_INTERNAL              = "internal"
+)
+
+// ApiError describes request failed or denied
+type ApiError struct {
+	// HTTP status
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func apiError(status int, code string, message string) *ApiError {
+	return &ApiError{Status: status, Code: code, Message: message}
+}
+
+type ErrorResponse struct {
+	Error ApiError `json:"error"`
+}
+
+// DecisionRequest asks to check or consume tokens of subscription
+type DecisionRequest struct {
+	Key string `json:"key"`
+	// tokens, 1 if not set. Request passes while bucket is not in debt
+	// and takes its whole cost, so it may put bucket into debt.
+	Cost int64 `json:"cost,omitempty"`
+	// request of client matched by rules, optional
+	Request *RequestAttributes `json:"request,omitempty"`
+}
+
+// DecisionResponse is returned with 200 if request is allowed and with 429
+// if it is not
+type DecisionResponse struct {
+	Allowed bool   `json:"allowed"`
+	Key     string `json:"key"`
+	Cost    int64  `json:"cost"`
+	// error code of denial, "rate_limited", "quota_exceeded" or
+	// "concurrency_limited"
+	Reason string `json:"reason,omitempty"`
+	// rule denying request, empty if it is denied by subscription
+	Rule string `json:"rule,omitempty"`
+	// lease of request in flight to be released by /v1/release, set if
+	// subscription limits concurrency
+	Lease string `json:"lease,omitempty"`
+
+	RateLimit RateLimitInfo `json:"rateLimit"`
+	Quota     *QuotaInfo    `json:"quota,omitempty"`
+}
+
+// ReleaseRequest gives back lease of request done
+type ReleaseRequest struct {
+	Key   string `json:"key"`
+	Lease string `json:"lease"`
+}
+
+type ReleaseResponse struct {
+	Key   string `json:"key"`
+	Lease string `json:"lease"`
+	// requests in flight left
+	InFlight int `json:"inFlight"`
+}
+
+// LimitExplanation is decision of one bucket, nothing is charged
+type LimitExplanation struct {
+	Bucket string `json:"bucket"`
+	// template bucket would be created of, empty if bucket exists
+	Template string `json:"template,omitempty"`
+	Allowed  bool   `json:"allowed"`
+	// error code of denial
+	Reason    string         `json:"reason,omitempty"`
+	RateLimit *RateLimitInfo `json:"rateLimit,omitempty"`
+	Quota     *QuotaInfo     `json:"quota,omitempty"`
+}
+
+// RuleExplanation tells whether rule applies to request
+type RuleExplanation struct {
+	Rule     string `json:"rule"`
+	Priority int    `json:"priority"`
+	Matched  bool   `json:"matched"`
+	// why rule does not apply, empty if it does
+	Mismatch string `json:"mismatch,omitempty"`
+	// decision of rule bucket, set if rule applies
+	Limit *LimitExplanation `json:"limit,omitempty"`
+}
+
+// ExplainResponse tells how decision of request is made, every limit is
+// evaluated even if request is denied before
+type ExplainResponse struct {
+	Key     string `json:"key"`
+	Cost    int64  `json:"cost"`
+	Allowed bool   `json:"allowed"`
+	// error code and rule of the first limit denying request
+	Reason string `json:"reason,omitempty"`
+	Rule   string `json:"rule,omitempty"`
+	// in order of precedence
+	Rules        []RuleExplanation `json:"rules"`
+	Subscription LimitExplanation  `json:"subscription"`
+}
+
+type StateResponse struct {
+	State     BucketState   `json:"state"`
+	RateLimit RateLimitInfo `json:"rateLimit"`
+	Quota     *QuotaInfo    `json:"quota,omitempty"`
+}
+
+// v1Route is route of the API and its description for OpenAPI document
+type v1Route struct {
+	method  string
+	path    string
+	summary string
+	handler gin.HandlerFunc
+
+	// credentials are required if authentication is configured
+	authenticated bool
+
+	// nil if operation has no body
+	request   reflect.Type
+	responses map[int]reflect.Type
+	// description of response status, status text if not set
+	descriptions map[int]string
+}
+
+// decisionDescriptions tell contract of weighted cost: request passes while
+// bucket is not in debt and takes its whole cost, so it may put bucket into
+// debt, cost which could never pass is rejected
+var decisionDescriptions = map[int]string{
+	200: "Allowed, bucket is not in debt, whole cost is taken even if bucket goes into debt",
+	429: "Denied, bucket is in debt (paid back by inflow, see retryAfter), quota or concurrency limit is reached",
+	400: "Cost is not positive or exceeds bucket capacity or quota limit, retrying does not help",
+}
+
+func (a *Api) v1Routes() []v1Route {
+	decision := reflect.TypeOf(DecisionResponse{})
+	failure := reflect.TypeOf(ErrorResponse{})
+
+	return []v1Route{
+		{
+			method: "POST", path: "/v1/check", summary: "Checks whether request would be allowed, tokens are not consumed",
+			handler: a.v1Check, request: reflect.TypeOf(DecisionRequest{}),
+			responses:    map[int]reflect.Type{200: decision, 429: decision, 400: failure, 401: failure, 403: failure},
+			descriptions: decisionDescriptions,
+		},
+		{
+			method: "POST", path: "/v1/consume", summary: "Consumes tokens of subscription if request is allowed",
+			handler: a.v1Consume, request: reflect.TypeOf(DecisionRequest{}),
+			responses:    map[int]reflect.Type{200: decision, 429: decision, 400: failure, 401: failure, 403: failure},
+			descriptions: decisionDescriptions,
+		},
+		{
+			method: "POST", path: "/v1/release", summary: "Releases lease of request in flight taken by consume",
+			handler: a.v1Release, request: reflect.TypeOf(ReleaseRequest{}),
+			responses: map[int]reflect.Type{200: reflect.TypeOf(ReleaseResponse{}), 400: failure, 401: failure, 403: failure, 404: failure},
+		},
+		{
+			method: "POST", path: "/v1/explain", summary: "Explains rules and limits deciding request, tokens are not consumed",
+			handler: a.v1Explain, authenticated: true, request: reflect.TypeOf(DecisionRequest{}),
+			responses: map[int]reflect.Type{200: reflect.TypeOf(ExplainResponse{}), 400: failure, 401: failure, 403: failure},
+		},
+		{
+			method: "GET", path: "/v1/limiters/:key", summary: "Returns bucket and quota state of subscription",
+			handler: a.v1State, authenticated: true,
+			responses: map[int]reflect.Type{200: reflect.TypeOf(StateResponse{}), 401: failure, 403: failure, 404: failure},
+		},
+	}
+}
+
+// registerV1 adds /v1 routes and OpenAPI document of them
+func (a *Api) registerV1(r *gin.Engine) {
+	routes := a.v1Routes()
+	for _, route := range routes {
+		if route.authenticated {
+			r.Handle(route.method, route.path, a.authenticate, route.handler)
+		} else {
+			r.Handle(route.method, route.path, route.handler)
+		}
+	}
+
+	spec := openAPISpec(routes)
+	r.GET("/v1/openapi.json", func(c *gin.Context) {
+		a.apiSendJSON(c, 200, spec)
+	})
+}
+
+func (a *Api) v1SendError(c *gin.Context, err *ApiError) {
+	a.apiSendJSON(c, err.Status, ErrorResponse{Error: *err})
+}
+
+func (a *Api) v1Check(c *gin.Context) {
+	a.v1Decide(c, true)
+}
+
+func (a *Api) v1Consume(c *gin.Context) {
+	a.v1Decide(c, false)
+}
+
+func (a *Api) v1Decide(c *gin.Context, dryRun bool) {
+	if a.core == nil {
+		a.v1SendError(c, apiError(502, ERROR_INTERNAL, "Internal error"))
+		return
+	}
+
+	req, reqErr := bindDecision(c)
+	if reqErr != nil {
+		a.v1SendError(c, reqErr)
+		return
+	}
+
+	key, keyErr := a.requestKey(c, req.Key)
+	if keyErr != nil {
+		a.v1SendError(c, keyErr)
+		return
+	}
+	req.Key = key
+
+	d := a.decide(req.Key, a.requestAttributes(c, req.Request), req.Cost, dryRun, true)
+	if d.limiter == nil || (d.err != nil && d.err.Status != 429) {
+		a.v1SendError(c, d.err)
+		return
+	}
+
+	r := DecisionResponse{Allowed: d.err == nil, Key: req.Key, Cost: req.Cost, Rule: d.rule, Lease: d.lease}
+	r.RateLimit = *rateLimitInfo(c, d.limiter, d.err != nil)
+	if d.quota != nil {
+		r.Quota = quotaInfo(c, d.quota)
+	}
+
+	status := 200
+	if d.err != nil {
+		status = d.err.Status
+		r.Reason = d.err.Code
+		if d.err.Code == ERROR_QUOTA_EXCEEDED {
+			r.RateLimit.retryAfter(c, time.Until(r.Quota.Reset))
+		}
+	}
+	a.apiSendJSON(c, status, r)
+}
+
+// bindDecision returns decision request with cost defaulted
+func bindDecision(c *gin.Context) (*DecisionRequest, *ApiError) {
+	var req DecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return nil, apiError(400, ERROR_BAD_REQUEST, fmt.Sprintf("Invalid request, err:'%s'", err))
+	}
+	if req.Cost == 0 {
+		req.Cost = 1
+	}
+	if req.Cost < 0 {
+		return nil, apiError(400, ERROR_INVALID_COST, fmt.Sprintf("Invalid cost '%d', positive integer expected", req.Cost))
+	}
+	return &req, nil
+}
+
+func (a *Api) v1Explain(c *gin.Context) {
+	if a.core == nil {
+		a.v1SendError(c, apiError(502, ERROR_INTERNAL, "Internal error"))
+		return
+	}
+
+	req, reqErr := bindDecision(c)
+	if reqErr != nil {
+		a.v1SendError(c, reqErr)
+		return
+	}
+	attrs := a.requestAttributes(c, req.Request)
+
+	key, keyErr := subscriptionKey(c, req.Key)
+	if keyErr == nil && key == "" {
+		if key = a.anonymousKey(attrs.ClientIP); key == "" {
+			keyErr = apiError(400, ERROR_BAD_REQUEST, "Subscription key is required")
+		}
+	}
+	if keyErr == nil {
+		keyErr = authorizeRead(c, key)
+	}
+	if keyErr != nil {
+		a.v1SendError(c, keyErr)
+		return
+	}
+
+	_, rules := (*a.rules.Load()).apply(key, attrs)
+	r := ExplainResponse{Key: key, Cost: req.Cost, Allowed: true, Rules: rules}
+	for i := range r.Rules {
+		if limit := r.Rules[i].Limit; limit != nil {
+			a.explainLimit(limit, req.Cost)
+			if !limit.Allowed && r.Allowed {
+				r.Allowed, r.Reason, r.Rule = false, limit.Reason, r.Rules[i].Rule
+			}
+		}
+	}
+	r.Subscription.Bucket = key
+	a.explainLimit(&r.Subscription, req.Cost)
+	if !r.Subscription.Allowed && r.Allowed {
+		r.Allowed, r.Reason = false, r.Subscription.Reason
+	}
+
+	a.apiSendJSON(c, 200, r)
+}
+
+// explainLimit sets decision of limit bucket, nothing is charged or
+// created
+func (a *Api) explainLimit(limit *LimitExplanation, cost int64) {
+	d := a.consume(limit.Bucket, cost, true, false)
+	limit.Template = d.template
+	limit.Allowed = d.err == nil
+	if d.err != nil {
+		limit.Reason = d.err.Code
+	}
+	if d.limiter != nil {
+		// headers are of decisions, not of explanation
+		limit.RateLimit = bucketInfo(http.Header{}, d.limiter, d.err != nil)
+	}
+	if d.quota != nil {
+		limit.Quota = newQuotaInfo(d.quota)
+	}
+}
+
+func (a *Api) v1Release(c *gin.Context) {
+	if a.core == nil {
+		a.v1SendError(c, apiError(502, ERROR_INTERNAL, "Internal error"))
+		return
+	}
+
+	var req ReleaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		a.v1SendError(c, apiError(400, ERROR_BAD_REQUEST, fmt.Sprintf("Invalid request, err:'%s'", err)))
+		return
+	}
+
+	// callers release leases of their own keys only
+	key, keyErr := a.requestKey(c, req.Key)
+	if keyErr != nil {
+		a.v1SendError(c, keyErr)
+		return
+	}
+	sub, ok := a.subscription(key)
+	if !ok || sub.concurrency == nil || !sub.concurrency.Release(req.Lease) {
+		a.v1SendError(c, apiError(404, ERROR_UNKNOWN_LEASE, fmt.Sprintf("Unknown or expired lease '%s'", req.Lease)))
+		return
+	}
+
+	a.apiSendJSON(c, 200, ReleaseResponse{Key: key, Lease: req.Lease, InFlight: sub.concurrency.InFlight()})
+}
+
+func (a *Api) v1State(c *gin.Context) {
+	if a.core == nil {
+		a.v1SendError(c, apiError(502, ERROR_INTERNAL, "Internal error"))
+		return
+	}
+
+	key, keyErr := subscriptionKey(c, c.Param("key"))
+	if keyErr == nil {
+		keyErr = authorizeRead(c, key)
+	}
+	if keyErr != nil {
+		a.v1SendError(c, keyErr)
+		return
+	}
+	sub, ok := a.subscription(key)
+	if !ok {
+		a.v1SendError(c, apiError(404, ERROR_UNKNOWN_KEY, fmt.Sprintf("Unknown subscription '%s'", key)))
+		return
+	}
+
+	r := StateResponse{
+		State:     a.bucketState(key, sub.limiter),
+		RateLimit: *rateLimitInfo(c, sub.limiter, false),
+	}
+	if sub.quota != nil {
+		r.Quota = quotaInfo(c, sub.quota)
+	}
+	a.apiSendJSON(c, 200, r)
+}
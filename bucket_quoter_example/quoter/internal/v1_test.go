@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func v1Request(r *gin.Engine, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestV1Decisions(t *testing.T) {
+	_, r := testApi(t, map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 5}})
+
+	// check does not consume
+	for i := 0; i < 3; i++ {
+		w := v1Request(r, "/v1/check", `{"key":"a","cost":5}`)
+		var d DecisionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 || !d.Allowed || d.Cost != 5 || d.RateLimit.Limit != 5 {
+			t.Fatalf("expected allowed check, got %d %+v", w.Code, d)
+		}
+	}
+
+	if w := v1Request(r, "/v1/consume", `{"key":"a","cost":5}`); w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	w := v1Request(r, "/v1/consume", `{"key":"a"}`)
+	var d DecisionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 429 || d.Allowed || d.Reason != ERROR_RATE_LIMITED || d.Cost != 1 || d.RateLimit.RetryAfter == 0 {
+		t.Fatalf("expected rate limited decision, got %d %+v", w.Code, d)
+	}
+
+	errorCases := []struct {
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"/v1/consume", `{"key":"b"}`, 403, ERROR_UNKNOWN_KEY},
+		{"/v1/consume", `{"key":"a","cost":-1}`, 400, ERROR_INVALID_COST},
+		{"/v1/consume", `{"key":"a","cost":6}`, 400, ERROR_COST_EXCEEDS_CAPACITY},
+		{"/v1/check", `not json`, 400, ERROR_BAD_REQUEST},
+	}
+	for _, tc := range errorCases {
+		w := v1Request(r, tc.path, tc.body)
+		var e ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tc.status || e.Error.Code != tc.code || e.Error.Status != tc.status {
+			t.Fatalf("%s %s: expected %d %s, got %d %+v", tc.path, tc.body, tc.status, tc.code, w.Code, e)
+		}
+	}
+}
+
+func TestV1State(t *testing.T) {
+	_, r := testApi(t, map[string]*BucketSettings{"a": {Inflow: 1, Capacity: 5}})
+
+	w := testRequest(r, "GET", "/v1/limiters/a", "")
+	var s StateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 || s.State.Key != "a" || s.State.Capacity != 5 || s.RateLimit.Limit != 5 {
+		t.Fatalf("unexpected state %d %+v", w.Code, s)
+	}
+
+	if w := testRequest(r, "GET", "/v1/limiters/b", ""); w.Code != 404 {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestV1OpenAPI(t *testing.T) {
+	_, r := testApi(t, nil)
+
+	w := testRequest(r, "GET", "/v1/openapi.json", "")
+	var spec struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+				Required   []string                   `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.OpenAPI != openAPIVersion {
+		t.Fatalf("unexpected version %s", spec.OpenAPI)
+	}
+	for path, method := range map[string]string{"/v1/check": "post", "/v1/consume": "post", "/v1/limiters/{key}": "get"} {
+		if _, ok := spec.Paths[path][method]; !ok {
+			t.Fatalf("expected %s %s in %v", method, path, spec.Paths)
+		}
+	}
+
+	// debt of weighted cost is part of the contract
+	var consume struct {
+		Responses map[string]struct {
+			Description string `json:"description"`
+		} `json:"responses"`
+	}
+	if err := json.Unmarshal(spec.Paths["/v1/consume"]["post"], &consume); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(consume.Responses["429"].Description, "debt") || !strings.Contains(consume.Responses["400"].Description, "capacity") {
+		t.Fatalf("unexpected responses %+v", consume.Responses)
+	}
+
+	decision := spec.Components.Schemas["DecisionResponse"]
+	for _, field := range []string{"allowed", "key", "cost", "reason", "rateLimit", "quota"} {
+		if _, ok := decision.Properties[field]; !ok {
+			t.Fatalf("expected field %s in %v", field, decision.Properties)
+		}
+	}
+	if strings.Join(decision.Required, ",") != "allowed,key,cost,rateLimit" {
+		t.Fatalf("unexpected required fields %v", decision.Required)
+	}
+	for _, name := range []string{"RateLimitInfo", "QuotaInfo", "ErrorResponse", "ApiError", "BucketState", "DecisionRequest"} {
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Fatalf("expected schema %s", name)
+		}
+	}
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"quoter/cmd"
+	"quoter/internal"
 )
 
 const (
 	ExitCodeUnspecified = 1
+	// requests in flight were cut off on shutdown
+	ExitCodeDrainFailed = 2
 )
 
 func main() {
 	err := cmd.Execute()
+	if errors.Is(err, internal.ErrDrainTimeout) {
+		os.Exit(ExitCodeDrainFailed)
+	}
 	if err != nil {
 		os.Exit(ExitCodeUnspecified)
 	}